@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/a-pavlov/ged2k"
+	"github.com/a-pavlov/ged2k/proto"
+)
+
+func main() {
+	//file, err := os.OpenFile("gED2KLog.txt", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	//if err != nil {
+	//	log.Fatal(err)
+	//}
+
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	//log.SetOutput(file)
+
+	log.Println("GED2K has been started")
+	reader := bufio.NewReader(os.Stdin)
+	cfg := ged2k.Config{UserAgent: proto.EMULE, ListenPort: 4888, Name: "TestGed2k", MaxConnections: 100, ModName: "jed2k", ClientName: "jed2k", AppVersion: 0x3c, IncomingDir: "/home/inkpot/dev/incoming"}
+	s, err := ged2k.NewSession(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sub := s.Subscribe(ged2k.EVENT_CATEGORY_TRANSFER|ged2k.EVENT_CATEGORY_SERVER, 0)
+	go logEvents(sub)
+	s.Start()
+
+L:
+	for {
+		message, _ := reader.ReadString('\n')
+		cmd := strings.Split(strings.Trim(message, "\n"), " ")
+		switch cmd[0] {
+		case "quit":
+			break L
+		case "start":
+
+			//s.Connect("176.123.5.89:4725")
+			s.Connect("5.45.85.226:6584")
+		case "connect":
+			if len(cmd) > 1 {
+				s.Connect(cmd[1])
+			}
+		case "search":
+			search(s, strings.Join(cmd[1:], " "))
+		case "auto":
+			s.AutoConnect()
+		case "stop":
+			s.Disconnect()
+		case "slist":
+			s.GetServerList()
+		case "rescan":
+			s.Rescan()
+		case "link":
+			if len(cmd) > 1 {
+				if err := s.AddLink(strings.Join(cmd[1:], " ")); err != nil {
+					log.Println("Can not add link", err)
+				}
+			}
+		case "tran":
+			// tran name hash size [peers]
+			if len(cmd) > 3 {
+				size, err := strconv.ParseUint(cmd[3], 10, 64)
+				params := ged2k.TransferParams{Hash: proto.String2Hash(cmd[2]), Size: size, Filename: cmd[1]}
+				for _, x := range cmd[4:] {
+					params.Sources = append(params.Sources, proto.EndpointFromString(x))
+				}
+
+				if err == nil {
+					_, err = s.AddTransfer(params)
+				}
+
+				if err != nil {
+					log.Println("Can not add transfer", err)
+				}
+			}
+		case "load":
+			for _, x := range cmd[1:] {
+				if _, err := s.LoadTransfer(x); err != nil {
+					log.Println("Can not load transfer", err)
+				}
+			}
+		case "pause", "resume", "remove", "recheck":
+			// remove hash [data]
+			if len(cmd) > 1 {
+				if err := transferAction(s, cmd[0], proto.String2Hash(cmd[1]), len(cmd) > 2 && cmd[2] == "data"); err != nil {
+					log.Printf("Can not %s transfer: %v\n", cmd[0], err)
+				}
+			}
+		case "priority":
+			// priority hash begin end priority
+			if len(cmd) > 4 {
+				begin, _ := strconv.ParseUint(cmd[2], 10, 64)
+				end, _ := strconv.ParseUint(cmd[3], 10, 64)
+				priority, _ := strconv.Atoi(cmd[4])
+				if th := s.Transfer(proto.String2Hash(cmd[1])); th == nil {
+					log.Println("Transfer not found", cmd[1])
+				} else if err := th.SetPriority(begin, end, byte(priority)); err != nil {
+					log.Println("Can not set priority", err)
+				}
+			}
+		case "strategy":
+			if len(cmd) > 2 {
+				if th := s.Transfer(proto.String2Hash(cmd[1])); th == nil {
+					log.Println("Transfer not found", cmd[1])
+				} else if err := th.SetPickStrategy(cmd[2]); err != nil {
+					log.Println("Can not set pick strategy", err)
+				}
+			}
+		case "uploadpriority":
+			if len(cmd) > 2 {
+				priority, _ := strconv.Atoi(cmd[2])
+				s.SetUploadPriority(proto.String2Hash(cmd[1]), priority)
+			}
+		case "rep":
+			st := s.ServerStatus()
+			log.Printf("Server %s connected: %v low id: %v, last left %s reason: %s\n", st.Current.ToString(), st.Connected, st.LowId,
+				st.LastLeft.ToString(), ged2k.ServerLeaveReason2String(st.LastLeaveReason))
+		case "uq":
+			uq := s.UploadQueue()
+			log.Printf("Upload slots %d/%d waiting %d\n", len(uq.Slots), uq.MaxSlots, len(uq.Waiting))
+			for _, x := range uq.Slots {
+				log.Printf("slot %s file %s sent %d\n", x.Endpoint.ToString(), x.Hash.ToString(), x.Bytes)
+			}
+		case "status":
+			if len(cmd) > 1 {
+				printTransferStatus(s, proto.String2Hash(cmd[1]))
+				break
+			}
+
+			st := s.Status()
+			log.Printf("Server connected: %v peers %d shared %d download %d upload %d\n", st.Server.Connected, st.PeerConnections, st.SharedFiles, st.DownloadRate, st.UploadRate)
+			for _, x := range st.Transfers {
+				log.Printf("transfer %s %s paused %v finished %v peers %d download %d\n", x.Hash.ToString(), x.Filename, x.Paused, x.Finished, x.Peers, x.DownloadRate)
+			}
+		case "peers":
+			if len(cmd) > 1 {
+				if th := s.Transfer(proto.String2Hash(cmd[1])); th == nil {
+					log.Println("Transfer not found", cmd[1])
+				} else if peers, err := th.Peers(); err != nil {
+					log.Println("Can not get peers", err)
+				} else {
+					for _, x := range peers {
+						log.Printf("peer %s %s download %d requests %d\n", x.Endpoint.ToString(), x.ClientName, x.DownloadRate, len(x.Requests))
+					}
+				}
+			}
+		default:
+			log.Println("Unknown command", cmd[0])
+		}
+	}
+
+	s.Stop()
+}
+
+func search(s *ged2k.Session, query string) {
+	sh, err := s.Search(query)
+	if err != nil {
+		log.Println("Can not search", err)
+		return
+	}
+
+	go func() {
+		for items := range sh.Results() {
+			for _, x := range items {
+				log.Println("File", x.H.ToString(), x.Filename, "size", x.Filesize, "sources", x.Sources, "complete sources", x.CompleteSources)
+			}
+		}
+	}()
+}
+
+func logEvents(sub *ged2k.Subscription) {
+	for e := range sub.Events() {
+		switch x := e.(type) {
+		case ged2k.ServerConnectedEvent:
+			log.Printf("Connected to %s low id %v\n", x.Endpoint.ToString(), x.LowId)
+		case ged2k.ServerMessageEvent:
+			log.Println("Server message", x.Message)
+		case ged2k.TransferPausedEvent:
+			log.Println("Transfer paused", x.Hash.ToString())
+		case ged2k.TransferResumedEvent:
+			log.Println("Transfer resumed", x.Hash.ToString())
+		case ged2k.TransferFinishedEvent:
+			log.Println("Transfer finished", x.Hash.ToString())
+		case ged2k.TransferErrorEvent:
+			log.Println("Transfer error", x.Hash.ToString(), x.Err)
+		case ged2k.PieceHashFailedEvent:
+			log.Println("Transfer piece hash failed", x.Hash.ToString(), x.PieceIndex)
+		}
+	}
+}
+
+func printTransferStatus(s *ged2k.Session, hash proto.ED2KHash) {
+	th := s.Transfer(hash)
+	if th == nil {
+		log.Println("Transfer not found", hash.ToString())
+		return
+	}
+
+	st, err := th.Status()
+	if err != nil {
+		log.Println("Can not get status", err)
+		return
+	}
+
+	log.Printf("transfer %s downloaded %d verified %d of %d wanted, download %d eta %v\n", st.Filename, st.DownloadedBytes, st.VerifiedBytes, st.WantedBytes, st.DownloadRate, st.ETA)
+}
+
+func transferAction(s *ged2k.Session, action string, hash proto.ED2KHash, deleteData bool) error {
+	th := s.Transfer(hash)
+	if th == nil {
+		return fmt.Errorf("transfer %s not found", hash.ToString())
+	}
+
+	switch action {
+	case "pause":
+		return th.Pause()
+	case "resume":
+		return th.Resume()
+	case "recheck":
+		return th.Recheck()
+	default:
+		return th.Remove(deleteData)
+	}
+}
+
+// tran test.txt 460359517F89AE010793896EDE7D30F8 4 127.0.0.1:4662
+// tran 12.txt D8B5305980DB239B8888439603E518B1 12000000
+// OP_PUBLICIP_REQ
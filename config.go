@@ -1,4 +1,4 @@
-package main
+package ged2k
 
 import "github.com/a-pavlov/ged2k/proto"
 
@@ -16,4 +16,12 @@ type Config struct {
 	MaxConnections            int
 	ServerReconnectTimeoutSec int
 	IncomingDir               string
+	ServerMetFile             string
+	MaxServerFailCount        int
+	ServerAutoConnect         bool
+	MaxUploadRate             int
+	MaxUploadSlots            int
+	SharedDirs                []string
+	KnownMetFile              string
+	StreamAddress             string
 }
@@ -66,3 +66,13 @@ func Sub(seg1 Range, seg2 Range) []Range {
 func (region Region) Begin() uint64 {
 	return region.Segments[0].Begin
 }
+
+// Size returns total length of all segments
+func (region Region) Size() uint64 {
+	res := uint64(0)
+	for _, x := range region.Segments {
+		res += x.End - x.Begin
+	}
+
+	return res
+}
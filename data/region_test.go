@@ -70,6 +70,19 @@ func Test_PartialIntersectSub(t *testing.T) {
 	}
 }
 
+func Test_RegionSize(t *testing.T) {
+	rg := MakeRegion(Range{Begin: 100, End: 200})
+	rg.Sub(Range{Begin: 120, End: 150})
+	if rg.Size() != 70 {
+		t.Errorf("Region size is not correct %d", rg.Size())
+	}
+
+	rg.Sub(Range{Begin: 0, End: 300})
+	if rg.Size() != 0 {
+		t.Errorf("Empty region size is not correct %d", rg.Size())
+	}
+}
+
 func Test_FullIntersect(t *testing.T) {
 	rg := MakeRegion(Range{Begin: 0, End: 40})
 	rg.Sub(Range{Begin: 0, End: 10})
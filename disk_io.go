@@ -0,0 +1,219 @@
+package ged2k
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/a-pavlov/ged2k/proto"
+)
+
+// DISK_WORKERS is count of goroutines writing received blocks
+const DISK_WORKERS = 2
+
+// HASH_WORKERS is count of goroutines hashing pieces
+const HASH_WORKERS = 1
+
+// DISK_QUEUE_SIZE is count of write jobs waiting for a free worker
+const DISK_QUEUE_SIZE = 32
+
+// DISK_BATCH_SIZE limits count of adjacent blocks written by one job
+const DISK_BATCH_SIZE = 10
+
+// DISK_SYNC_INTERVAL is interval of flushing written data of files to the disk
+const DISK_SYNC_INTERVAL = 5 * time.Second
+
+// TRANSFER_WRITE_QUEUE_SIZE limits count of received blocks waiting for write, transfer stops
+// taking blocks from peer connections when the limit is reached, so peers stop reading sockets
+const TRANSFER_WRITE_QUEUE_SIZE = 20
+
+type diskWriteJob struct {
+	storage Storage
+	blocks  []*PendingBlock
+	res     chan diskWriteResult
+}
+
+type diskWriteResult struct {
+	blocks []*PendingBlock
+	err    error
+}
+
+// diskHashBlock has data of block kept in memory or nil when data is read from storage
+type diskHashBlock struct {
+	offset int64
+	size   int
+	data   []byte
+}
+
+// diskHashJob continues hashing of the piece, complete job has the last blocks of piece
+type diskHashJob struct {
+	pieceIndex int
+	hash       hash.Hash
+	storage    Storage
+	blocks     []diskHashBlock
+	complete   bool
+	res        chan diskHashResult
+}
+
+type diskHashResult struct {
+	pieceIndex int
+	complete   bool
+	hash       proto.ED2KHash // piece hash of complete job
+	err        error
+}
+
+// DiskIO writes blocks of all transfers by pool of workers and syncs written storages with interval
+type DiskIO struct {
+	jobs   chan diskWriteJob
+	hashes chan diskHashJob
+	done   chan struct{}
+	wg     sync.WaitGroup
+	mutex  sync.Mutex
+	dirty  map[Storage]bool
+}
+
+func NewDiskIO() *DiskIO {
+	return &DiskIO{
+		jobs:   make(chan diskWriteJob, DISK_QUEUE_SIZE),
+		hashes: make(chan diskHashJob, DISK_QUEUE_SIZE),
+		done:   make(chan struct{}),
+		dirty:  make(map[Storage]bool),
+	}
+}
+
+func (d *DiskIO) Start(workers int, hashers int) {
+	d.wg.Add(workers + hashers)
+	for i := 0; i < workers; i++ {
+		go d.worker()
+	}
+
+	for i := 0; i < hashers; i++ {
+		go d.hasher()
+	}
+
+	go d.syncLoop(DISK_SYNC_INTERVAL)
+}
+
+// Close stops workers when all jobs are done, it must be called after transfers stopped sending jobs
+func (d *DiskIO) Close() {
+	close(d.jobs)
+	close(d.hashes)
+	d.wg.Wait()
+	close(d.done)
+	d.syncStorages()
+}
+
+// Release stops periodic syncs of the storage, called by transfer before it finalizes the storage
+func (d *DiskIO) Release(storage Storage) {
+	d.mutex.Lock()
+	delete(d.dirty, storage)
+	d.mutex.Unlock()
+}
+
+func (d *DiskIO) worker() {
+	defer d.wg.Done()
+	for job := range d.jobs {
+		job.res <- diskWriteResult{blocks: job.blocks, err: d.write(job)}
+	}
+}
+
+func (d *DiskIO) hasher() {
+	defer d.wg.Done()
+	buffer := make([]byte, proto.BLOCK_SIZE)
+	for job := range d.hashes {
+		job.res <- d.hash(job, buffer)
+	}
+}
+
+// hash continues hashing of the piece by blocks of the job, buffer is used for blocks read from storage
+func (d *DiskIO) hash(job diskHashJob, buffer []byte) diskHashResult {
+	res := diskHashResult{pieceIndex: job.pieceIndex, complete: job.complete}
+	for _, x := range job.blocks {
+		data := x.data
+		if data == nil {
+			data = buffer[:x.size]
+			if n, err := job.storage.ReadAt(data, x.offset); n != len(data) {
+				res.err = fmt.Errorf("can not read block at %d for hashing: %v", x.offset, err)
+				return res
+			}
+		}
+
+		job.hash.Write(data)
+	}
+
+	if job.complete {
+		job.hash.Sum(res.hash[:0])
+	}
+
+	return res
+}
+
+// write writes adjacent blocks of the job by single call
+func (d *DiskIO) write(job diskWriteJob) error {
+	data := job.blocks[0].data
+	if len(job.blocks) > 1 {
+		size := 0
+		for _, x := range job.blocks {
+			size += len(x.data)
+		}
+
+		data = make([]byte, 0, size)
+		for _, x := range job.blocks {
+			data = append(data, x.data...)
+		}
+	}
+
+	if _, err := job.storage.WriteAt(data, int64(job.blocks[0].block.Start())); err != nil {
+		return err
+	}
+
+	if _, ok := job.storage.(syncer); ok {
+		d.mutex.Lock()
+		d.dirty[job.storage] = true
+		d.mutex.Unlock()
+	}
+	return nil
+}
+
+func (d *DiskIO) syncLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.syncStorages()
+		case <-d.done:
+			return
+		}
+	}
+}
+
+func (d *DiskIO) syncStorages() {
+	d.mutex.Lock()
+	storages := d.dirty
+	d.dirty = make(map[Storage]bool)
+	d.mutex.Unlock()
+
+	for x := range storages {
+		// storage could be released and finalized by transfer after it was taken
+		if err := x.(syncer).Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+			log.Printf("can not sync storage: %v\n", err)
+		}
+	}
+}
+
+// nextWriteBatch orders queue by offset and returns its first adjacent blocks to write by one job
+func nextWriteBatch(queue []*PendingBlock) []*PendingBlock {
+	sort.Slice(queue, func(i, j int) bool { return queue[i].block.Start() < queue[j].block.Start() })
+	n := 1
+	for n < len(queue) && n < DISK_BATCH_SIZE && queue[n-1].block.Start()+uint64(len(queue[n-1].data)) == queue[n].block.Start() {
+		n++
+	}
+
+	return queue[:n:n]
+}
@@ -0,0 +1,75 @@
+package ged2k
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/a-pavlov/ged2k/proto"
+)
+
+func makeFullBlock(pieceIndex int, blockIndex int, fill byte) *PendingBlock {
+	return &PendingBlock{block: proto.PieceBlock{PieceIndex: pieceIndex, BlockIndex: blockIndex}, data: bytes.Repeat([]byte{fill}, proto.BLOCK_SIZE)}
+}
+
+func Test_NextWriteBatch(t *testing.T) {
+	queue := []*PendingBlock{makeFullBlock(0, 3, 3), makeFullBlock(0, 1, 1), makeFullBlock(1, 0, 4), makeFullBlock(0, 2, 2)}
+	batch := nextWriteBatch(queue)
+	if len(batch) != 3 || batch[0].block.BlockIndex != 1 || batch[2].block.BlockIndex != 3 {
+		t.Errorf("Incorrect batch of adjacent blocks %d", len(batch))
+	}
+
+	if rest := queue[len(batch):]; len(rest) != 1 || rest[0].block.PieceIndex != 1 {
+		t.Error("Not adjacent block was not left in queue")
+	}
+
+	// the last block of piece is adjacent to the first block of the next piece
+	queue = []*PendingBlock{makeFullBlock(1, 0, 0), makeFullBlock(0, proto.BLOCKS_PER_PIECE-1, 0)}
+	if batch = nextWriteBatch(queue); len(batch) != 2 {
+		t.Errorf("Blocks of adjacent pieces were not batched %d", len(batch))
+	}
+
+	queue = []*PendingBlock{}
+	for i := 0; i < DISK_BATCH_SIZE+1; i++ {
+		queue = append(queue, makeFullBlock(0, i, 0))
+	}
+
+	if batch = nextWriteBatch(queue); len(batch) != DISK_BATCH_SIZE {
+		t.Errorf("Batch size was not limited %d", len(batch))
+	}
+}
+
+func Test_DiskIOWrite(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "a.bin")
+	storage, err := OpenFileStorage(filename, uint64(3*proto.BLOCK_SIZE), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDiskIO()
+	d.Start(DISK_WORKERS, HASH_WORKERS)
+	res := make(chan diskWriteResult, 2)
+	d.jobs <- diskWriteJob{storage: storage, blocks: []*PendingBlock{makeFullBlock(0, 1, 1), makeFullBlock(0, 2, 2)}, res: res}
+	d.jobs <- diskWriteJob{storage: storage, blocks: []*PendingBlock{makeFullBlock(0, 0, 7)}, res: res}
+	for i := 0; i < 2; i++ {
+		if r := <-res; r.err != nil {
+			t.Errorf("Blocks were not written %v", r.err)
+		}
+	}
+
+	d.Release(storage)
+	if len(d.dirty) != 0 {
+		t.Error("Storage was not released")
+	}
+
+	if err = storage.Finalize(); err != nil {
+		t.Error(err)
+	}
+
+	d.Close()
+	data, err := os.ReadFile(filename)
+	if err != nil || len(data) != 3*proto.BLOCK_SIZE || data[0] != 7 || data[proto.BLOCK_SIZE] != 1 || data[len(data)-1] != 2 {
+		t.Errorf("Incorrect file content %v", err)
+	}
+}
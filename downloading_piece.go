@@ -1,4 +1,4 @@
-package main
+package ged2k
 
 import (
 	"github.com/a-pavlov/ged2k/proto"
@@ -0,0 +1,231 @@
+package ged2k
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/a-pavlov/ged2k/proto"
+)
+
+const (
+	EVENT_CATEGORY_SERVER = 1 << iota
+	EVENT_CATEGORY_SEARCH
+	EVENT_CATEGORY_TRANSFER
+	EVENT_CATEGORY_PEER
+	EVENT_CATEGORY_ERROR
+)
+
+const EVENT_CATEGORY_ALL = EVENT_CATEGORY_SERVER | EVENT_CATEGORY_SEARCH | EVENT_CATEGORY_TRANSFER | EVENT_CATEGORY_PEER | EVENT_CATEGORY_ERROR
+
+// EVENT_QUEUE_SIZE is the default buffer size of subscription
+const EVENT_QUEUE_SIZE int = 1000
+
+// Event is published by the session, type switch on the concrete event type to get its data
+type Event interface {
+	Category() int
+}
+
+type ServerConnectedEvent struct {
+	Endpoint proto.Endpoint
+	ClientId uint32
+	LowId    bool
+}
+
+func (ServerConnectedEvent) Category() int { return EVENT_CATEGORY_SERVER }
+
+type ServerDisconnectedEvent struct {
+	Endpoint proto.Endpoint
+	Reason   int
+	Err      error
+}
+
+func (ServerDisconnectedEvent) Category() int { return EVENT_CATEGORY_SERVER }
+
+type ServerMessageEvent struct {
+	Message string
+}
+
+func (ServerMessageEvent) Category() int { return EVENT_CATEGORY_SERVER }
+
+type ServerStatusEvent struct {
+	UsersCount uint32
+	FilesCount uint32
+}
+
+func (ServerStatusEvent) Category() int { return EVENT_CATEGORY_SERVER }
+
+type SearchResultEvent struct {
+	Query string
+	Items []proto.SearchItem
+}
+
+func (SearchResultEvent) Category() int { return EVENT_CATEGORY_SEARCH }
+
+type SourcesFoundEvent struct {
+	Hash    proto.ED2KHash
+	Sources []proto.Endpoint
+}
+
+func (SourcesFoundEvent) Category() int { return EVENT_CATEGORY_TRANSFER }
+
+type TransferAddedEvent struct {
+	Hash     proto.ED2KHash
+	Filename string
+	Size     uint64
+}
+
+func (TransferAddedEvent) Category() int { return EVENT_CATEGORY_TRANSFER }
+
+type TransferFinishedEvent struct {
+	Hash proto.ED2KHash
+}
+
+func (TransferFinishedEvent) Category() int { return EVENT_CATEGORY_TRANSFER }
+
+type TransferPausedEvent struct {
+	Hash proto.ED2KHash
+}
+
+func (TransferPausedEvent) Category() int { return EVENT_CATEGORY_TRANSFER }
+
+type TransferResumedEvent struct {
+	Hash proto.ED2KHash
+}
+
+func (TransferResumedEvent) Category() int { return EVENT_CATEGORY_TRANSFER }
+
+type TransferRemovedEvent struct {
+	Hash proto.ED2KHash
+}
+
+func (TransferRemovedEvent) Category() int { return EVENT_CATEGORY_TRANSFER }
+
+type TransferErrorEvent struct {
+	Hash proto.ED2KHash
+	Err  error
+}
+
+func (TransferErrorEvent) Category() int { return EVENT_CATEGORY_TRANSFER | EVENT_CATEGORY_ERROR }
+
+type PieceHashFailedEvent struct {
+	Hash       proto.ED2KHash
+	PieceIndex int
+}
+
+func (PieceHashFailedEvent) Category() int { return EVENT_CATEGORY_TRANSFER | EVENT_CATEGORY_ERROR }
+
+// HashSetRejectedEvent reports peer which sent hash set not matching the transfer, peer is not connected anymore
+type HashSetRejectedEvent struct {
+	Hash     proto.ED2KHash
+	Endpoint proto.Endpoint
+	Err      error
+}
+
+func (HashSetRejectedEvent) Category() int { return EVENT_CATEGORY_TRANSFER | EVENT_CATEGORY_ERROR }
+
+// TransferRecheckedEvent reports count of pieces verified by recheck, error means recheck was not done
+// or data does not match the transfer hash
+type TransferRecheckedEvent struct {
+	Hash           proto.ED2KHash
+	Pieces         int
+	VerifiedPieces int
+	Err            error
+}
+
+func (TransferRecheckedEvent) Category() int { return EVENT_CATEGORY_TRANSFER }
+
+// ResumeDataErrorEvent reports resume data file which was not restored on start, orphaned file has no data file
+type ResumeDataErrorEvent struct {
+	File     string
+	Orphaned bool
+	Err      error
+}
+
+func (ResumeDataErrorEvent) Category() int { return EVENT_CATEGORY_TRANSFER | EVENT_CATEGORY_ERROR }
+
+type PeerConnectedEvent struct {
+	Endpoint proto.Endpoint
+	Hash     proto.ED2KHash
+}
+
+func (PeerConnectedEvent) Category() int { return EVENT_CATEGORY_PEER }
+
+type PeerDisconnectedEvent struct {
+	Endpoint proto.Endpoint
+	Err      error
+}
+
+func (PeerDisconnectedEvent) Category() int { return EVENT_CATEGORY_PEER }
+
+// Subscription receives session events of the requested categories. Events are dropped when subscriber
+// does not read them and buffer is full
+type Subscription struct {
+	categories int
+	events     chan Event
+	dropped    uint64
+}
+
+func (sub *Subscription) Events() <-chan Event {
+	return sub.events
+}
+
+// Dropped returns count of events dropped because of full buffer
+func (sub *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&sub.dropped)
+}
+
+// eventBus delivers events to subscribers, events are published from the session and transfer goroutines
+type eventBus struct {
+	mutex         sync.Mutex
+	subscriptions []*Subscription
+}
+
+func (eb *eventBus) subscribe(categories int, size int) *Subscription {
+	if size <= 0 {
+		size = EVENT_QUEUE_SIZE
+	}
+
+	sub := &Subscription{categories: categories, events: make(chan Event, size)}
+	eb.mutex.Lock()
+	defer eb.mutex.Unlock()
+	eb.subscriptions = append(eb.subscriptions, sub)
+	return sub
+}
+
+func (eb *eventBus) unsubscribe(sub *Subscription) {
+	eb.mutex.Lock()
+	defer eb.mutex.Unlock()
+	for i, x := range eb.subscriptions {
+		if x == sub {
+			eb.subscriptions = append(eb.subscriptions[:i], eb.subscriptions[i+1:]...)
+			close(sub.events)
+			break
+		}
+	}
+}
+
+func (eb *eventBus) publish(event Event) {
+	eb.mutex.Lock()
+	defer eb.mutex.Unlock()
+	for _, x := range eb.subscriptions {
+		if x.categories&event.Category() == 0 {
+			continue
+		}
+
+		select {
+		case x.events <- event:
+		default:
+			atomic.AddUint64(&x.dropped, 1)
+		}
+	}
+}
+
+// Subscribe returns subscription to events of categories, size limits count of buffered events, zero means default size
+func (s *Session) Subscribe(categories int, size int) *Subscription {
+	return s.events.subscribe(categories, size)
+}
+
+// Unsubscribe stops events delivery and closes events channel
+func (s *Session) Unsubscribe(sub *Subscription) {
+	s.events.unsubscribe(sub)
+}
@@ -0,0 +1,78 @@
+package ged2k
+
+import (
+	"testing"
+	"time"
+
+	"github.com/a-pavlov/ged2k/proto"
+)
+
+func Test_EventBus(t *testing.T) {
+	eb := eventBus{}
+	all := eb.subscribe(EVENT_CATEGORY_ALL, 2)
+	errors := eb.subscribe(EVENT_CATEGORY_ERROR, 0)
+
+	eb.publish(ServerMessageEvent{Message: "hello"})
+	eb.publish(PieceHashFailedEvent{Hash: proto.EMULE, PieceIndex: 3})
+	eb.publish(ServerStatusEvent{UsersCount: 1})
+
+	if all.Dropped() != 1 || errors.Dropped() != 0 || len(all.Events()) != 2 || len(errors.Events()) != 1 {
+		t.Errorf("Events delivery incorrect dropped %d, buffered %d and %d", all.Dropped(), len(all.Events()), len(errors.Events()))
+	}
+
+	if e, ok := (<-errors.Events()).(PieceHashFailedEvent); !ok || e.PieceIndex != 3 {
+		t.Errorf("Error event incorrect %v", e)
+	}
+
+	if e, ok := (<-all.Events()).(ServerMessageEvent); !ok || e.Message != "hello" {
+		t.Errorf("First event incorrect %v", e)
+	}
+
+	eb.unsubscribe(errors)
+	eb.publish(TransferErrorEvent{Hash: proto.EMULE})
+	if _, ok := <-errors.Events(); ok {
+		t.Error("Events channel was not closed on unsubscribe")
+	}
+}
+
+func Test_SessionTransferEvents(t *testing.T) {
+	s, err := NewSession(Config{IncomingDir: t.TempDir(), UserAgent: proto.EMULE})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub := s.Subscribe(EVENT_CATEGORY_TRANSFER, 0)
+	defer s.Unsubscribe(sub)
+	s.Start()
+	defer s.Stop()
+
+	th, err := s.AddTransfer(TransferParams{Hash: proto.EMULE, Size: 100, Filename: "a.bin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if th.Remove(false) != nil {
+		t.Fatal("Can not remove transfer")
+	}
+
+	expected := []Event{TransferAddedEvent{Hash: proto.EMULE}, TransferRemovedEvent{Hash: proto.EMULE}}
+	for _, x := range expected {
+		select {
+		case e := <-sub.Events():
+			switch v := e.(type) {
+			case TransferAddedEvent:
+				if _, ok := x.(TransferAddedEvent); !ok || v.Hash != proto.EMULE || v.Size != 100 {
+					t.Errorf("Unexpected event %v", e)
+				}
+			case TransferRemovedEvent:
+				if _, ok := x.(TransferRemovedEvent); !ok || v.Hash != proto.EMULE {
+					t.Errorf("Unexpected event %v", e)
+				}
+			default:
+				t.Errorf("Unexpected event %v", e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Event %v was not received", x)
+		}
+	}
+}
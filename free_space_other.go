@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !windows
+// +build !linux,!darwin,!windows
+
+package ged2k
+
+// freeSpace is unknown on this platform, preallocation is done without check
+func freeSpace(path string) (uint64, bool) {
+	return 0, false
+}
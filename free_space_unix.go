@@ -0,0 +1,16 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package ged2k
+
+import "syscall"
+
+// freeSpace returns bytes available to unprivileged user on file system of the path
+func freeSpace(path string) (uint64, bool) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, false
+	}
+
+	return uint64(st.Bavail) * uint64(st.Bsize), true
+}
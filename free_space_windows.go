@@ -0,0 +1,23 @@
+package ged2k
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// freeSpace returns bytes available to the current user on the volume of the path
+func freeSpace(path string) (uint64, bool) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, false
+	}
+
+	var available uint64
+	if r, _, _ := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&available)), 0, 0); r == 0 {
+		return 0, false
+	}
+
+	return available, true
+}
@@ -0,0 +1,176 @@
+package ged2k
+
+import (
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/a-pavlov/ged2k/proto"
+	"golang.org/x/crypto/md4"
+)
+
+// HashFile calculates ed2k hash set of the file, files with size multiple of PIECE_SIZE get additional hash of empty piece
+func HashFile(filename string) (proto.HashSet, uint64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return proto.HashSet{}, 0, err
+	}
+
+	defer file.Close()
+
+	var size uint64
+	hashes := make([]proto.ED2KHash, 0)
+	buffer := make([]byte, proto.PIECE_SIZE)
+	for {
+		n, err := io.ReadFull(file, buffer)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return proto.HashSet{}, 0, err
+		}
+
+		hasher := md4.New()
+		hasher.Write(buffer[:n])
+		h := proto.ED2KHash{}
+		hasher.Sum(h[:0])
+		hashes = append(hashes, h)
+		size += uint64(n)
+
+		if n < proto.PIECE_SIZE {
+			break
+		}
+	}
+
+	return proto.HashSet{Hash: proto.ResultHash(hashes), PieceHashes: hashes}, size, nil
+}
+
+func NewSharedFile(path string, size uint64, hashSet proto.HashSet) *SharedFile {
+	pieces, _ := proto.NumPiecesAndBlocks(size)
+	bf := proto.CreateBitField(pieces)
+	bf.SetAll()
+	return &SharedFile{Hash: hashSet.Hash, Size: size, Filename: path, HashSet: hashSet, Pieces: bf, Priority: UPLOAD_PRIORITY_NORMAL}
+}
+
+// Library scans shared directories and keeps hashes of the known files to avoid rehashing
+type Library struct {
+	known map[string]*proto.KnownFile
+	dirty bool
+}
+
+func MakeLibrary() Library {
+	return Library{known: make(map[string]*proto.KnownFile)}
+}
+
+func (l *Library) LoadKnown(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	km := proto.KnownMet{}
+	sb := proto.StateBuffer{Data: data}
+	sb.Read(&km)
+	if sb.Error() != nil {
+		return sb.Error()
+	}
+
+	for i := range km.Files {
+		if km.Files[i].Path != "" {
+			l.known[km.Files[i].Path] = &km.Files[i]
+		}
+	}
+
+	l.dirty = false
+	return nil
+}
+
+func (l *Library) SaveKnown(filename string) error {
+	km := proto.KnownMet{Header: proto.MET_HEADER, Files: make([]proto.KnownFile, 0, len(l.known))}
+	for _, x := range l.known {
+		if x.Filesize > math.MaxUint32 {
+			km.Header = proto.MET_HEADER_I64TAGS
+		}
+		km.Files = append(km.Files, *x)
+	}
+
+	data := make([]byte, km.Size())
+	sb := proto.StateBuffer{Data: data}
+	sb.Write(km)
+	if sb.Error() != nil {
+		return sb.Error()
+	}
+
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, data, 0666); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, filename); err != nil {
+		return err
+	}
+
+	l.dirty = false
+	return nil
+}
+
+// File returns shared file for the path using known files cache when path, size and modification time match
+func (l *Library) File(path string, info fs.FileInfo) (*SharedFile, error) {
+	size := uint64(info.Size())
+	date := uint32(info.ModTime().Unix())
+	if kf, ok := l.known[path]; ok && kf.Filesize == size && kf.Date == date && kf.HashSet.IsValid(size) {
+		return NewSharedFile(path, size, kf.HashSet), nil
+	}
+
+	log.Printf("hashing file %s\n", path)
+	hs, hashedSize, err := HashFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	l.known[path] = &proto.KnownFile{Date: date, HashSet: hs, Filename: filepath.Base(path), Path: path, Filesize: hashedSize}
+	l.dirty = true
+	return NewSharedFile(path, hashedSize, hs), nil
+}
+
+// Scan walks directories recursively and returns shared files for all not empty regular files except excluded
+func (l *Library) Scan(dirs []string, exclude map[string]bool) []*SharedFile {
+	res := make([]*SharedFile, 0)
+	for _, dir := range dirs {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				log.Printf("can not scan %s: %v\n", path, err)
+				return nil
+			}
+
+			if !d.Type().IsRegular() || exclude[path] || filepath.Ext(path) == ".rd" || filepath.Ext(path) == ".tmp" {
+				return nil
+			}
+
+			info, err := d.Info()
+			if err != nil {
+				log.Printf("can not stat %s: %v\n", path, err)
+				return nil
+			}
+
+			if info.Size() == 0 {
+				return nil
+			}
+
+			sf, err := l.File(path, info)
+			if err != nil {
+				log.Printf("can not hash %s: %v\n", path, err)
+				return nil
+			}
+
+			res = append(res, sf)
+			return nil
+		})
+
+		if err != nil {
+			log.Printf("can not scan directory %s: %v\n", dir, err)
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,94 @@
+package ged2k
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/a-pavlov/ged2k/proto"
+)
+
+func Test_HashFile(t *testing.T) {
+	dir := t.TempDir()
+	small := filepath.Join(dir, "small.txt")
+	if err := os.WriteFile(small, []byte{}, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	hs, size, err := HashFile(small)
+	if err != nil || size != 0 || len(hs.PieceHashes) != 1 || hs.Hash != proto.Terminal {
+		t.Errorf("Empty file hash incorrect %v %v", hs, err)
+	}
+
+	exact := filepath.Join(dir, "exact.bin")
+	if err := os.WriteFile(exact, make([]byte, proto.PIECE_SIZE), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	hs, size, err = HashFile(exact)
+	if err != nil || size != proto.PIECE_SIZE_UINT64 || !hs.IsValid(size) || hs.PieceHashes[1] != proto.Terminal {
+		t.Errorf("Exact piece file hash incorrect %v %v", hs, err)
+	}
+
+	tail := filepath.Join(dir, "tail.bin")
+	if err := os.WriteFile(tail, make([]byte, proto.PIECE_SIZE+10), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	hs2, size, err := HashFile(tail)
+	if err != nil || size != proto.PIECE_SIZE_UINT64+10 || !hs2.IsValid(size) || hs2.PieceHashes[0] != hs.PieceHashes[0] || hs2.PieceHashes[1] == proto.Terminal {
+		t.Errorf("File with tail hash incorrect %v %v", hs2, err)
+	}
+}
+
+func Test_LibraryKnownFiles(t *testing.T) {
+	dir := t.TempDir()
+	shared := filepath.Join(dir, "shared")
+	if err := os.Mkdir(shared, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	filename := filepath.Join(shared, "a.txt")
+	if err := os.WriteFile(filename, []byte("some data"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(shared, "b.txt"), []byte("excluded"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	knownMet := filepath.Join(dir, "known.met")
+	library := MakeLibrary()
+	files := library.Scan([]string{shared}, map[string]bool{filepath.Join(shared, "b.txt"): true})
+	if len(files) != 1 || files[0].Filename != filename || files[0].Size != 9 || !files[0].HaveRange(0, 9) {
+		t.Fatalf("Library scan result incorrect %v", files)
+	}
+
+	if err := library.SaveKnown(knownMet); err != nil {
+		t.Fatalf("Can not save known files %v", err)
+	}
+
+	// replace cached hash to check the cache is used instead of hashing
+	library2 := MakeLibrary()
+	if err := library2.LoadKnown(knownMet); err != nil {
+		t.Fatalf("Can not load known files %v", err)
+	}
+
+	library2.known[filename].HashSet = proto.HashSet{Hash: proto.EMULE, PieceHashes: []proto.ED2KHash{proto.EMULE}}
+	files = library2.Scan([]string{shared}, map[string]bool{filepath.Join(shared, "b.txt"): true})
+	if len(files) != 1 || files[0].Hash != proto.EMULE || library2.dirty {
+		t.Error("Known file cache was not used")
+	}
+
+	// modification time changed - file must be rehashed
+	mtime := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filename, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	files = library2.Scan([]string{shared}, map[string]bool{filepath.Join(shared, "b.txt"): true})
+	if len(files) != 1 || files[0].Hash == proto.EMULE || !library2.dirty {
+		t.Error("Modified file was not rehashed")
+	}
+}
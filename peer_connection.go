@@ -1,4 +1,4 @@
-package main
+package ged2k
 
 import (
 	"bytes"
@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
+	"path/filepath"
 
 	"github.com/a-pavlov/ged2k/data"
 	"github.com/a-pavlov/ged2k/proto"
@@ -44,28 +46,71 @@ func RemovePendingBlock(s []*PendingBlock, i int) []*PendingBlock {
 }
 
 func (pb *PendingBlock) Receive(reader io.Reader, begin uint64, end uint64) (int, error) {
+	if begin > end || begin < pb.block.Start() || end > pb.block.Start()+uint64(len(pb.data)) {
+		return 0, fmt.Errorf("range [%d:%d] is out of block %s", begin, end, pb.block.ToString())
+	}
+
 	inBlockOffset := proto.InBlockOffset(begin)
 	chunkLen := int(end - begin)
 	n, err := io.ReadFull(reader, pb.data[inBlockOffset:inBlockOffset+chunkLen])
 	log.Printf("pending block [%d:%d] receive %d bytes offset %d\n", pb.block.PieceIndex, pb.block.BlockIndex, chunkLen, inBlockOffset)
-	if err == nil {
-		if n != chunkLen {
-			return n, fmt.Errorf("not enough bytes")
+	// bytes read before the connection was lost are kept, so only the rest of the block is requested again
+	pb.region.Sub(data.Range{Begin: begin, End: begin + uint64(n)})
+	return n, err
+}
+
+// ReceiveToEof receives unpacked data of the missing segment starting at begin, peer sends one part per requested segment
+func (pb *PendingBlock) ReceiveToEof(reader io.Reader, begin uint64) (int, error) {
+	end := uint64(0)
+	for _, x := range pb.region.Segments {
+		if x.Begin <= begin && begin < x.End {
+			end = x.End
+			break
 		}
-		pb.region.Sub(data.Range{Begin: begin, End: end})
 	}
 
+	if end == 0 {
+		return 0, fmt.Errorf("offset %d of block %s was not requested", begin, pb.block.ToString())
+	}
+
+	inBlockOffset := proto.InBlockOffset(begin)
+	n, err := io.ReadFull(reader, pb.data[inBlockOffset:inBlockOffset+int(end-begin)])
+	pb.region.Sub(data.Range{Begin: begin, End: begin + uint64(n)})
 	return n, err
 }
 
-func (pb *PendingBlock) ReceiveToEof(reader io.Reader, begin uint64) (int, error) {
-	inBlockOffset := proto.InBlockOffset(begin)
-	n, err := io.ReadFull(reader, pb.data[inBlockOffset:])
-	if err == nil {
-		pb.region.Sub(data.Range{Begin: begin, End: begin + uint64(n)})
+// IsPartial returns true when block has received data but is not complete
+func (pb *PendingBlock) IsPartial() bool {
+	return !pb.region.IsEmpty() && pb.region.Size() < uint64(len(pb.data))
+}
+
+// MakeRequestParts64 requests missing segments of blocks, segments are packed by PARTS_IN_REQUEST per packet
+func MakeRequestParts64(hash proto.ED2KHash, blocks []*PendingBlock) []proto.RequestParts64 {
+	res := []proto.RequestParts64{}
+	i := 0
+	for _, pb := range blocks {
+		for _, x := range pb.region.Segments {
+			if i%proto.PARTS_IN_REQUEST == 0 {
+				res = append(res, proto.RequestParts64{Hash: hash})
+			}
+			res[len(res)-1].BeginOffset[i%proto.PARTS_IN_REQUEST] = x.Begin
+			res[len(res)-1].EndOffset[i%proto.PARTS_IN_REQUEST] = x.End
+			i++
+		}
 	}
 
-	return n, err
+	return res
+}
+
+// isDownloadAnswer returns true for packets which are sent only in answer to requests of downloading transfer
+func isDownloadAnswer(packet byte) bool {
+	switch packet {
+	case proto.OP_REQFILENAMEANSWER, proto.OP_FILESTATUS, proto.OP_HASHSETANSWER, proto.OP_ACCEPTUPLOADREQ,
+		proto.OP_SENDINGPART, proto.OP_SENDINGPART_I64, proto.OP_COMPRESSEDPART, proto.OP_COMPRESSEDPART_I64:
+		return true
+	}
+
+	return false
 }
 
 type AbortPendingBlock struct {
@@ -80,9 +125,23 @@ type PeerConnectionPacket struct {
 
 type StatPacket struct {
 	Connection *PeerConnection
+	UserHash   proto.ED2KHash
 	Counter    int
 }
 
+// PeerInfo describes remote client from its hello packet
+type PeerInfo struct {
+	UserHash      proto.ED2KHash
+	ClientName    string
+	ClientVersion uint32
+	ModName       string
+}
+
+type PeerInfoPacket struct {
+	Connection *PeerConnection
+	Info       PeerInfo
+}
+
 type PeerConnection struct {
 	connection      net.Conn
 	transfer        *Transfer
@@ -95,6 +154,14 @@ type PeerConnection struct {
 	Speed           int
 	requestedBlocks []*PendingBlock
 	closedByRequest bool
+	remotePieces    bool
+	// info is owned by the session goroutine
+	info PeerInfo
+
+	// upload section
+	remoteHash    proto.ED2KHash
+	remoteOptions proto.MiscOptions
+	uploadFile    *SharedFile
 }
 
 func NewPeerConnection(e proto.Endpoint, transfer *Transfer, p *Peer) *PeerConnection {
@@ -102,7 +169,7 @@ func NewPeerConnection(e proto.Endpoint, transfer *Transfer, p *Peer) *PeerConne
 }
 
 func (peerConnection *PeerConnection) Start(s *Session) {
-	log.Println("Peer connection start", peerConnection.peer.endpoint.ToString())
+	log.Println("Peer connection start", peerConnection.Endpoint.ToString())
 	if peerConnection.connection == nil {
 		conn, err := net.Dial("tcp", peerConnection.peer.endpoint.ToString())
 		if err != nil {
@@ -110,7 +177,7 @@ func (peerConnection *PeerConnection) Start(s *Session) {
 			peerConnection.unregister(s, err)
 			return
 		}
-		hello := proto.Hello{Answer: s.CreateHelloAnswer(), HashLength: byte(proto.HASH_LEN)}
+		hello := proto.Hello{Answer: s.createHelloAnswer(), HashLength: byte(proto.HASH_LEN)}
 		peerConnection.connection = conn
 		s.registerPeerConnection <- peerConnection
 		peerConnection.SendPacket(s, proto.OP_EDONKEYPROT, proto.OP_HELLO, &hello)
@@ -130,6 +197,13 @@ func (peerConnection *PeerConnection) Start(s *Session) {
 
 		peerConnection.recvStat(s, len(packetBytes)+ph.Size()-1)
 
+		// inbound connection has no transfer, so answers to download requests could be sent by remote peer unsolicited
+		if peerConnection.transfer == nil && isDownloadAnswer(ph.Packet) {
+			lastError = fmt.Errorf("unexpected packet %x on connection without transfer", ph.Packet)
+			log.Printf("stop peer connection by error %v\n", lastError)
+			break
+		}
+
 		sb := proto.StateBuffer{Data: packetBytes}
 
 		switch {
@@ -142,7 +216,10 @@ func (peerConnection *PeerConnection) Start(s *Session) {
 				break
 			}
 			// obtain peer information
-			helloAnswer := s.CreateHelloAnswer()
+			peerConnection.remoteHash = hello.Answer.Hash
+			peerConnection.readRemoteOptions(hello.Answer.Properties)
+			s.peerInfoChan <- PeerInfoPacket{Connection: peerConnection, Info: readPeerInfo(hello.Answer.Hash, hello.Answer.Properties)}
+			helloAnswer := s.createHelloAnswer()
 			peerConnection.SendPacket(s, proto.OP_EDONKEYPROT, proto.OP_HELLOANSWER, &helloAnswer)
 		case ph.Packet == proto.OP_HELLOANSWER:
 			log.Println("Peer connection: HELLO_ANSWER")
@@ -153,7 +230,12 @@ func (peerConnection *PeerConnection) Start(s *Session) {
 				break
 			}
 
-			peerConnection.SendPacket(s, proto.OP_EDONKEYPROT, proto.OP_REQUESTFILENAME, &peerConnection.transfer.Hash)
+			peerConnection.remoteHash = helloAnswer.Hash
+			peerConnection.readRemoteOptions(helloAnswer.Properties)
+			s.peerInfoChan <- PeerInfoPacket{Connection: peerConnection, Info: readPeerInfo(helloAnswer.Hash, helloAnswer.Properties)}
+			if peerConnection.transfer != nil {
+				peerConnection.SendPacket(s, proto.OP_EDONKEYPROT, proto.OP_REQUESTFILENAME, &peerConnection.transfer.Hash)
+			}
 		case ph.Packet == proto.OP_PUBLICIP_REQ && ph.Protocol == proto.OP_EMULEPROT:
 			log.Println("Public IP request has been received")
 			ep, err := proto.FromString("192.168.111.11:9999")
@@ -162,6 +244,19 @@ func (peerConnection *PeerConnection) Start(s *Session) {
 				peerConnection.SendPacket(s, proto.OP_EMULEPROT, proto.OP_PUBLICIP_ANSWER, &ip)
 			}
 		case ph.Packet == proto.OP_REQUESTFILENAME:
+			hash := proto.ED2KHash{}
+			sb.Read(&hash)
+			if sb.Error() != nil {
+				lastError = sb.Error()
+				break
+			}
+
+			if peerConnection.requestUploadFile(s, hash) {
+				fa := proto.FileAnswer{Hash: hash, Name: proto.String2ByteContainer(filepath.Base(peerConnection.uploadFile.Filename))}
+				peerConnection.SendPacket(s, proto.OP_EDONKEYPROT, proto.OP_REQFILENAMEANSWER, &fa)
+			} else {
+				peerConnection.SendPacket(s, proto.OP_EDONKEYPROT, proto.OP_FILEREQANSNOFIL, &hash)
+			}
 		case ph.Packet == proto.OP_REQFILENAMEANSWER:
 			fa := proto.FileAnswer{}
 			sb.Read(&fa)
@@ -177,6 +272,19 @@ func (peerConnection *PeerConnection) Start(s *Session) {
 			// sent OP_REQUESTFILENAME
 		case ph.Packet == proto.OP_SETREQFILEID:
 			// got file status request
+			hash := proto.ED2KHash{}
+			sb.Read(&hash)
+			if sb.Error() != nil {
+				lastError = sb.Error()
+				break
+			}
+
+			if peerConnection.requestUploadFile(s, hash) {
+				fs := peerConnection.uploadFile.FileStatus()
+				peerConnection.SendPacket(s, proto.OP_EDONKEYPROT, proto.OP_FILESTATUS, &fs)
+			} else {
+				peerConnection.SendPacket(s, proto.OP_EDONKEYPROT, proto.OP_FILEREQANSNOFIL, &hash)
+			}
 		case ph.Packet == proto.OP_FILESTATUS:
 			fs := proto.FileStatusAnswer{}
 			sb.Read(&fs)
@@ -187,12 +295,19 @@ func (peerConnection *PeerConnection) Start(s *Session) {
 			}
 
 			log.Println("File status received, bits:", fs.BF.Bits(), "count", fs.BF.Count())
+			if peerConnection.peer != nil {
+				peerConnection.transfer.addPeerPieces(peerConnection.peer, fs.BF)
+				peerConnection.remotePieces = true
+			}
 
 			if peerConnection.transfer.Size >= proto.PIECE_SIZE_UINT64 {
 				peerConnection.SendPacket(s, proto.OP_EDONKEYPROT, proto.OP_HASHSETREQUEST, &peerConnection.transfer.Hash)
 			} else {
 				hs := proto.HashSet{Hash: peerConnection.transfer.Hash, PieceHashes: []proto.ED2KHash{peerConnection.transfer.Hash}}
-				peerConnection.transfer.hashSetChan <- &hs
+				if !peerConnection.transfer.receiveHashSet(&hs) {
+					lastError = fmt.Errorf("transfer %s is closed", hs.Hash.ToString())
+					break
+				}
 				peerConnection.SendPacket(s, proto.OP_EDONKEYPROT, proto.OP_STARTUPLOADREQ, &hs.Hash)
 			}
 		case ph.Packet == proto.OP_FILEREQANSNOFIL:
@@ -200,6 +315,18 @@ func (peerConnection *PeerConnection) Start(s *Session) {
 			lastError = fmt.Errorf("no file answer received")
 		case ph.Packet == proto.OP_HASHSETREQUEST:
 			// hash set request received
+			hash := proto.ED2KHash{}
+			sb.Read(&hash)
+			if sb.Error() != nil {
+				lastError = sb.Error()
+				break
+			}
+
+			if peerConnection.requestUploadFile(s, hash) {
+				peerConnection.SendPacket(s, proto.OP_EDONKEYPROT, proto.OP_HASHSETANSWER, &peerConnection.uploadFile.HashSet)
+			} else {
+				peerConnection.SendPacket(s, proto.OP_EDONKEYPROT, proto.OP_FILEREQANSNOFIL, &hash)
+			}
 		case ph.Packet == proto.OP_HASHSETANSWER:
 			// got hash set answer
 			hs := proto.HashSet{}
@@ -212,22 +339,77 @@ func (peerConnection *PeerConnection) Start(s *Session) {
 				log.Println("Received hash set answer")
 			}
 
-			peerConnection.transfer.hashSetChan <- &hs
+			// peer which sent invalid hash set is disconnected and not used anymore
+			if lastError = validateHashSet(&hs, peerConnection.transfer.Hash, peerConnection.transfer.Size); lastError != nil {
+				break
+			}
+
+			if !peerConnection.transfer.receiveHashSet(&hs) {
+				lastError = fmt.Errorf("transfer %s is closed", hs.Hash.ToString())
+				break
+			}
+
 			peerConnection.SendPacket(s, proto.OP_EDONKEYPROT, proto.OP_STARTUPLOADREQ, &hs.Hash)
 		case ph.Packet == proto.OP_STARTUPLOADREQ:
 			// receive start upload request
+			hash := proto.ED2KHash{}
+			sb.Read(&hash)
+			if sb.Error() != nil {
+				lastError = sb.Error()
+				break
+			}
+
+			if !peerConnection.requestUploadFile(s, hash) {
+				peerConnection.SendPacket(s, proto.OP_EDONKEYPROT, proto.OP_FILEREQANSNOFIL, &hash)
+				break
+			}
+
+			rank := s.requestUploadSlot(peerConnection, hash)
+			switch {
+			case rank == 0:
+				peerConnection.SendPacket(s, proto.OP_EDONKEYPROT, proto.OP_ACCEPTUPLOADREQ, nil)
+			case rank > 0:
+				qr := proto.QueueRanking{Rank: uint16(Min(uint64(rank), math.MaxUint16))}
+				peerConnection.SendPacket(s, proto.OP_EMULEPROT, proto.OP_QUEUERANKING, &qr)
+			default:
+				lastError = fmt.Errorf("upload queue is full")
+			}
 		case ph.Packet == proto.OP_ACCEPTUPLOADREQ:
 			log.Println("received accept uploadow req")
-			peerConnection.transfer.peerConnChan <- peerConnection
+			if !peerConnection.transfer.readyToDownload(peerConnection) {
+				lastError = fmt.Errorf("transfer %s is closed", peerConnection.transfer.Hash.ToString())
+			}
 			// got accept upload
 		case ph.Packet == proto.OP_QUEUERANKING:
-			lastError = fmt.Errorf("queue ranked: %d", sb.ReadUint16())
+			qr := proto.QueueRanking{}
+			sb.Read(&qr)
+			lastError = fmt.Errorf("queue ranked: %d", qr.Rank)
 		case ph.Packet == proto.OP_OUTOFPARTREQS:
 			lastError = fmt.Errorf("out of parts")
 		case ph.Packet == proto.OP_REQUESTPARTS:
 			// got 32 request parts request
+			rp := proto.RequestParts32{}
+			sb.Read(&rp)
+			if sb.Error() != nil {
+				lastError = sb.Error()
+				break
+			}
+
+			for i := 0; i < proto.PARTS_IN_REQUEST && lastError == nil; i++ {
+				lastError = peerConnection.uploadRange(s, rp.Hash, uint64(rp.BeginOffset[i]), uint64(rp.EndOffset[i]))
+			}
 		case ph.Packet == proto.OP_REQUESTPARTS_I64:
 			// got 64 request parts request
+			rp := proto.RequestParts64{}
+			sb.Read(&rp)
+			if sb.Error() != nil {
+				lastError = sb.Error()
+				break
+			}
+
+			for i := 0; i < proto.PARTS_IN_REQUEST && lastError == nil; i++ {
+				lastError = peerConnection.uploadRange(s, rp.Hash, rp.BeginOffset[i], rp.EndOffset[i])
+			}
 		case ph.Packet == proto.OP_SENDINGPART || ph.Packet == proto.OP_SENDINGPART_I64:
 			sp := proto.SendingPart{Extended: ph.Packet == proto.OP_SENDINGPART_I64}
 			sb.Read(&sp)
@@ -255,11 +437,17 @@ func (peerConnection *PeerConnection) Start(s *Session) {
 						}
 
 						if x.region.IsEmpty() {
-							peerConnection.transfer.dataChan <- x
+							if !peerConnection.transfer.receiveBlock(x) {
+								lastError = fmt.Errorf("transfer %s is closed", peerConnection.transfer.Hash.ToString())
+								break
+							}
+
 							peerConnection.requestedBlocks = RemovePendingBlock(peerConnection.requestedBlocks, i)
 							if len(peerConnection.requestedBlocks) == 0 {
 								// all blocks completed
-								peerConnection.transfer.peerConnChan <- peerConnection
+								if !peerConnection.transfer.readyToDownload(peerConnection) {
+									lastError = fmt.Errorf("transfer %s is closed", peerConnection.transfer.Hash.ToString())
+								}
 							}
 						}
 					}
@@ -320,10 +508,16 @@ func (peerConnection *PeerConnection) Start(s *Session) {
 					}
 
 					if x.region.IsEmpty() {
-						peerConnection.transfer.dataChan <- x
+						if !peerConnection.transfer.receiveBlock(x) {
+							lastError = fmt.Errorf("transfer %s is closed", peerConnection.transfer.Hash.ToString())
+							break
+						}
+
 						peerConnection.requestedBlocks = RemovePendingBlock(peerConnection.requestedBlocks, i)
 						if len(peerConnection.requestedBlocks) == 0 {
-							peerConnection.transfer.peerConnChan <- peerConnection
+							if !peerConnection.transfer.readyToDownload(peerConnection) {
+								lastError = fmt.Errorf("transfer %s is closed", peerConnection.transfer.Hash.ToString())
+							}
 						}
 					}
 					break
@@ -352,6 +546,11 @@ func (peerConnection *PeerConnection) Start(s *Session) {
 }
 
 func (connection *PeerConnection) SendPacket(s *Session, protocol byte, packet byte, data proto.Serializable) {
+	connection.SendPacketWithData(s, protocol, packet, data, nil)
+}
+
+// SendPacketWithData sends packet followed by raw payload like file data in OP_SENDINGPART
+func (connection *PeerConnection) SendPacketWithData(s *Session, protocol byte, packet byte, data proto.Serializable, payload []byte) {
 	if data == nil {
 		b := make([]byte, proto.HEADER_SIZE)
 		ph := proto.PacketHeader{Protocol: protocol, Packet: packet, Bytes: 1}
@@ -362,11 +561,12 @@ func (connection *PeerConnection) SendPacket(s *Session, protocol byte, packet b
 		} else {
 			connection.sendStat(s, n)
 		}
+		return
 	}
 
 	sz := proto.DataSize(data)
 	log.Printf("Packet size calculated: %d\n", sz)
-	b := make([]byte, sz+proto.HEADER_SIZE)
+	b := make([]byte, sz+proto.HEADER_SIZE, sz+proto.HEADER_SIZE+len(payload))
 	stateBuffer := proto.StateBuffer{Data: b[proto.HEADER_SIZE:]}
 	data.Put(&stateBuffer)
 
@@ -377,11 +577,10 @@ func (connection *PeerConnection) SendPacket(s *Session, protocol byte, packet b
 		log.Println("Wrote", stateBuffer.Offset(), "bytes")
 	}
 
-	bytesCount := uint32(stateBuffer.Offset() + 1)
+	bytesCount := uint32(stateBuffer.Offset() + len(payload) + 1)
 	ph := proto.PacketHeader{Protocol: protocol, Packet: packet, Bytes: bytesCount}
 	ph.Write(b)
-	log.Printf("Bytes: %x\n", b)
-	n, err := connection.connection.Write(b[:stateBuffer.Offset()+proto.HEADER_SIZE])
+	n, err := connection.connection.Write(append(b[:stateBuffer.Offset()+proto.HEADER_SIZE], payload...))
 	if err != nil {
 		log.Printf("peer connection can not write packet %v\n", err)
 		connection.Close(false)
@@ -407,17 +606,109 @@ func (peerConnection *PeerConnection) Close(byRequest bool) {
 	}
 }
 
+func (peerConnection *PeerConnection) readRemoteOptions(tags proto.TagCollection) {
+	for _, x := range tags {
+		if x.Id == proto.CT_EMULE_MISCOPTIONS1 && x.IsUint32() {
+			peerConnection.remoteOptions.Assign(x.AsUint32())
+		}
+	}
+}
+
+func readPeerInfo(hash proto.ED2KHash, tags proto.TagCollection) PeerInfo {
+	res := PeerInfo{UserHash: hash}
+	for _, x := range tags {
+		switch {
+		case x.Id == proto.CT_NAME && x.IsString():
+			res.ClientName = x.AsString()
+		case x.Id == proto.CT_MOD_VERSION && x.IsString():
+			res.ModName = x.AsString()
+		case x.Id == proto.CT_EMULE_VERSION && x.IsUint32():
+			res.ClientVersion = x.AsUint32()
+		case x.Id == proto.CT_VERSION && x.IsUint32() && res.ClientVersion == 0:
+			res.ClientVersion = x.AsUint32()
+		}
+	}
+
+	return res
+}
+
+// requestUploadFile obtains shared file from the session when remote peer asks for another file
+func (peerConnection *PeerConnection) requestUploadFile(s *Session, hash proto.ED2KHash) bool {
+	// partial file gets new pieces while downloading, so its status is always requested again
+	if peerConnection.uploadFile == nil || peerConnection.uploadFile.Hash != hash || !peerConnection.uploadFile.Complete() {
+		peerConnection.uploadFile = s.getSharedFile(hash)
+	}
+
+	return peerConnection.uploadFile != nil
+}
+
+// uploadRange reads requested range from the disk and sends it as one compressed part
+// when remote peer supports compression and data is compressible or as series of sending parts otherwise
+func (peerConnection *PeerConnection) uploadRange(s *Session, hash proto.ED2KHash, begin uint64, end uint64) error {
+	if begin == end {
+		// empty slot in request
+		return nil
+	}
+
+	if !peerConnection.requestUploadFile(s, hash) {
+		return fmt.Errorf("requested parts for unknown file %s", hash.ToString())
+	}
+
+	if !s.hasUploadSlot(peerConnection) {
+		log.Printf("peer %s requested parts without upload slot\n", peerConnection.Endpoint.ToString())
+		return nil
+	}
+
+	if end-begin > proto.BLOCK_SIZE_UINT64 {
+		return fmt.Errorf("requested range [%d:%d] is too large", begin, end)
+	}
+
+	data, err := peerConnection.uploadFile.ReadRange(begin, end)
+	if err != nil {
+		return err
+	}
+
+	extended := end > math.MaxUint32
+	if peerConnection.remoteOptions.DataCompVer != 0 {
+		if packed := Compress(data); packed != nil {
+			cp := proto.CompressedPart{Hash: hash, Offset: begin, CompressedDataLength: uint32(len(packed)), Extended: extended}
+			if extended {
+				peerConnection.SendPacketWithData(s, proto.OP_EMULEPROT, proto.OP_COMPRESSEDPART_I64, &cp, packed)
+			} else {
+				peerConnection.SendPacketWithData(s, proto.OP_EMULEPROT, proto.OP_COMPRESSEDPART, &cp, packed)
+			}
+			return nil
+		}
+	}
+
+	for offset := begin; offset < end; offset += UPLOAD_PACKET_SIZE {
+		partEnd := Min(offset+UPLOAD_PACKET_SIZE, end)
+		sp := proto.SendingPart{Hash: hash, Begin: offset, End: partEnd, Extended: extended}
+		if extended {
+			peerConnection.SendPacketWithData(s, proto.OP_EMULEPROT, proto.OP_SENDINGPART_I64, &sp, data[offset-begin:partEnd-begin])
+		} else {
+			peerConnection.SendPacketWithData(s, proto.OP_EDONKEYPROT, proto.OP_SENDINGPART, &sp, data[offset-begin:partEnd-begin])
+		}
+	}
+
+	return nil
+}
+
 func (peerConnection *PeerConnection) recvStat(s *Session, n int) {
-	s.statReceiveChan <- StatPacket{Connection: peerConnection, Counter: n}
+	s.statReceiveChan <- StatPacket{Connection: peerConnection, UserHash: peerConnection.remoteHash, Counter: n}
 }
 
 func (peerConnection *PeerConnection) sendStat(s *Session, n int) {
-	s.statSendChan <- StatPacket{Connection: peerConnection, Counter: n}
+	s.statSendChan <- StatPacket{Connection: peerConnection, UserHash: peerConnection.remoteHash, Counter: n}
 }
 
 func (peerConnection *PeerConnection) unregister(s *Session, err error) {
 	for _, pb := range peerConnection.requestedBlocks {
-		peerConnection.transfer.abortPendingBlockChan <- AbortPendingBlock{pendingBlock: pb, peer: peerConnection.peer}
+		peerConnection.transfer.abortBlock(pb, peerConnection.peer)
+	}
+
+	if peerConnection.remotePieces {
+		peerConnection.transfer.removePeer(peerConnection.peer)
 	}
 	s.unregisterPeerConnection <- PeerConnectionPacket{Connection: peerConnection, Error: err}
 }
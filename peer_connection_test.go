@@ -1,6 +1,16 @@
-package main
+package ged2k
 
 import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/a-pavlov/ged2k/data"
 	"github.com/a-pavlov/ged2k/proto"
 	"testing"
 )
@@ -50,3 +60,378 @@ func Test_RemovePB(t *testing.T) {
 		t.Errorf("Remove by index error 2")
 	}
 }
+
+func Test_RequestPartialBlocks(t *testing.T) {
+	size := proto.PIECE_SIZE_UINT64
+	pb0 := MakePendingBlock(proto.PieceBlock{PieceIndex: 0, BlockIndex: 0}, size)
+	pb1 := MakePendingBlock(proto.PieceBlock{PieceIndex: 0, BlockIndex: 1}, size)
+	pb2 := MakePendingBlock(proto.PieceBlock{PieceIndex: 0, BlockIndex: 2}, size)
+	if pb0.IsPartial() {
+		t.Error("Block without data is partial")
+	}
+
+	// received the middle of the block 1 before disconnect
+	pb1.region.Sub(data.Range{Begin: pb1.block.Start() + 100, End: pb1.block.Start() + 200})
+	if !pb1.IsPartial() {
+		t.Error("Block with received data is not partial")
+	}
+
+	reqs := MakeRequestParts64(proto.EMULE, []*PendingBlock{&pb0, &pb1, &pb2})
+	if len(reqs) != 2 {
+		t.Fatalf("Requests count is not correct %d", len(reqs))
+	}
+
+	if reqs[0].BeginOffset[1] != pb1.block.Start() || reqs[0].EndOffset[1] != pb1.block.Start()+100 ||
+		reqs[0].BeginOffset[2] != pb1.block.Start()+200 || reqs[0].EndOffset[2] != pb2.block.Start() {
+		t.Errorf("Missing segments of partial block were not requested %v %v", reqs[0].BeginOffset, reqs[0].EndOffset)
+	}
+
+	if reqs[1].Hash != proto.EMULE || reqs[1].BeginOffset[0] != pb2.block.Start() || reqs[1].EndOffset[1] != 0 {
+		t.Errorf("Incorrect last request %v %v", reqs[1].BeginOffset, reqs[1].EndOffset)
+	}
+
+	pb1.region.Sub(data.Range{Begin: 0, End: size})
+	if pb1.IsPartial() {
+		t.Error("Complete block is partial")
+	}
+}
+
+func Test_ValidateHashSet(t *testing.T) {
+	size := proto.PIECE_SIZE_UINT64 + 1
+	hashes := []proto.ED2KHash{proto.EMULE, proto.LIBED2K}
+	hash := proto.ResultHash(hashes)
+	if err := validateHashSet(&proto.HashSet{Hash: hash, PieceHashes: hashes}, hash, size); err != nil {
+		t.Errorf("Correct hash set was rejected %v", err)
+	}
+
+	for _, hs := range []proto.HashSet{
+		{Hash: proto.EMULE, PieceHashes: hashes},
+		{Hash: hash, PieceHashes: hashes[:1]},
+		{Hash: hash, PieceHashes: []proto.ED2KHash{proto.LIBED2K, proto.EMULE}},
+	} {
+		if err := validateHashSet(&hs, hash, size); !errors.Is(err, ErrInvalidHashSet) {
+			t.Errorf("Incorrect hash set was accepted %v", err)
+		}
+	}
+}
+
+func Test_PendingBlockReceiveCutOff(t *testing.T) {
+	pb := MakePendingBlock(proto.PieceBlock{PieceIndex: 0, BlockIndex: 1}, proto.PIECE_SIZE_UINT64)
+	begin := pb.block.Start()
+	content := bytes.Repeat([]byte{7}, int(proto.BLOCK_SIZE))
+
+	// connection is lost after 1000 bytes of the whole block chunk
+	n, err := pb.Receive(io.LimitReader(bytes.NewReader(content), 1000), begin, begin+proto.BLOCK_SIZE_UINT64)
+	if err == nil || n != 1000 || !pb.IsPartial() || pb.region.Size() != proto.BLOCK_SIZE_UINT64-1000 || pb.region.Segments[0].Begin != begin+1000 {
+		t.Errorf("Received bytes were not kept %d %v %v", n, err, pb.region)
+	}
+
+	n, err = pb.ReceiveToEof(io.LimitReader(bytes.NewReader(content), 500), begin+1000)
+	if err == nil || n != 500 || pb.region.Size() != proto.BLOCK_SIZE_UINT64-1500 || !bytes.Equal(pb.data[:1500], content[:1500]) {
+		t.Errorf("Unpacked bytes were not kept %d %v %v", n, err, pb.region)
+	}
+}
+
+func Test_PendingBlockReceiveSegments(t *testing.T) {
+	pb := MakePendingBlock(proto.PieceBlock{PieceIndex: 0, BlockIndex: 1}, proto.PIECE_SIZE_UINT64)
+	begin := pb.block.Start()
+	end := begin + proto.BLOCK_SIZE_UINT64
+	content := bytes.Repeat([]byte{7}, int(proto.BLOCK_SIZE))
+
+	// the middle of block was received before, peer packs each requested segment separately
+	pb.region.Sub(data.Range{Begin: begin + 1000, End: begin + 2000})
+	for _, x := range []data.Range{{Begin: begin + 2000, End: end}, {Begin: begin, End: begin + 1000}} {
+		z, err := zlib.NewReader(bytes.NewReader(Compress(content[x.Begin-begin : x.End-begin])))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n, err := pb.ReceiveToEof(z, x.Begin); err != nil || n != int(x.End-x.Begin) {
+			t.Errorf("Segment %v was not received %d %v", x, n, err)
+		}
+	}
+
+	if !pb.region.IsEmpty() {
+		t.Errorf("Block was not completed by segments %v", pb.region)
+	}
+
+	if _, err := pb.ReceiveToEof(bytes.NewReader(content), begin+1500); err == nil {
+		t.Error("Not requested segment was received")
+	}
+
+	if _, err := pb.Receive(bytes.NewReader(content), begin+1000, end+1); err == nil {
+		t.Error("Range out of block was received")
+	}
+}
+
+// fakePeer is the remote side of the peer connection, it collects parts requested by the connection
+type fakePeer struct {
+	peer     *Peer
+	conn     net.Conn
+	requests chan proto.RequestParts64
+}
+
+func startFakePeer(s *Session, transfer *Transfer, port uint16) *fakePeer {
+	local, remote := net.Pipe()
+	ep := proto.Endpoint{Ip: 0x0100007f, Port: port}
+	fp := &fakePeer{peer: &Peer{endpoint: ep}, conn: remote, requests: make(chan proto.RequestParts64, 100)}
+	pc := NewPeerConnection(ep, transfer, fp.peer)
+	pc.connection = local
+	go pc.Start(s)
+	go func() {
+		defer close(fp.requests)
+		combiner := proto.PacketCombiner{}
+		for {
+			ph, packetBytes, err := combiner.Read(remote)
+			if err != nil {
+				return
+			}
+
+			if ph.Protocol == proto.OP_EMULEPROT && ph.Packet == proto.OP_REQUESTPARTS_I64 {
+				rp := proto.RequestParts64{}
+				sb := proto.StateBuffer{Data: packetBytes}
+				if sb.Read(&rp); sb.Error() == nil {
+					fp.requests <- rp
+				}
+			}
+		}
+	}()
+
+	return fp
+}
+
+func (fp *fakePeer) send(protocol byte, packet byte, data proto.Serializable, payload []byte) error {
+	sz := 0
+	if data != nil {
+		sz = proto.DataSize(data)
+	}
+
+	b := make([]byte, sz+proto.HEADER_SIZE)
+	if data != nil {
+		sb := proto.StateBuffer{Data: b[proto.HEADER_SIZE:]}
+		if data.Put(&sb); sb.Error() != nil {
+			return sb.Error()
+		}
+	}
+
+	ph := proto.PacketHeader{Protocol: protocol, Packet: packet, Bytes: uint32(sz + len(payload) + 1)}
+	ph.Write(b)
+	_, err := fp.conn.Write(append(b, payload...))
+	return err
+}
+
+func Test_PeerHashSetRejected(t *testing.T) {
+	s, err := NewSession(Config{IncomingDir: t.TempDir(), UserAgent: proto.EMULE})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub := s.Subscribe(EVENT_CATEGORY_TRANSFER, 0)
+	defer s.Unsubscribe(sub)
+	s.Start()
+	defer s.Stop()
+
+	hash := proto.ED2KHash{1, 2, 3}
+	if _, err = s.AddTransfer(TransferParams{Hash: hash, Size: proto.PIECE_SIZE_UINT64 + 100, Filename: "a.bin"}); err != nil {
+		t.Fatal(err)
+	}
+
+	fp := startFakePeer(s, s.transfers[hash], 4661)
+	defer fp.conn.Close()
+	if err = fp.send(proto.OP_EDONKEYPROT, proto.OP_HASHSETANSWER, &proto.HashSet{Hash: hash, PieceHashes: []proto.ED2KHash{proto.LIBED2K, proto.EMULE}}, nil); err != nil {
+		t.Fatalf("Can not send hash set %v", err)
+	}
+
+	for {
+		select {
+		case e := <-sub.Events():
+			if x, ok := e.(HashSetRejectedEvent); ok {
+				if x.Hash != hash || x.Endpoint != fp.peer.endpoint || !errors.Is(x.Err, ErrInvalidHashSet) || fp.peer.FailCount <= MAX_PEER_FAIL_COUNT {
+					t.Errorf("Peer was not marked by rejected hash set %v fail count %d", x, fp.peer.FailCount)
+				}
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Hash set was not rejected")
+		}
+	}
+}
+
+func Test_PeerPiecesWaitHashSet(t *testing.T) {
+	content := make([]byte, proto.PIECE_SIZE_UINT64+100)
+	for i := range content {
+		content[i] = byte(i)
+	}
+
+	source := filepath.Join(t.TempDir(), "a.bin")
+	if err := os.WriteFile(source, content, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	hs, size, err := HashFile(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSession(Config{IncomingDir: t.TempDir(), UserAgent: proto.EMULE})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub := s.Subscribe(EVENT_CATEGORY_TRANSFER, 0)
+	defer s.Unsubscribe(sub)
+	s.Start()
+	defer s.Stop()
+
+	th, err := s.AddTransfer(TransferParams{Hash: hs.Hash, Size: size, Filename: "a.bin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transfer := s.transfers[hs.Hash]
+	fp := startFakePeer(s, transfer, 4661)
+	defer fp.conn.Close()
+
+	// peer has all pieces and does not answer hash set request
+	bf := proto.CreateBitField(2)
+	bf.SetAll()
+	if fp.send(proto.OP_EDONKEYPROT, proto.OP_FILESTATUS, &proto.FileStatusAnswer{Hash: hs.Hash, BF: bf}, nil) != nil ||
+		fp.send(proto.OP_EDONKEYPROT, proto.OP_ACCEPTUPLOADREQ, nil, nil) != nil {
+		t.Fatal("Can not start download")
+	}
+
+	for sent := uint64(0); sent < size; {
+		select {
+		case rp := <-fp.requests:
+			for i := range rp.BeginOffset {
+				if rp.BeginOffset[i] == rp.EndOffset[i] {
+					continue
+				}
+
+				sp := proto.SendingPart{Hash: hs.Hash, Begin: rp.BeginOffset[i], End: rp.EndOffset[i], Extended: true}
+				if err = fp.send(proto.OP_EMULEPROT, proto.OP_SENDINGPART_I64, &sp, content[sp.Begin:sp.End]); err != nil {
+					t.Fatalf("Can not send part %v", err)
+				}
+				sent += sp.End - sp.Begin
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Parts were not requested")
+		}
+	}
+
+	ts := TransferStatus{}
+	for i := 0; i < 50 && ts.DownloadedBytes != size; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if ts, err = th.Status(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// completed pieces wait for trusted hash set
+	time.Sleep(500 * time.Millisecond)
+	if ts, err = th.Status(); err != nil || ts.DownloadedBytes != size || ts.VerifiedBytes != 0 || ts.Finished {
+		t.Fatalf("Pieces were verified without hash set %v %v", ts.TransferSummary, err)
+	}
+
+	// hash set is received from another peer, pieces are verified and the whole file is verified at the end
+	hashSetPeer := startFakePeer(s, transfer, 4662)
+	defer hashSetPeer.conn.Close()
+	if err = hashSetPeer.send(proto.OP_EDONKEYPROT, proto.OP_HASHSETANSWER, &hs, nil); err != nil {
+		t.Fatalf("Can not send hash set %v", err)
+	}
+
+	rechecked, finished := false, false
+	for !rechecked || !finished {
+		select {
+		case e := <-sub.Events():
+			switch x := e.(type) {
+			case TransferRecheckedEvent:
+				rechecked = true
+				if x.Err != nil || x.Pieces != 2 || x.VerifiedPieces != 2 {
+					t.Errorf("Downloaded file was not verified %v", x)
+				}
+			case TransferFinishedEvent:
+				finished = true
+			case PieceHashFailedEvent:
+				t.Errorf("Downloaded piece does not match hash set %v", x)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Transfer was not verified %v finished %v", rechecked, finished)
+		}
+	}
+
+	if ts, err = th.Status(); err != nil || !ts.Finished || ts.VerifiedBytes != size {
+		t.Errorf("Transfer status was not verified %v %v", ts.TransferSummary, err)
+	}
+}
+
+func Test_PeerConnectionClosedTransfer(t *testing.T) {
+	transfer := NewTransfer(proto.EMULE, "a.bin", proto.PIECE_SIZE_UINT64)
+	close(transfer.done)
+	s := Session{unregisterPeerConnection: make(chan PeerConnectionPacket, 1)}
+	peer := &Peer{endpoint: proto.Endpoint{Ip: 0x0100007f, Port: 4661}}
+	pc := NewPeerConnection(peer.endpoint, transfer, peer)
+	pb := MakePendingBlock(proto.PieceBlock{PieceIndex: 0, BlockIndex: 0}, transfer.Size)
+	pc.requestedBlocks = append(pc.requestedBlocks, &pb)
+	pc.remotePieces = true
+
+	done := make(chan struct{})
+	go func() {
+		transfer.addPeerPieces(peer, proto.CreateBitField(1))
+		// blocks channel is buffered, so block could be queued
+		transfer.receiveBlock(&pb)
+		if transfer.readyToDownload(pc) {
+			t.Error("Closed transfer accepted peer connection")
+		}
+		pc.unregister(&s, io.EOF)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Peer connection was blocked by closed transfer")
+	}
+
+	if x := <-s.unregisterPeerConnection; x.Connection != pc || x.Error != io.EOF {
+		t.Errorf("Peer connection was not unregistered %v", x)
+	}
+}
+
+func Test_PeerConnectionWithoutTransfer(t *testing.T) {
+	s := Session{statReceiveChan: make(chan StatPacket, 10), unregisterPeerConnection: make(chan PeerConnectionPacket, 1)}
+	hs := proto.HashSet{Hash: proto.EMULE, PieceHashes: []proto.ED2KHash{proto.EMULE}}
+	bf := proto.CreateBitField(1)
+	for _, x := range []struct {
+		protocol byte
+		packet   byte
+		data     proto.Serializable
+	}{
+		{proto.OP_EDONKEYPROT, proto.OP_FILESTATUS, &proto.FileStatusAnswer{Hash: proto.EMULE, BF: bf}},
+		{proto.OP_EDONKEYPROT, proto.OP_HASHSETANSWER, &hs},
+		{proto.OP_EDONKEYPROT, proto.OP_ACCEPTUPLOADREQ, nil},
+		{proto.OP_EMULEPROT, proto.OP_SENDINGPART_I64, &proto.SendingPart{Hash: proto.EMULE, Begin: 0, End: 10, Extended: true}},
+	} {
+		// inbound connection is not attached to transfer
+		local, remote := net.Pipe()
+		pc := NewPeerConnection(proto.Endpoint{Ip: 0x0100007f, Port: 4661}, nil, nil)
+		pc.connection = local
+		go pc.Start(&s)
+		fp := fakePeer{conn: remote}
+		if err := fp.send(x.protocol, x.packet, x.data, nil); err != nil {
+			t.Fatalf("Can not send packet %x %v", x.packet, err)
+		}
+
+		select {
+		case res := <-s.unregisterPeerConnection:
+			if res.Connection != pc || res.Error == nil {
+				t.Errorf("Unexpected packet %x did not close connection %v", x.packet, res.Error)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Unexpected packet %x was not rejected", x.packet)
+		}
+
+		remote.Close()
+		local.Close()
+	}
+}
@@ -0,0 +1,116 @@
+package ged2k
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+const (
+	PICK_STRATEGY_RAREST_FIRST = "rarest"
+	PICK_STRATEGY_SEQUENTIAL   = "sequential"
+	PICK_STRATEGY_PREVIEW      = "preview"
+	PICK_STRATEGY_RANDOM_FIRST = "random"
+)
+
+// PickStrategy chooses next piece to download from the pieces piece picker does not have and peer has
+type PickStrategy interface {
+	// ChoosePiece returns index of the piece to download or -1 when no candidates
+	ChoosePiece(pp *PiecePicker, peer *Peer) int
+	Name() string
+}
+
+// RarestFirstStrategy is the default strategy, lower index wins on equal availability
+type RarestFirstStrategy struct{}
+
+func (RarestFirstStrategy) ChoosePiece(pp *PiecePicker, peer *Peer) int {
+	best := -1
+	for i := 0; i < pp.pieces.Bits(); i++ {
+		if pp.IsCandidate(i, peer) && (best == -1 || pp.availability[i] < pp.availability[best]) {
+			best = i
+		}
+	}
+
+	return best
+}
+
+func (RarestFirstStrategy) Name() string {
+	return PICK_STRATEGY_RAREST_FIRST
+}
+
+// SequentialStrategy downloads pieces in order for streaming
+type SequentialStrategy struct{}
+
+func (SequentialStrategy) ChoosePiece(pp *PiecePicker, peer *Peer) int {
+	for i := 0; i < pp.pieces.Bits(); i++ {
+		if pp.IsCandidate(i, peer) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (SequentialStrategy) Name() string {
+	return PICK_STRATEGY_SEQUENTIAL
+}
+
+// PreviewStrategy downloads first and last pieces before others to make media headers and indexes available early
+type PreviewStrategy struct{}
+
+func (PreviewStrategy) ChoosePiece(pp *PiecePicker, peer *Peer) int {
+	if pp.IsCandidate(0, peer) {
+		return 0
+	}
+
+	if last := pp.pieces.Bits() - 1; pp.IsCandidate(last, peer) {
+		return last
+	}
+
+	return RarestFirstStrategy{}.ChoosePiece(pp, peer)
+}
+
+func (PreviewStrategy) Name() string {
+	return PICK_STRATEGY_PREVIEW
+}
+
+// RandomFirstStrategy picks random pieces until the first piece is downloaded to get something to share quickly,
+// then falls back to the rarest first
+type RandomFirstStrategy struct{}
+
+func (RandomFirstStrategy) ChoosePiece(pp *PiecePicker, peer *Peer) int {
+	if pp.pieces.Count()-len(pp.downloadingPieces) > 0 {
+		return RarestFirstStrategy{}.ChoosePiece(pp, peer)
+	}
+
+	candidates := make([]int, 0)
+	for i := 0; i < pp.pieces.Bits(); i++ {
+		if pp.IsCandidate(i, peer) {
+			candidates = append(candidates, i)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return -1
+	}
+
+	return candidates[rand.Intn(len(candidates))]
+}
+
+func (RandomFirstStrategy) Name() string {
+	return PICK_STRATEGY_RANDOM_FIRST
+}
+
+func PickStrategyFromString(name string) (PickStrategy, error) {
+	switch name {
+	case PICK_STRATEGY_RAREST_FIRST:
+		return RarestFirstStrategy{}, nil
+	case PICK_STRATEGY_SEQUENTIAL:
+		return SequentialStrategy{}, nil
+	case PICK_STRATEGY_PREVIEW:
+		return PreviewStrategy{}, nil
+	case PICK_STRATEGY_RANDOM_FIRST:
+		return RandomFirstStrategy{}, nil
+	}
+
+	return nil, fmt.Errorf("unknown pick strategy %s", name)
+}
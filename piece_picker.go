@@ -1,4 +1,4 @@
-package main
+package ged2k
 
 import (
 	"fmt"
@@ -10,10 +10,170 @@ type PiecePicker struct {
 	BlocksInLastPiece int
 	downloadingPieces []*DownloadingPiece
 	pieces            proto.BitField
+	availability      []int
+	peerPieces        map[*Peer]proto.BitField
+	strategy          PickStrategy
+	// priorities of pieces, empty means normal priority for all pieces
+	priorities []byte
+	// pickPriority limits candidates to pieces with the priority while choosing next piece, skip means any wanted piece
+	pickPriority byte
+	// boosts counts streams waiting for pieces, boosts are not saved in resume data
+	boosts map[int]int
 }
 
 func CreatePiecePicker(pieceCount int, blocksInLastPiece int) PiecePicker {
-	return PiecePicker{BlocksInLastPiece: blocksInLastPiece, downloadingPieces: []*DownloadingPiece{}, pieces: proto.CreateBitField(pieceCount)}
+	return PiecePicker{
+		BlocksInLastPiece: blocksInLastPiece,
+		downloadingPieces: []*DownloadingPiece{},
+		pieces:            proto.CreateBitField(pieceCount),
+		availability:      make([]int, pieceCount),
+		peerPieces:        make(map[*Peer]proto.BitField),
+	}
+}
+
+// AddPeerPieces registers pieces peer has from its file status, empty bit field means peer has complete file
+func (pp *PiecePicker) AddPeerPieces(peer *Peer, pieces proto.BitField) error {
+	if pieces.Bits() == 0 {
+		pieces = proto.CreateBitField(pp.pieces.Bits())
+		pieces.SetAll()
+	}
+
+	if pieces.Bits() != pp.pieces.Bits() {
+		return fmt.Errorf("peer pieces count %d does not match transfer pieces count %d", pieces.Bits(), pp.pieces.Bits())
+	}
+
+	pp.RemovePeer(peer)
+	pp.peerPieces[peer] = proto.CloneBitField(pieces)
+	for i := 0; i < pieces.Bits(); i++ {
+		if pieces.GetBit(i) {
+			pp.availability[i]++
+		}
+	}
+
+	return nil
+}
+
+// RemovePeer removes availability of the peer's pieces
+func (pp *PiecePicker) RemovePeer(peer *Peer) {
+	pieces, ok := pp.peerPieces[peer]
+	if !ok {
+		return
+	}
+
+	for i := 0; i < pieces.Bits(); i++ {
+		if pieces.GetBit(i) {
+			pp.availability[i]--
+		}
+	}
+
+	delete(pp.peerPieces, peer)
+}
+
+// SetStrategy changes order of the next pieces, already downloading pieces are kept
+func (pp *PiecePicker) SetStrategy(strategy PickStrategy) {
+	pp.strategy = strategy
+}
+
+func (pp *PiecePicker) Strategy() PickStrategy {
+	if pp.strategy == nil {
+		return RarestFirstStrategy{}
+	}
+
+	return pp.strategy
+}
+
+// IsCandidate returns true when piece is wanted, not downloaded or downloading and peer has it
+func (pp *PiecePicker) IsCandidate(pieceIndex int, peer *Peer) bool {
+	if pieceIndex < 0 || pieceIndex >= pp.pieces.Bits() || pp.pieces.GetBit(pieceIndex) || !pp.peerHasPiece(peer, pieceIndex) {
+		return false
+	}
+
+	priority := pp.pickingPriority(pieceIndex)
+	return priority != proto.PIECE_PRIORITY_SKIP && (pp.pickPriority == proto.PIECE_PRIORITY_SKIP || priority == pp.pickPriority)
+}
+
+// pickingPriority returns priority used to choose the next piece, boosted piece is chosen as high priority piece unless it is skipped
+func (pp *PiecePicker) pickingPriority(pieceIndex int) byte {
+	priority := pp.PiecePriority(pieceIndex)
+	if priority != proto.PIECE_PRIORITY_SKIP && pp.boosts[pieceIndex] > 0 {
+		return proto.PIECE_PRIORITY_HIGH
+	}
+
+	return priority
+}
+
+func (pp *PiecePicker) PiecePriority(pieceIndex int) byte {
+	if pieceIndex < len(pp.priorities) {
+		return pp.priorities[pieceIndex]
+	}
+
+	return proto.PIECE_PRIORITY_NORMAL
+}
+
+func (pp *PiecePicker) SetPiecePriority(pieceIndex int, priority byte) {
+	if pieceIndex < 0 || pieceIndex >= pp.pieces.Bits() {
+		return
+	}
+
+	if len(pp.priorities) == 0 {
+		pp.priorities = make([]byte, pp.pieces.Bits())
+		for i := range pp.priorities {
+			pp.priorities[i] = proto.PIECE_PRIORITY_NORMAL
+		}
+	}
+
+	pp.priorities[pieceIndex] = priority
+}
+
+// SetRangePriority sets priority for all pieces intersecting byte range [begin, end)
+func (pp *PiecePicker) SetRangePriority(begin uint64, end uint64, priority byte) {
+	if begin >= end {
+		return
+	}
+
+	for i := int(begin / proto.PIECE_SIZE_UINT64); i <= int((end-1)/proto.PIECE_SIZE_UINT64); i++ {
+		pp.SetPiecePriority(i, priority)
+	}
+}
+
+// BoostRange adds or removes boost of pieces intersecting byte range [begin, end), priorities of pieces are not changed
+func (pp *PiecePicker) BoostRange(begin uint64, end uint64, boost bool) {
+	if begin >= end {
+		return
+	}
+
+	if pp.boosts == nil {
+		pp.boosts = make(map[int]int)
+	}
+
+	for i := int(begin / proto.PIECE_SIZE_UINT64); i <= int((end-1)/proto.PIECE_SIZE_UINT64) && i < pp.pieces.Bits(); i++ {
+		if boost {
+			pp.boosts[i]++
+		} else if pp.boosts[i] > 1 {
+			pp.boosts[i]--
+		} else {
+			delete(pp.boosts, i)
+		}
+	}
+}
+
+func (pp *PiecePicker) GetPriorities() []byte {
+	res := make([]byte, len(pp.priorities))
+	copy(res, pp.priorities)
+	return res
+}
+
+// peerHasPiece returns true when peer has piece or its file status is unknown
+func (pp *PiecePicker) peerHasPiece(peer *Peer, pieceIndex int) bool {
+	pieces, ok := pp.peerPieces[peer]
+	return !ok || pieces.GetBit(pieceIndex)
+}
+
+// Availability returns count of connected peers having each piece
+func (pp *PiecePicker) Availability() []int {
+	res := make([]int, len(pp.availability))
+	copy(res, pp.availability)
+	return res
 }
 
 func (pp PiecePicker) BlocksInPiece(pieceIndex int) int {
@@ -37,6 +197,10 @@ func (pp PiecePicker) getDownloadingPiece(pieceIndex int) *DownloadingPiece {
 func (pp *PiecePicker) addDownloadingBlocks(requiredBlocksCount int, peer *Peer, endGame bool) []proto.PieceBlock {
 	res := []proto.PieceBlock{}
 	for _, dp := range pp.downloadingPieces {
+		if !pp.peerHasPiece(peer, dp.pieceIndex) || pp.PiecePriority(dp.pieceIndex) == proto.PIECE_PRIORITY_SKIP {
+			continue
+		}
+
 		res = append(res, dp.PickBlock(requiredBlocksCount-len(res), peer, endGame)...)
 		if len(res) == requiredBlocksCount {
 			break
@@ -52,16 +216,22 @@ func (pp *PiecePicker) isEndGame() bool {
 	return true
 }
 
-func (pp *PiecePicker) chooseNextPiece() bool {
-	for i := 0; i < pp.pieces.Bits(); i++ {
-		if !pp.pieces.GetBit(i) {
-			pp.downloadingPieces = append(pp.downloadingPieces, NewDownloadingPiece(i, pp.BlocksInPiece(i)))
-			pp.pieces.SetBit(i)
-			return true
-		}
+// chooseNextPiece starts downloading of the piece selected by the current strategy among pieces with the highest priority
+func (pp *PiecePicker) chooseNextPiece(peer *Peer) bool {
+	best := -1
+	for priority := proto.PIECE_PRIORITY_HIGH; priority > proto.PIECE_PRIORITY_SKIP && best == -1; priority-- {
+		pp.pickPriority = priority
+		best = pp.Strategy().ChoosePiece(pp, peer)
 	}
 
-	return false
+	pp.pickPriority = proto.PIECE_PRIORITY_SKIP
+	if best == -1 {
+		return false
+	}
+
+	pp.downloadingPieces = append(pp.downloadingPieces, NewDownloadingPiece(best, pp.BlocksInPiece(best)))
+	pp.pieces.SetBit(best)
+	return true
 }
 
 func (pp *PiecePicker) PickPieces(requiredBlocksCount int, peer *Peer) []proto.PieceBlock {
@@ -72,7 +242,7 @@ func (pp *PiecePicker) PickPieces(requiredBlocksCount int, peer *Peer) []proto.P
 		res = append(res, pp.addDownloadingBlocks(requiredBlocksCount-len(res), peer, true)...)
 	}
 
-	if len(res) < requiredBlocksCount && pp.chooseNextPiece() {
+	if len(res) < requiredBlocksCount && pp.chooseNextPiece(peer) {
 		fmt.Printf("Required block count %d\n", requiredBlocksCount-len(res))
 		res = append(res, pp.PickPieces(requiredBlocksCount-len(res), peer)...)
 	}
@@ -132,9 +302,26 @@ func (pp *PiecePicker) IsFinished() bool {
 	return pp.pieces.Count() == pp.pieces.Bits() && len(pp.downloadingPieces) == 0
 }
 
+// IsWantedFinished returns true when all not skipped pieces are downloaded
+func (pp *PiecePicker) IsWantedFinished() bool {
+	for i := 0; i < pp.pieces.Bits(); i++ {
+		if pp.PiecePriority(i) != proto.PIECE_PRIORITY_SKIP && (!pp.pieces.GetBit(i) || pp.getDownloadingPiece(i) != nil) {
+			return false
+		}
+	}
+
+	return true
+}
+
 func FromResumeData(atp *proto.AddTransferParameters) PiecePicker {
 	pp := PiecePicker{}
+	_, pp.BlocksInLastPiece = proto.NumPiecesAndBlocks(atp.Filesize)
 	pp.pieces = proto.CloneBitField(atp.Pieces)
+	pp.availability = make([]int, pp.pieces.Bits())
+	pp.peerPieces = make(map[*Peer]proto.BitField)
+	if len(atp.Priorities) == pp.pieces.Bits() {
+		pp.priorities = append([]byte{}, atp.Priorities...)
+	}
 	for pieceIndex, x := range atp.DownloadedBlocks {
 		downloadingPiece := pp.getDownloadingPiece(pieceIndex)
 		if downloadingPiece == nil {
@@ -161,6 +348,42 @@ func (pp *PiecePicker) GetDownloadedBlocks() map[int]proto.BitField {
 	return res
 }
 
+// PiecesStatus returns state, priority and availability of each piece
+func (pp *PiecePicker) PiecesStatus() []PieceStatus {
+	res := make([]PieceStatus, pp.pieces.Bits())
+	for i := range res {
+		res[i] = PieceStatus{Priority: pp.PiecePriority(i), Blocks: pp.BlocksInPiece(i)}
+		if i < len(pp.availability) {
+			res[i].Availability = pp.availability[i]
+		}
+		if pp.pieces.GetBit(i) {
+			res[i].State = PIECE_STATE_VERIFIED
+			res[i].BlocksFinished = res[i].Blocks
+		}
+	}
+
+	for _, x := range pp.downloadingPieces {
+		res[x.pieceIndex].State = PIECE_STATE_DOWNLOADING
+		res[x.pieceIndex].BlocksFinished = x.NumHave()
+	}
+
+	return res
+}
+
+// RequestedBlocks returns not finished blocks of downloading pieces by endpoint of the last downloader
+func (pp *PiecePicker) RequestedBlocks() map[proto.Endpoint][]proto.PieceBlock {
+	res := make(map[proto.Endpoint][]proto.PieceBlock)
+	for _, x := range pp.downloadingPieces {
+		for i, b := range x.blocks {
+			if b.lastDownloader != nil && x.IsBlockRequested(i) && !x.IsBlockFinished(i) {
+				res[b.lastDownloader.endpoint] = append(res[b.lastDownloader.endpoint], proto.PieceBlock{PieceIndex: x.pieceIndex, BlockIndex: i})
+			}
+		}
+	}
+
+	return res
+}
+
 func remove(s []*DownloadingPiece, i int) []*DownloadingPiece {
 	s[i] = s[len(s)-1]
 	return s[:len(s)-1]
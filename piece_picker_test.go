@@ -1,4 +1,4 @@
-package main
+package ged2k
 
 import (
 	"fmt"
@@ -330,3 +330,251 @@ func Test_PiecePickerRestoreAtp(t *testing.T) {
 	}
 
 }
+
+func Test_PiecePickerRarestFirst(t *testing.T) {
+	pp := CreatePiecePicker(4, 2)
+	peer1 := Peer{endpoint: proto.EndpointFromString("192.168.11.11:7899"), Speed: PEER_SPEED_SLOW}
+	peer2 := Peer{endpoint: proto.EndpointFromString("192.168.11.12:7899"), Speed: PEER_SPEED_SLOW}
+	peer3 := Peer{endpoint: proto.EndpointFromString("192.168.11.13:7899"), Speed: PEER_SPEED_SLOW}
+
+	bf1 := proto.CreateBitField(4)
+	bf1.SetAll()
+	bf2 := proto.CreateBitField(4)
+	bf2.SetBit(0)
+	bf2.SetBit(1)
+	bf2.SetBit(3)
+
+	if pp.AddPeerPieces(&peer1, bf1) != nil || pp.AddPeerPieces(&peer2, bf2) != nil {
+		t.Fatal("Can not add peer pieces")
+	}
+
+	if pp.AddPeerPieces(&peer3, proto.CreateBitField(5)) == nil {
+		t.Error("Peer pieces with incorrect size were accepted")
+	}
+
+	if a := pp.Availability(); a[0] != 2 || a[1] != 2 || a[2] != 1 || a[3] != 2 {
+		t.Errorf("Availability incorrect %v", a)
+	}
+
+	blocks := pp.PickPieces(1, &peer1)
+	if len(blocks) != 1 || blocks[0].PieceIndex != 2 {
+		t.Errorf("Rarest piece was not picked %v", blocks)
+	}
+
+	blocks = pp.PickPieces(3, &peer2)
+	if len(blocks) != 3 || blocks[0].PieceIndex != 0 || blocks[2].PieceIndex != 0 {
+		t.Errorf("Peer got incorrect blocks %v", blocks)
+	}
+
+	for _, x := range blocks {
+		if x.PieceIndex == 2 {
+			t.Error("Peer got piece it does not have")
+		}
+	}
+
+	pp.RemovePeer(&peer1)
+	if a := pp.Availability(); a[0] != 1 || a[2] != 0 {
+		t.Errorf("Availability was not removed %v", a)
+	}
+
+	// empty bit field means complete file
+	if pp.AddPeerPieces(&peer3, proto.BitField{}) != nil {
+		t.Error("Can not add complete peer")
+	}
+
+	if a := pp.Availability(); a[0] != 2 || a[2] != 1 {
+		t.Errorf("Complete peer availability incorrect %v", a)
+	}
+
+	// re-adding replaces previous peer status
+	pp.AddPeerPieces(&peer3, proto.CreateBitField(4))
+	if a := pp.Availability(); a[0] != 1 || a[2] != 0 {
+		t.Errorf("Peer status was not replaced %v", a)
+	}
+
+	if blocks = pp.PickPieces(3, &peer3); len(blocks) != 0 {
+		t.Errorf("Peer without pieces got blocks %v", blocks)
+	}
+}
+
+func Test_PiecePickerStrategies(t *testing.T) {
+	peer := Peer{endpoint: proto.EndpointFromString("192.168.11.11:7899"), Speed: PEER_SPEED_SLOW}
+	rare := Peer{endpoint: proto.EndpointFromString("192.168.11.12:7899"), Speed: PEER_SPEED_SLOW}
+	bf := proto.CreateBitField(5)
+	bf.SetBit(0)
+	bf.SetBit(1)
+	bf.SetBit(2)
+	bf.SetBit(4)
+
+	pp := CreatePiecePicker(5, 1)
+	pp.AddPeerPieces(&rare, bf)
+	if pp.Strategy().Name() != PICK_STRATEGY_RAREST_FIRST {
+		t.Error("Default strategy is not rarest first")
+	}
+
+	pp.SetStrategy(SequentialStrategy{})
+	if blocks := pp.PickPieces(1, &peer); len(blocks) != 1 || blocks[0].PieceIndex != 0 {
+		t.Errorf("Sequential strategy picked incorrect piece %v", blocks)
+	}
+
+	// switch strategy keeps downloading pieces
+	pp.SetStrategy(PreviewStrategy{})
+	if blocks := pp.PickPieces(1, &peer); len(blocks) != 1 || blocks[0].PieceIndex != 0 || blocks[0].BlockIndex != 1 {
+		t.Errorf("Downloading piece was not continued %v", blocks)
+	}
+
+	pp = CreatePiecePicker(5, 1)
+	pp.AddPeerPieces(&rare, bf)
+	pp.SetStrategy(PreviewStrategy{})
+	if pp.chooseNextPiece(&peer); !pp.pieces.GetBit(0) {
+		t.Error("Preview strategy did not pick first piece")
+	}
+
+	if pp.chooseNextPiece(&peer); !pp.pieces.GetBit(4) {
+		t.Error("Preview strategy did not pick last piece")
+	}
+
+	if pp.chooseNextPiece(&peer); !pp.pieces.GetBit(3) {
+		t.Error("Preview strategy did not fall back to rarest first")
+	}
+
+	pp = CreatePiecePicker(5, 1)
+	pp.AddPeerPieces(&rare, bf)
+	pp.SetStrategy(RandomFirstStrategy{})
+	if index := pp.Strategy().ChoosePiece(&pp, &rare); index < 0 || index == 3 {
+		t.Errorf("Random strategy picked incorrect piece %d", index)
+	}
+
+	pp.pieces.SetBit(2)
+	if index := pp.Strategy().ChoosePiece(&pp, &peer); index != 3 {
+		t.Errorf("Random strategy did not fall back to rarest first after first piece %d", index)
+	}
+
+	for _, x := range []string{PICK_STRATEGY_RAREST_FIRST, PICK_STRATEGY_SEQUENTIAL, PICK_STRATEGY_PREVIEW, PICK_STRATEGY_RANDOM_FIRST} {
+		if st, err := PickStrategyFromString(x); err != nil || st.Name() != x {
+			t.Errorf("Can not create strategy %s", x)
+		}
+	}
+
+	if _, err := PickStrategyFromString("unknown"); err == nil {
+		t.Error("Unknown strategy was created")
+	}
+}
+
+func Test_PiecePickerPriorities(t *testing.T) {
+	peer := Peer{endpoint: proto.EndpointFromString("192.168.11.11:7899"), Speed: PEER_SPEED_SLOW}
+	pp := CreatePiecePicker(4, 1)
+	pp.SetStrategy(SequentialStrategy{})
+	pp.SetRangePriority(0, proto.PIECE_SIZE_UINT64+1, proto.PIECE_PRIORITY_SKIP)
+	pp.SetRangePriority(proto.PIECE_SIZE_UINT64*3, proto.PIECE_SIZE_UINT64*3+10, proto.PIECE_PRIORITY_HIGH)
+	if pp.PiecePriority(0) != proto.PIECE_PRIORITY_SKIP || pp.PiecePriority(1) != proto.PIECE_PRIORITY_SKIP || pp.PiecePriority(2) != proto.PIECE_PRIORITY_NORMAL || pp.PiecePriority(3) != proto.PIECE_PRIORITY_HIGH {
+		t.Errorf("Range priority incorrect %v", pp.GetPriorities())
+	}
+
+	if !pp.chooseNextPiece(&peer) || !pp.pieces.GetBit(3) {
+		t.Error("High priority piece was not picked first")
+	}
+
+	if !pp.chooseNextPiece(&peer) || !pp.pieces.GetBit(2) {
+		t.Error("Normal priority piece was not picked")
+	}
+
+	if pp.chooseNextPiece(&peer) || pp.pieces.GetBit(0) || pp.pieces.GetBit(1) {
+		t.Error("Skipped piece was picked")
+	}
+
+	blocks := pp.PickPieces(100, &peer)
+	if len(blocks) != proto.BLOCKS_PER_PIECE+1 {
+		t.Errorf("Blocks of wanted pieces count incorrect %d", len(blocks))
+	}
+
+	for _, x := range blocks {
+		pp.FinishBlock(x)
+	}
+
+	if pp.IsWantedFinished() {
+		t.Error("Wanted finished before set have")
+	}
+
+	pp.SetHave(2)
+	pp.SetHave(3)
+	if !pp.IsWantedFinished() || pp.IsFinished() {
+		t.Error("Wanted data must be finished")
+	}
+
+	pp.SetPiecePriority(1, proto.PIECE_PRIORITY_LOW)
+	if pp.IsWantedFinished() {
+		t.Error("Wanted data finished after skipped piece was requested")
+	}
+
+	atp := proto.AddTransferParameters{Filesize: proto.PIECE_SIZE_UINT64*3 + 10, Pieces: pp.GetPieces(), Priorities: pp.GetPriorities()}
+	restored := FromResumeData(&atp)
+	if restored.PiecePriority(0) != proto.PIECE_PRIORITY_SKIP || restored.PiecePriority(1) != proto.PIECE_PRIORITY_LOW {
+		t.Errorf("Priorities were not restored %v", restored.GetPriorities())
+	}
+}
+
+func Test_PiecePickerBoost(t *testing.T) {
+	peer := Peer{endpoint: proto.EndpointFromString("192.168.11.11:7899"), Speed: PEER_SPEED_SLOW}
+	pp := CreatePiecePicker(4, 1)
+	pp.SetStrategy(SequentialStrategy{})
+	pp.SetPiecePriority(1, proto.PIECE_PRIORITY_SKIP)
+	pp.BoostRange(proto.PIECE_SIZE_UINT64, proto.PIECE_SIZE_UINT64*3, true)
+	pp.BoostRange(proto.PIECE_SIZE_UINT64*2, proto.PIECE_SIZE_UINT64*2+1, true)
+	if pp.PiecePriority(2) != proto.PIECE_PRIORITY_NORMAL || len(pp.GetPriorities()) != 4 || pp.GetPriorities()[2] != proto.PIECE_PRIORITY_NORMAL {
+		t.Errorf("Boost changed priorities %v", pp.GetPriorities())
+	}
+
+	if !pp.chooseNextPiece(&peer) || !pp.pieces.GetBit(2) {
+		t.Error("Boosted piece was not picked first")
+	}
+
+	// one boost of the piece is left
+	pp.BoostRange(proto.PIECE_SIZE_UINT64, proto.PIECE_SIZE_UINT64*4, false)
+	if pp.boosts[2] != 1 || pp.boosts[1] != 0 || pp.boosts[3] != 0 {
+		t.Errorf("Boosts were not removed %v", pp.boosts)
+	}
+
+	if !pp.chooseNextPiece(&peer) || !pp.chooseNextPiece(&peer) || !pp.pieces.GetBit(3) || pp.chooseNextPiece(&peer) || pp.pieces.GetBit(1) {
+		t.Error("Skipped piece was picked after boost")
+	}
+}
+
+func Test_PiecePickerStatus(t *testing.T) {
+	peer := Peer{endpoint: proto.EndpointFromString("192.168.11.11:7899"), Speed: PEER_SPEED_SLOW}
+	pp := CreatePiecePicker(3, 2)
+	pp.SetStrategy(SequentialStrategy{})
+	pp.SetPiecePriority(2, proto.PIECE_PRIORITY_SKIP)
+	if err := pp.AddPeerPieces(&peer, proto.BitField{}); err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := pp.PickPieces(proto.BLOCKS_PER_PIECE+1, &peer)
+	for _, x := range blocks[:proto.BLOCKS_PER_PIECE] {
+		pp.FinishBlock(x)
+	}
+	pp.SetHave(0)
+
+	status := pp.PiecesStatus()
+	if len(status) != 3 || status[0].State != PIECE_STATE_VERIFIED || status[0].BlocksFinished != proto.BLOCKS_PER_PIECE || status[0].Availability != 1 {
+		t.Errorf("Verified piece status incorrect %v", status)
+	}
+
+	if status[1].State != PIECE_STATE_DOWNLOADING || status[1].BlocksFinished != 0 || status[1].Blocks != proto.BLOCKS_PER_PIECE {
+		t.Errorf("Downloading piece status incorrect %v", status[1])
+	}
+
+	if status[2].State != PIECE_STATE_NONE || status[2].Priority != proto.PIECE_PRIORITY_SKIP || status[2].Blocks != 2 {
+		t.Errorf("Skipped piece status incorrect %v", status[2])
+	}
+
+	requests := pp.RequestedBlocks()
+	if len(requests) != 1 || len(requests[peer.endpoint]) != 1 || requests[peer.endpoint][0] != blocks[proto.BLOCKS_PER_PIECE] {
+		t.Errorf("Requested blocks incorrect %v", requests)
+	}
+
+	pp.AbortBlock(blocks[proto.BLOCKS_PER_PIECE], &peer)
+	if len(pp.RequestedBlocks()) != 0 {
+		t.Error("Aborted block is still requested")
+	}
+}
@@ -1,62 +1,102 @@
-package main
+package ged2k
 
 import (
 	"hash"
-	"log"
 
 	"github.com/a-pavlov/ged2k/proto"
+	"golang.org/x/crypto/md4"
 )
 
+// ReceivingPiece tracks blocks of the downloading piece and hashes them in order by hashing worker.
+// Data of written block is kept in memory only when all previous blocks are written, so it is hashed soon,
+// other blocks release data after write and are read back from storage when their turn comes
 type ReceivingPiece struct {
+	pieceIndex     int
 	hash           hash.Hash
-	blocks         []*PendingBlock
-	hashBlockIndex int
+	received       proto.BitField
+	written        proto.BitField
+	data           map[int][]byte
+	hashBlockIndex int  // next block to hash
+	hashing        bool // hash is owned by hashing worker
+	queued         bool // piece waits for hashing worker
 }
 
+func NewReceivingPiece(pieceIndex int, blocks int) *ReceivingPiece {
+	return &ReceivingPiece{
+		pieceIndex: pieceIndex,
+		hash:       md4.New(),
+		received:   proto.CreateBitField(blocks),
+		written:    proto.CreateBitField(blocks),
+		data:       make(map[int][]byte),
+	}
+}
+
+// InsertBlock registers received block, returns false when block was already received
 func (rp *ReceivingPiece) InsertBlock(pb *PendingBlock) bool {
-	skipBlocks := 0
-	for _, x := range rp.blocks {
-		if x.block.BlockIndex == pb.block.BlockIndex {
-			return false
-		}
-		if x.block.BlockIndex < pb.block.BlockIndex {
-			skipBlocks++
-		} else {
-			break
-		}
+	if rp.received.GetBit(pb.block.BlockIndex) {
+		return false
+	}
+
+	rp.received.SetBit(pb.block.BlockIndex)
+	return true
+}
+
+// RestoreBlock registers block written before restart, its data is read from storage
+func (rp *ReceivingPiece) RestoreBlock(blockIndex int) {
+	rp.received.SetBit(blockIndex)
+	rp.written.SetBit(blockIndex)
+}
+
+// BlockWritten registers written block and releases its data unless block is next in hashing order
+func (rp *ReceivingPiece) BlockWritten(pb *PendingBlock) {
+	rp.written.SetBit(pb.block.BlockIndex)
+	if rp.writtenBlocks() > pb.block.BlockIndex {
+		rp.data[pb.block.BlockIndex] = pb.data
 	}
 
-	log.Println("skip blocks", skipBlocks)
+	pb.data = nil
+}
 
-	switch skipBlocks {
-	case 0:
-		rp.blocks = append([]*PendingBlock{pb}, rp.blocks...)
-	case len(rp.blocks):
-		rp.blocks = append(rp.blocks, pb)
-	default:
-		rp.blocks = append(rp.blocks[:skipBlocks+1], rp.blocks[skipBlocks:]...)
-		rp.blocks[skipBlocks] = pb
+// writtenBlocks returns index of the first not written block starting from the hashing position
+func (rp *ReceivingPiece) writtenBlocks() int {
+	i := rp.hashBlockIndex
+	for i < rp.written.Bits() && rp.written.GetBit(i) {
+		i++
 	}
 
-	for _, x := range rp.blocks {
-		// skip blocks with index less than start hashing
-		if x.block.BlockIndex < rp.hashBlockIndex {
-			continue
-		}
+	return i
+}
 
-		if rp.hashBlockIndex != x.block.BlockIndex {
-			break
-		}
+// CanHash returns true when hash is not owned by worker and next blocks are written
+func (rp *ReceivingPiece) CanHash() bool {
+	return !rp.hashing && rp.writtenBlocks() > rp.hashBlockIndex
+}
 
-		rp.hash.Write(x.data)
-		rp.hashBlockIndex++
+// Complete returns true when all blocks were hashed
+func (rp *ReceivingPiece) Complete() bool {
+	return !rp.hashing && rp.hashBlockIndex == rp.written.Bits()
+}
+
+// hashJob returns job hashing written blocks in order, blocks without data are read from storage
+func (rp *ReceivingPiece) hashJob(storage Storage, size uint64, res chan diskHashResult) diskHashJob {
+	job := diskHashJob{pieceIndex: rp.pieceIndex, hash: rp.hash, storage: storage, res: res}
+	end := rp.writtenBlocks()
+	for i := rp.hashBlockIndex; i < end; i++ {
+		start := proto.PieceBlock{PieceIndex: rp.pieceIndex, BlockIndex: i}.Start()
+		job.blocks = append(job.blocks, diskHashBlock{offset: int64(start), size: int(Min(size-start, proto.BLOCK_SIZE_UINT64)), data: rp.data[i]})
 	}
 
-	return true
+	job.complete = end == rp.written.Bits()
+	return job
 }
 
-func (rp *ReceivingPiece) Hash() proto.ED2KHash {
-	h := proto.ED2KHash{}
-	rp.hash.Sum(h[:0])
-	return h
+// hashStarted passes hash to worker and releases data of hashing blocks
+func (rp *ReceivingPiece) hashStarted(job diskHashJob) {
+	for i := 0; i < len(job.blocks); i++ {
+		delete(rp.data, rp.hashBlockIndex+i)
+	}
+
+	rp.hashBlockIndex += len(job.blocks)
+	rp.hashing = true
+	rp.queued = false
 }
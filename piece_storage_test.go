@@ -1,94 +1,92 @@
-package main
+package ged2k
 
 import (
+	"testing"
+
 	"github.com/a-pavlov/ged2k/proto"
 	"golang.org/x/crypto/md4"
-	"testing"
 )
 
 func Test_ReceivedPiece(t *testing.T) {
-	rp := ReceivingPiece{hash: md4.New(), blocks: make([]*PendingBlock, 0)}
-
-	pb0 := PendingBlock{block: proto.PieceBlock{0, 0}, data: make([]byte, 20)}
-	pb1 := PendingBlock{block: proto.PieceBlock{0, 1}, data: make([]byte, 20)}
-	pb2 := PendingBlock{block: proto.PieceBlock{0, 2}, data: make([]byte, 20)}
-	pb3 := PendingBlock{block: proto.PieceBlock{0, 3}, data: make([]byte, 20)}
-	pb4 := PendingBlock{block: proto.PieceBlock{0, 4}, data: make([]byte, 20)}
-	pb5 := PendingBlock{block: proto.PieceBlock{0, 5}, data: make([]byte, 20)}
-
-	rp.InsertBlock(&pb3)
-	if rp.hashBlockIndex != 0 {
-		t.Error("Hash has started before zero block received")
+	size := uint64(4 * proto.BLOCK_SIZE)
+	storage := makeMemoryStorage(t, size)
+	blocks := []*PendingBlock{}
+	for i := 0; i < 4; i++ {
+		pb := makeFullBlock(0, i, byte(i+1))
+		storage.WriteAt(pb.data, int64(pb.block.Start()))
+		blocks = append(blocks, pb)
 	}
 
-	rp.InsertBlock(&pb1)
-
-	if rp.hashBlockIndex != 0 {
-		t.Error("Hash has started before zero block received")
-	}
+	expected := proto.ED2KHash{}
+	md4 := md4.New()
+	content := make([]byte, size)
+	storage.ReadAt(content, 0)
+	md4.Write(content)
+	md4.Sum(expected[:0])
 
-	if rp.blocks[0] != &pb1 || rp.blocks[1] != &pb3 {
-		t.Errorf("Wrong blocks order")
+	d := NewDiskIO()
+	buffer := make([]byte, proto.BLOCK_SIZE)
+	rp := NewReceivingPiece(0, 4)
+	if !rp.InsertBlock(blocks[2]) || rp.InsertBlock(blocks[2]) {
+		t.Error("Duplicate block was accepted")
 	}
 
-	rp.InsertBlock(&pb4)
-
-	if rp.hashBlockIndex != 0 {
-		t.Error("Hash has started before zero block received")
+	rp.BlockWritten(blocks[2])
+	if blocks[2].data != nil || len(rp.data) != 0 || rp.CanHash() {
+		t.Error("Data of block out of hashing order was kept")
 	}
 
-	if rp.blocks[0] != &pb1 || rp.blocks[1] != &pb3 || rp.blocks[2] != &pb4 {
-		t.Errorf("Wrong blocks order")
+	rp.InsertBlock(blocks[0])
+	rp.BlockWritten(blocks[0])
+	if !rp.CanHash() || len(rp.data) != 1 {
+		t.Error("Data of the next block was released")
 	}
 
-	rp.InsertBlock(&pb0)
-
-	if rp.hashBlockIndex != 2 {
-		t.Errorf("Hash has started, but not correct index: %d expected 2", rp.hashBlockIndex)
+	job := rp.hashJob(storage, size, nil)
+	if len(job.blocks) != 1 || job.blocks[0].data == nil || job.complete {
+		t.Errorf("Incorrect hash job of %d blocks", len(job.blocks))
 	}
 
-	if rp.blocks[0] != &pb0 || rp.blocks[1] != &pb1 || rp.blocks[2] != &pb3 || rp.blocks[3] != &pb4 {
-		t.Errorf("Wrong blocks order")
+	rp.hashStarted(job)
+	rp.InsertBlock(blocks[1])
+	rp.BlockWritten(blocks[1])
+	if rp.CanHash() || len(rp.data) != 1 {
+		t.Error("Hash owned by worker can be used")
 	}
 
-	rp.InsertBlock(&pb2)
-
-	if rp.hashBlockIndex != 5 {
-		t.Errorf("Next hashing index is not correct %d expected 5", rp.hashBlockIndex)
+	if res := d.hash(job, buffer); res.err != nil || res.complete {
+		t.Errorf("Hash job failed %v", res.err)
 	}
 
-	if rp.blocks[0] != &pb0 || rp.blocks[1] != &pb1 || rp.blocks[2] != &pb2 || rp.blocks[3] != &pb3 || rp.blocks[4] != &pb4 {
-		t.Errorf("Wrong blocks order")
+	rp.hashing = false
+	job = rp.hashJob(storage, size, nil)
+	if len(job.blocks) != 2 || job.blocks[0].data == nil || job.blocks[1].data != nil {
+		t.Errorf("Incorrect hash job of %d blocks", len(job.blocks))
 	}
 
-	rp.InsertBlock(&pb5)
-
-	if rp.hashBlockIndex != 6 {
-		t.Errorf("Next hashing index is not correct %d expected 6", rp.hashBlockIndex)
+	rp.hashStarted(job)
+	d.hash(job, buffer)
+	rp.hashing = false
+	rp.InsertBlock(blocks[3])
+	rp.BlockWritten(blocks[3])
+	job = rp.hashJob(storage, size, nil)
+	rp.hashStarted(job)
+	res := d.hash(job, buffer)
+	rp.hashing = false
+	if res.err != nil || !res.complete || !rp.Complete() || len(rp.data) != 0 {
+		t.Errorf("Piece hashing was not completed %v", res.err)
 	}
 
-	if rp.blocks[0] != &pb0 || rp.blocks[1] != &pb1 || rp.blocks[2] != &pb2 || rp.blocks[3] != &pb3 || rp.blocks[4] != &pb4 || rp.blocks[5] != &pb5 {
-		t.Errorf("Wrong blocks order")
+	if res.hash != expected {
+		t.Errorf("Result hash %x does not match expected %x", res.hash, expected)
 	}
 }
 
-func Test_ReceivingPieceSingle(t *testing.T) {
-	rp := ReceivingPiece{hash: md4.New(), blocks: make([]*PendingBlock, 0)}
-	pb0 := PendingBlock{block: proto.PieceBlock{0, 0}, data: make([]byte, 10)}
-	for i, _ := range pb0.data {
-		pb0.data[i] = 'A'
-	}
-
-	if !rp.InsertBlock(&pb0) {
-		t.Errorf("Can not insert first block")
-	}
-
-	expected := proto.ED2KHash{}
-	md4 := md4.New()
-	md4.Write(pb0.data)
-	md4.Sum(expected[:0])
-
-	if expected != rp.Hash() {
-		t.Errorf("Result hash %x does not match expected %x", rp.Hash(), expected)
+func Test_ReceivingPieceReadError(t *testing.T) {
+	rp := NewReceivingPiece(0, 1)
+	rp.RestoreBlock(0)
+	res := NewDiskIO().hash(rp.hashJob(makeMemoryStorage(t, 10), 100, nil), make([]byte, proto.BLOCK_SIZE))
+	if res.err == nil {
+		t.Error("Short read of block was not reported")
 	}
 }
@@ -1,4 +1,4 @@
-package main
+package ged2k
 
 import (
 	"log"
@@ -10,12 +10,19 @@ import (
 const MAX_PEER_LIST_SIZE int = 100
 const MIN_RECONNECT_TIMEOUT_SEC = 10
 
+// MAX_PEER_FAIL_COUNT is count of failed connections after which peer is not connected anymore
+const MAX_PEER_FAIL_COUNT = 5
+
 //const MAX_ITERATIONS = 50
 
 const PEER_SRC_INCOMING byte = 0x1
 const PEER_SRC_SERVER byte = 0x2
 const PEER_SRC_DHT byte = 0x4
 const PEER_SRC_RESUME_DATA byte = 0x8
+const PEER_SRC_LINK byte = 0x10
+
+// PEER_SRC_API marks sources passed by application in TransferParams
+const PEER_SRC_API byte = 0x20
 
 type Peer struct {
 	SourceFlag     byte
@@ -33,7 +40,7 @@ func (p Peer) IsEmpty() bool {
 }
 
 func (p *Peer) IsConnectCandidate() bool {
-	return !(p.peerConnection != nil || p.FailCount > 5)
+	return !(p.peerConnection != nil || p.FailCount > MAX_PEER_FAIL_COUNT)
 }
 
 func (p *Peer) IsEraseCandidate() bool {
@@ -66,6 +73,11 @@ func (p *Peer) SourceRank() int {
 		ret |= 1 << 2
 	}
 
+	// sources from application are trusted as much as sources from link
+	if (p.SourceFlag&PEER_SRC_LINK) == PEER_SRC_LINK || (p.SourceFlag&PEER_SRC_API) == PEER_SRC_API {
+		ret |= 1 << 1
+	}
+
 	return ret
 }
 
@@ -1,4 +1,4 @@
-package main
+package ged2k
 
 import (
 	"github.com/a-pavlov/ged2k/proto"
@@ -181,3 +181,15 @@ func Test_PolicyBase(t *testing.T) {
 	}
 
 }
+
+func Test_PeerSourceRank(t *testing.T) {
+	link := Peer{SourceFlag: PEER_SRC_LINK}
+	api := Peer{SourceFlag: PEER_SRC_API}
+	if api.SourceRank() == 0 || api.SourceRank() != link.SourceRank() || api.SourceFlag == link.SourceFlag {
+		t.Errorf("Application source rank %d does not match link source rank %d", api.SourceRank(), link.SourceRank())
+	}
+
+	if server := (Peer{SourceFlag: PEER_SRC_SERVER}); server.SourceRank() <= api.SourceRank() {
+		t.Errorf("Server source rank %d is not better than application source rank %d", server.SourceRank(), api.SourceRank())
+	}
+}
@@ -731,3 +731,15 @@ func TestEndpoint_IsLocalAddress(t *testing.T) {
 		}
 	}
 }
+
+func Test_IdChangeFlags(t *testing.T) {
+	id := IdChange{ClientId: 0x00FFFFFF, TcpFlags: SRV_TCPFLG_COMPRESSION | SRV_TCPFLG_LARGEFILES}
+	if !id.IsLowId() || !id.SupportsCompression() || !id.SupportsLargeFiles() || id.SupportsUnicode() || id.SupportsObfuscation() {
+		t.Errorf("Id change flags incorrect %v", id)
+	}
+
+	id2 := IdChange{ClientId: HIGHEST_LOWID_ED2K, TcpFlags: SRV_TCPFLG_UNICODE | SRV_TCPFLG_TCPOBFUSCATION}
+	if id2.IsLowId() || id2.SupportsCompression() || id2.SupportsLargeFiles() || !id2.SupportsUnicode() || !id2.SupportsObfuscation() {
+		t.Errorf("Id change 2 flags incorrect %v", id2)
+	}
+}
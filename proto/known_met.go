@@ -0,0 +1,165 @@
+package proto
+
+import (
+	"fmt"
+	"math"
+)
+
+const MET_HEADER_I64TAGS byte = MET_HEADER_WITH_LARGEFILES
+
+const MAX_KNOWN_FILES int = 100000
+
+// KNOWN_PATH_TAG stores full path of the file, eMule keeps unknown named tags untouched
+const KNOWN_PATH_TAG = "path"
+
+// KnownFile is known.met entry: hashes of the local file identified by path, size and modification time
+type KnownFile struct {
+	Date     uint32
+	HashSet  HashSet
+	Filename string
+	Path     string
+	Filesize uint64
+}
+
+func (kf KnownFile) Tags() TagCollection {
+	res := TagCollection{CreateTag(kf.Filename, FT_FILENAME, "")}
+	if kf.Filesize > math.MaxUint32 {
+		res = append(res, CreateTag(kf.Filesize, FT_FILESIZE, ""))
+	} else {
+		res = append(res, CreateTag(uint32(kf.Filesize), FT_FILESIZE, ""))
+	}
+
+	if kf.Path != "" {
+		res = append(res, CreateTag(kf.Path, 0, KNOWN_PATH_TAG))
+	}
+
+	return res
+}
+
+func (kf *KnownFile) Get(sb *StateBuffer) *StateBuffer {
+	kf.Date = sb.ReadUint32()
+	sb.Read(&kf.HashSet.Hash)
+	count := sb.ReadUint16()
+	if sb.err != nil {
+		return sb
+	}
+
+	if int(count) > MAX_ELEMS {
+		sb.err = fmt.Errorf("known file hashes count too large %d", count)
+		return sb
+	}
+
+	kf.HashSet.PieceHashes = make([]ED2KHash, count)
+	for i := range kf.HashSet.PieceHashes {
+		sb.Read(&kf.HashSet.PieceHashes[i])
+	}
+
+	tags := TagCollection{}
+	sb.Read(&tags)
+	if sb.err != nil {
+		return sb
+	}
+
+	var sizeHi uint64
+	for _, x := range tags {
+		if x.Name == KNOWN_PATH_TAG && x.IsString() {
+			kf.Path = x.AsString()
+			continue
+		}
+
+		switch x.Id {
+		case FT_FILENAME:
+			kf.Filename = x.AsString()
+		case FT_FILESIZE:
+			if x.IsUint64() {
+				kf.Filesize = x.AsUint64()
+			} else if v := x.AsInt(); v >= 0 {
+				kf.Filesize = uint64(v)
+			}
+		case FT_FILESIZE_HI:
+			if v := x.AsInt(); v >= 0 {
+				sizeHi = uint64(v)
+			}
+		}
+	}
+
+	kf.Filesize |= sizeHi << 32
+
+	// eMule stores only hash of the single piece files without hash set
+	if len(kf.HashSet.PieceHashes) == 0 && kf.Filesize < PIECE_SIZE_UINT64 {
+		kf.HashSet.PieceHashes = []ED2KHash{kf.HashSet.Hash}
+	}
+
+	return sb
+}
+
+// storedHashSet returns hash set in eMule format without piece hashes for single piece files
+func (kf KnownFile) storedHashSet() HashSet {
+	if kf.Filesize < PIECE_SIZE_UINT64 {
+		return HashSet{Hash: kf.HashSet.Hash}
+	}
+
+	return kf.HashSet
+}
+
+func (kf KnownFile) Put(sb *StateBuffer) *StateBuffer {
+	sb.Write(kf.Date).Write(kf.storedHashSet())
+	return sb.Write(kf.Tags())
+}
+
+func (kf KnownFile) Size() int {
+	return DataSize(kf.Date) + DataSize(kf.storedHashSet()) + DataSize(kf.Tags())
+}
+
+type KnownMet struct {
+	Header byte
+	Files  []KnownFile
+}
+
+func (km *KnownMet) Get(sb *StateBuffer) *StateBuffer {
+	km.Header = sb.ReadUint8()
+	if sb.err != nil {
+		return sb
+	}
+
+	if km.Header != MET_HEADER && km.Header != MET_HEADER_I64TAGS {
+		sb.err = fmt.Errorf("known met header is incorrect %x", km.Header)
+		return sb
+	}
+
+	count := sb.ReadUint32()
+	if sb.err == nil {
+		if int(count) > MAX_KNOWN_FILES {
+			sb.err = fmt.Errorf("known files count too large %d", count)
+			return sb
+		}
+
+		km.Files = make([]KnownFile, 0, count)
+		for i := 0; i < int(count); i++ {
+			kf := KnownFile{}
+			sb.Read(&kf)
+			if sb.err != nil {
+				break
+			}
+			km.Files = append(km.Files, kf)
+		}
+	}
+
+	return sb
+}
+
+func (km KnownMet) Put(sb *StateBuffer) *StateBuffer {
+	sb.Write(km.Header).Write(uint32(len(km.Files)))
+	for _, x := range km.Files {
+		sb.Write(x)
+	}
+	return sb
+}
+
+func (km KnownMet) Size() int {
+	res := DataSize(km.Header) + DataSize(uint32(0))
+	for _, x := range km.Files {
+		res += DataSize(x)
+	}
+	return res
+}
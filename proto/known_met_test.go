@@ -0,0 +1,48 @@
+package proto
+
+import (
+	"testing"
+)
+
+func Test_KnownMet(t *testing.T) {
+	hashes := []ED2KHash{EMULE, Terminal}
+	km := KnownMet{Header: MET_HEADER_I64TAGS, Files: []KnownFile{
+		{Date: 1000, HashSet: HashSet{Hash: LIBED2K, PieceHashes: []ED2KHash{LIBED2K}}, Filename: "small.txt", Path: "/tmp/small.txt", Filesize: 100},
+		{Date: 2000, HashSet: HashSet{Hash: ResultHash(hashes), PieceHashes: hashes}, Filename: "large.bin", Path: "/tmp/large.bin", Filesize: 0x100000000},
+	}}
+
+	data := make([]byte, DataSize(km))
+	sb := StateBuffer{Data: data}
+	sb.Write(km)
+	if sb.Error() != nil || sb.Offset() != len(data) {
+		t.Fatalf("Can not write known met %v", sb.Error())
+	}
+
+	km2 := KnownMet{}
+	sb2 := StateBuffer{Data: data}
+	sb2.Read(&km2)
+	if sb2.Error() != nil || len(km2.Files) != 2 {
+		t.Fatalf("Can not read known met %v", sb2.Error())
+	}
+
+	for i, x := range km2.Files {
+		y := km.Files[i]
+		if x.Date != y.Date || x.Filename != y.Filename || x.Path != y.Path || x.Filesize != y.Filesize || x.HashSet.Hash != y.HashSet.Hash || len(x.HashSet.PieceHashes) != len(y.HashSet.PieceHashes) {
+			t.Errorf("Known file %d does not match %v", i, x)
+		}
+	}
+
+	// single piece file is stored without piece hashes
+	if DataSize(km.Files[0].storedHashSet()) != 18 {
+		t.Error("Single piece file stored with hash set")
+	}
+}
+
+func Test_KnownMetIncorrectHeader(t *testing.T) {
+	km := KnownMet{}
+	sb := StateBuffer{Data: []byte{0x01, 0x00, 0x00, 0x00, 0x00}}
+	sb.Read(&km)
+	if sb.Error() == nil {
+		t.Error("Known met with incorrect header was read")
+	}
+}
@@ -0,0 +1,177 @@
+package proto
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const LINK_PREFIX = "ed2k://"
+
+const (
+	LINK_FILE = iota
+	LINK_SERVER
+	LINK_SERVERLIST
+)
+
+type EMuleLink struct {
+	Type int
+
+	// file link
+	Name        string
+	Size        uint64
+	Hash        ED2KHash
+	AICHHash    string
+	PieceHashes []ED2KHash
+	Sources     []Endpoint
+
+	// server link
+	Host string
+	Port uint16
+
+	// server list link
+	Url string
+}
+
+func ParseEMuleLink(s string) (EMuleLink, error) {
+	link := EMuleLink{}
+	s = strings.TrimSpace(s)
+
+	if !strings.HasPrefix(strings.ToLower(s), LINK_PREFIX) {
+		return link, fmt.Errorf("link has no %s prefix", LINK_PREFIX)
+	}
+
+	parts := strings.Split(s[len(LINK_PREFIX):], "|")
+	// leading empty element before the first separator
+	if len(parts) < 3 || parts[0] != "" {
+		return link, fmt.Errorf("link has incorrect format")
+	}
+
+	switch strings.ToLower(parts[1]) {
+	case "file":
+		if len(parts) < 6 {
+			return link, fmt.Errorf("file link has not enough parts %d", len(parts))
+		}
+
+		name, err := url.PathUnescape(parts[2])
+		if err != nil {
+			return link, fmt.Errorf("file link name can not be decoded %v", err)
+		}
+
+		// name becomes the file name in the incoming directory and must not point outside of it
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\\x00") {
+			return link, fmt.Errorf("file link has incorrect name %q", name)
+		}
+
+		size, err := strconv.ParseUint(parts[3], 10, 64)
+		if err != nil || size == 0 {
+			return link, fmt.Errorf("file link has incorrect size %s", parts[3])
+		}
+
+		if len(parts[4]) != HASH_LEN*2 {
+			return link, fmt.Errorf("file link has incorrect hash %s", parts[4])
+		}
+
+		hash := String2Hash(parts[4])
+		if hash == ZERO {
+			return link, fmt.Errorf("file link has incorrect hash %s", parts[4])
+		}
+
+		link.Type = LINK_FILE
+		link.Name = name
+		link.Size = size
+		link.Hash = hash
+
+		for i := 5; i < len(parts); i++ {
+			p := parts[i]
+			switch {
+			case p == "" || p == "/":
+			case strings.HasPrefix(p, "h="):
+				link.AICHHash = p[2:]
+			case strings.HasPrefix(p, "p="):
+				for _, x := range strings.Split(p[2:], ":") {
+					h := String2Hash(x)
+					if len(x) != HASH_LEN*2 || h == ZERO {
+						return link, fmt.Errorf("file link has incorrect piece hash %s", x)
+					}
+					link.PieceHashes = append(link.PieceHashes, h)
+				}
+			case strings.HasPrefix(strings.ToLower(p), "sources,"):
+				for _, x := range strings.Split(p[len("sources,"):], ",") {
+					ep, err := FromString(x)
+					if err != nil {
+						return link, fmt.Errorf("file link has incorrect source %s: %v", x, err)
+					}
+					link.Sources = append(link.Sources, ep)
+				}
+			default:
+				// unknown optional section like s=http://... - skip it
+			}
+		}
+	case "server":
+		if len(parts) < 5 {
+			return link, fmt.Errorf("server link has not enough parts %d", len(parts))
+		}
+
+		port, err := strconv.ParseUint(parts[3], 10, 16)
+		if err != nil || port == 0 || parts[2] == "" {
+			return link, fmt.Errorf("server link has incorrect address %s:%s", parts[2], parts[3])
+		}
+
+		link.Type = LINK_SERVER
+		link.Host = parts[2]
+		link.Port = uint16(port)
+	case "serverlist":
+		if len(parts) < 4 || parts[2] == "" {
+			return link, fmt.Errorf("server list link has no url")
+		}
+
+		link.Type = LINK_SERVERLIST
+		link.Url = parts[2]
+	default:
+		return link, fmt.Errorf("unknown link type %s", parts[1])
+	}
+
+	return link, nil
+}
+
+func (link EMuleLink) ToString() string {
+	switch link.Type {
+	case LINK_FILE:
+		res := fmt.Sprintf("%s|file|%s|%d|%s|", LINK_PREFIX, url.PathEscape(link.Name), link.Size, link.Hash.ToString())
+		if link.AICHHash != "" {
+			res += "h=" + link.AICHHash + "|"
+		}
+
+		if len(link.PieceHashes) > 0 {
+			hashes := make([]string, len(link.PieceHashes))
+			for i, x := range link.PieceHashes {
+				hashes[i] = x.ToString()
+			}
+			res += "p=" + strings.Join(hashes, ":") + "|"
+		}
+
+		res += "/"
+
+		if len(link.Sources) > 0 {
+			sources := make([]string, len(link.Sources))
+			for i, x := range link.Sources {
+				sources[i] = x.ToString()
+			}
+			res += "|sources," + strings.Join(sources, ",") + "|/"
+		}
+
+		return res
+	case LINK_SERVER:
+		return fmt.Sprintf("%s|server|%s|%d|/", LINK_PREFIX, link.Host, link.Port)
+	case LINK_SERVERLIST:
+		return fmt.Sprintf("%s|serverlist|%s|/", LINK_PREFIX, link.Url)
+	}
+
+	return ""
+}
+
+func (link EMuleLink) Address() string {
+	return fmt.Sprintf("%s:%d", link.Host, link.Port)
+}
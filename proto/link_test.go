@@ -0,0 +1,119 @@
+package proto
+
+import (
+	"testing"
+)
+
+func Test_FileLink(t *testing.T) {
+	link, err := ParseEMuleLink("ed2k://|file|some%20file.avi|12000000|D8B5305980DB239B8888439603E518B1|/")
+	if err != nil {
+		t.Errorf("Can not parse file link %v", err)
+	} else {
+		if link.Type != LINK_FILE || link.Name != "some file.avi" || link.Size != 12000000 || link.Hash != String2Hash("D8B5305980DB239B8888439603E518B1") {
+			t.Errorf("File link parsed incorrectly %v", link)
+		}
+
+		if len(link.Sources) != 0 || len(link.PieceHashes) != 0 || link.AICHHash != "" {
+			t.Errorf("File link has unexpected optional sections %v", link)
+		}
+	}
+}
+
+func Test_FileLinkOptional(t *testing.T) {
+	src := "ed2k://|file|data.bin|12000000|D8B5305980DB239B8888439603E518B1|h=BZVZPAXFC2LYQM4Q3VZFN7IDNYGXNVGG|" +
+		"p=31D6CFE0D10EE931B73C59D7E0C06FC0:31D6CFE0D16AE931B73C59D7E0C089C0|/|sources,192.168.0.1:4662,10.0.0.2:4663|/"
+	link, err := ParseEMuleLink(src)
+	if err != nil {
+		t.Errorf("Can not parse file link %v", err)
+	} else {
+		if link.AICHHash != "BZVZPAXFC2LYQM4Q3VZFN7IDNYGXNVGG" {
+			t.Errorf("AICH hash incorrect %s", link.AICHHash)
+		}
+
+		if len(link.PieceHashes) != 2 || link.PieceHashes[0] != EMULE || link.PieceHashes[1] != Terminal {
+			t.Errorf("Piece hashes incorrect %v", link.PieceHashes)
+		}
+
+		if len(link.Sources) != 2 || link.Sources[0] != EndpointFromString("192.168.0.1:4662") || link.Sources[1] != EndpointFromString("10.0.0.2:4663") {
+			t.Errorf("Sources incorrect %v", link.Sources)
+		}
+
+		if link.ToString() != src {
+			t.Errorf("Link to string %s does not match source %s", link.ToString(), src)
+		}
+	}
+}
+
+func Test_ServerLinks(t *testing.T) {
+	link, err := ParseEMuleLink("ed2k://|server|176.123.5.89|4725|/")
+	if err != nil {
+		t.Errorf("Can not parse server link %v", err)
+	} else if link.Type != LINK_SERVER || link.Host != "176.123.5.89" || link.Port != 4725 || link.Address() != "176.123.5.89:4725" {
+		t.Errorf("Server link parsed incorrectly %v", link)
+	} else if link.ToString() != "ed2k://|server|176.123.5.89|4725|/" {
+		t.Errorf("Server link to string incorrect %s", link.ToString())
+	}
+
+	list, err := ParseEMuleLink("ed2k://|serverlist|http://upd.emule-security.org/server.met|/")
+	if err != nil {
+		t.Errorf("Can not parse server list link %v", err)
+	} else if list.Type != LINK_SERVERLIST || list.Url != "http://upd.emule-security.org/server.met" {
+		t.Errorf("Server list link parsed incorrectly %v", list)
+	} else if list.ToString() != "ed2k://|serverlist|http://upd.emule-security.org/server.met|/" {
+		t.Errorf("Server list link to string incorrect %s", list.ToString())
+	}
+}
+
+func Test_IncorrectLinks(t *testing.T) {
+	links := []string{
+		"",
+		"http://|file|a|1|D8B5305980DB239B8888439603E518B1|/",
+		"ed2k://|file|a|0|D8B5305980DB239B8888439603E518B1|/",
+		"ed2k://|file|a|xx|D8B5305980DB239B8888439603E518B1|/",
+		"ed2k://|file|a|10|D8B5305980DB239B8888439603E518|/",
+		"ed2k://|file|a|10|D8B5305980DB239B8888439603E518B1|p=123|/",
+		"ed2k://|file|a|10|D8B5305980DB239B8888439603E518B1|/|sources,1.2.3:44|/",
+		"ed2k://|file|..%2F..%2F.bashrc|10|D8B5305980DB239B8888439603E518B1|/",
+		"ed2k://|file|%2Fetc%2Fcron.d%2Fx|10|D8B5305980DB239B8888439603E518B1|/",
+		"ed2k://|file|..|10|D8B5305980DB239B8888439603E518B1|/",
+		"ed2k://|file|a%5Cb|10|D8B5305980DB239B8888439603E518B1|/",
+		"ed2k://|file|a%00b|10|D8B5305980DB239B8888439603E518B1|/",
+		"ed2k://|file||10|D8B5305980DB239B8888439603E518B1|/",
+		"ed2k://|server|1.2.3.4|0|/",
+		"ed2k://|server|1.2.3.4|/",
+		"ed2k://|serverlist||/",
+		"ed2k://|search|abc|/",
+	}
+
+	for _, x := range links {
+		if _, err := ParseEMuleLink(x); err == nil {
+			t.Errorf("Incorrect link %s was parsed", x)
+		}
+	}
+}
+
+func Test_HashSetValidation(t *testing.T) {
+	if HashSetSize(100) != 1 || HashSetSize(PIECE_SIZE_UINT64) != 2 || HashSetSize(PIECE_SIZE_UINT64+1) != 2 || HashSetSize(PIECE_SIZE_UINT64*3) != 4 {
+		t.Error("Hash set size is not correct")
+	}
+
+	small := HashSet{Hash: EMULE, PieceHashes: []ED2KHash{EMULE}}
+	if !small.IsValid(100) {
+		t.Error("Single piece hash set is not valid")
+	}
+
+	hashes := []ED2KHash{EMULE, Terminal}
+	hs := HashSet{Hash: ResultHash(hashes), PieceHashes: hashes}
+	if !hs.IsValid(PIECE_SIZE_UINT64 + 100) {
+		t.Error("Hash set is not valid")
+	}
+
+	if hs.IsValid(PIECE_SIZE_UINT64*2 + 100) {
+		t.Error("Hash set with wrong pieces count is valid")
+	}
+
+	hs.Hash = LIBED2K
+	if hs.IsValid(PIECE_SIZE_UINT64 + 100) {
+		t.Error("Hash set with wrong hash is valid")
+	}
+}
@@ -37,8 +37,8 @@ type Hello struct {
 }
 
 func (hello *Hello) Get(sb *StateBuffer) *StateBuffer {
-	sb.ReadUint8()
-	return sb.Read(hello.Answer)
+	hello.HashLength = sb.ReadUint8()
+	return sb.Read(&hello.Answer)
 }
 
 func (hello Hello) Put(sb *StateBuffer) *StateBuffer {
@@ -154,6 +154,20 @@ func ResultHash(hashes []ED2KHash) ED2KHash {
 	return result
 }
 
+// HashSetSize returns count of piece hashes in the hash set for the file of size.
+// Files with size multiple of PIECE_SIZE have additional hash of the empty tail piece
+func HashSetSize(size uint64) int {
+	if size < PIECE_SIZE_UINT64 {
+		return 1
+	}
+
+	return int(size/PIECE_SIZE_UINT64) + 1
+}
+
+func (hs HashSet) IsValid(size uint64) bool {
+	return len(hs.PieceHashes) == HashSetSize(size) && ResultHash(hs.PieceHashes).Equals(hs.Hash)
+}
+
 type RequestParts32 struct {
 	Hash        ED2KHash
 	BeginOffset [PARTS_IN_REQUEST]uint32
@@ -351,7 +365,14 @@ func (cp *CompressedPart) Get(sb *StateBuffer) *StateBuffer {
 }
 
 func (cp *CompressedPart) Put(sb *StateBuffer) *StateBuffer {
-	return sb.Write(cp.Hash).Write(uint32(cp.Offset)).Write(cp.CompressedDataLength)
+	sb.Write(cp.Hash)
+	if cp.Extended {
+		sb.Write(cp.Offset)
+	} else {
+		sb.Write(uint32(cp.Offset))
+	}
+
+	return sb.Write(cp.CompressedDataLength)
 }
 
 func (cp CompressedPart) Size() int {
@@ -361,3 +382,21 @@ func (cp CompressedPart) Size() int {
 	}
 	return size + DataSize(cp.Hash) + DataSize(cp.CompressedDataLength)
 }
+
+// QueueRanking is position in the remote upload queue, eMule pads the packet up to 12 bytes
+type QueueRanking struct {
+	Rank uint16
+}
+
+func (qr *QueueRanking) Get(sb *StateBuffer) *StateBuffer {
+	qr.Rank = sb.ReadUint16()
+	return sb
+}
+
+func (qr QueueRanking) Put(sb *StateBuffer) *StateBuffer {
+	return sb.Write(qr.Rank).Write(make([]byte, 10))
+}
+
+func (qr QueueRanking) Size() int {
+	return DataSize(qr.Rank) + 10
+}
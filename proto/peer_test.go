@@ -159,3 +159,20 @@ func Test_MiscOptions(t *testing.T) {
 		t.Error("Source files exchange ver incorrect")
 	}
 }
+
+func Test_QueueRanking(t *testing.T) {
+	qr := QueueRanking{Rank: 0x1234}
+	data := make([]byte, DataSize(qr))
+	sb := StateBuffer{Data: data}
+	sb.Write(qr)
+	if sb.Error() != nil || sb.Offset() != 12 || data[0] != 0x34 || data[1] != 0x12 {
+		t.Errorf("Queue ranking write incorrect %x %v", data, sb.Error())
+	}
+
+	qr2 := QueueRanking{}
+	sb2 := StateBuffer{Data: data}
+	sb2.Read(&qr2)
+	if sb2.Error() != nil || qr2.Rank != qr.Rank {
+		t.Errorf("Queue ranking read incorrect %v", qr2)
+	}
+}
@@ -3,6 +3,9 @@ package proto
 import (
 	"fmt"
 	"log"
+	"math"
+	"path/filepath"
+	"strings"
 )
 
 const SEARCH_TYPE_BOOL byte = 0x00
@@ -499,14 +502,23 @@ func (sm SearchMore) Size() int {
 	return 0
 }
 
+// GetFileSources writes v2 request <HASH 16><SIZE 4> or v2large <HASH 16><0 4><SIZE 8> for files larger than 4GB
 type GetFileSources struct {
-	Hash    ED2KHash
-	LowPart uint32
-	HiPart  uint32
+	Hash     ED2KHash
+	Filesize uint64
+}
+
+func (gfs GetFileSources) IsLarge() bool {
+	return gfs.Filesize > math.MaxUint32
 }
 
 func (gfs GetFileSources) Put(sb *StateBuffer) *StateBuffer {
-	return sb.Write(gfs.Hash).Write(gfs.LowPart).Write(gfs.HiPart)
+	sb.Write(gfs.Hash)
+	if gfs.IsLarge() {
+		return sb.Write(uint32(0)).Write(gfs.Filesize)
+	}
+
+	return sb.Write(uint32(gfs.Filesize))
 }
 
 func (gfs *GetFileSources) Get(*StateBuffer) *StateBuffer {
@@ -514,7 +526,11 @@ func (gfs *GetFileSources) Get(*StateBuffer) *StateBuffer {
 }
 
 func (gfs GetFileSources) Size() int {
-	return DataSize(gfs.Hash) + DataSize(gfs.LowPart) + DataSize(gfs.HiPart)
+	if gfs.IsLarge() {
+		return DataSize(gfs.Hash) + DataSize(uint32(0)) + DataSize(gfs.Filesize)
+	}
+
+	return DataSize(gfs.Hash) + DataSize(uint32(0))
 }
 
 type SearchResult struct {
@@ -596,3 +612,28 @@ func ToSearchItem(up *UsualPacket) SearchItem {
 	}
 	return res
 }
+
+var ed2kFileTypes = map[string]string{
+	".mp3": ED2KFTSTR_AUDIO, ".ogg": ED2KFTSTR_AUDIO, ".flac": ED2KFTSTR_AUDIO, ".wav": ED2KFTSTR_AUDIO, ".wma": ED2KFTSTR_AUDIO,
+	".aac": ED2KFTSTR_AUDIO, ".m4a": ED2KFTSTR_AUDIO, ".ape": ED2KFTSTR_AUDIO, ".mid": ED2KFTSTR_AUDIO,
+	".avi": ED2KFTSTR_VIDEO, ".mkv": ED2KFTSTR_VIDEO, ".mp4": ED2KFTSTR_VIDEO, ".mpg": ED2KFTSTR_VIDEO, ".mpeg": ED2KFTSTR_VIDEO,
+	".wmv": ED2KFTSTR_VIDEO, ".mov": ED2KFTSTR_VIDEO, ".ogm": ED2KFTSTR_VIDEO, ".divx": ED2KFTSTR_VIDEO, ".flv": ED2KFTSTR_VIDEO,
+	".webm": ED2KFTSTR_VIDEO, ".vob": ED2KFTSTR_VIDEO, ".m4v": ED2KFTSTR_VIDEO,
+	".jpg": ED2KFTSTR_IMAGE, ".jpeg": ED2KFTSTR_IMAGE, ".png": ED2KFTSTR_IMAGE, ".gif": ED2KFTSTR_IMAGE, ".bmp": ED2KFTSTR_IMAGE,
+	".tif": ED2KFTSTR_IMAGE, ".tiff": ED2KFTSTR_IMAGE, ".webp": ED2KFTSTR_IMAGE,
+	".txt": ED2KFTSTR_DOCUMENT, ".pdf": ED2KFTSTR_DOCUMENT, ".doc": ED2KFTSTR_DOCUMENT, ".docx": ED2KFTSTR_DOCUMENT, ".rtf": ED2KFTSTR_DOCUMENT,
+	".odt": ED2KFTSTR_DOCUMENT, ".epub": ED2KFTSTR_DOCUMENT, ".djvu": ED2KFTSTR_DOCUMENT, ".chm": ED2KFTSTR_DOCUMENT, ".htm": ED2KFTSTR_DOCUMENT,
+	".html": ED2KFTSTR_DOCUMENT,
+	".exe":  ED2KFTSTR_PROGRAM, ".msi": ED2KFTSTR_PROGRAM, ".com": ED2KFTSTR_PROGRAM, ".bat": ED2KFTSTR_PROGRAM, ".apk": ED2KFTSTR_PROGRAM,
+	".deb": ED2KFTSTR_PROGRAM, ".rpm": ED2KFTSTR_PROGRAM,
+	".zip": ED2KFTSTR_ARCHIVE, ".rar": ED2KFTSTR_ARCHIVE, ".7z": ED2KFTSTR_ARCHIVE, ".gz": ED2KFTSTR_ARCHIVE, ".bz2": ED2KFTSTR_ARCHIVE,
+	".tar": ED2KFTSTR_ARCHIVE, ".xz": ED2KFTSTR_ARCHIVE, ".ace": ED2KFTSTR_ARCHIVE, ".arj": ED2KFTSTR_ARCHIVE,
+	".iso": ED2KFTSTR_CDIMAGE, ".bin": ED2KFTSTR_CDIMAGE, ".cue": ED2KFTSTR_CDIMAGE, ".nrg": ED2KFTSTR_CDIMAGE, ".img": ED2KFTSTR_CDIMAGE,
+	".mdf": ED2KFTSTR_CDIMAGE, ".mds": ED2KFTSTR_CDIMAGE,
+	".emulecollection": ED2KFTSTR_EMULECOLLECTION,
+}
+
+// GetED2KFileType returns FT_FILETYPE value for the file by extension or empty string when type is unknown
+func GetED2KFileType(filename string) string {
+	return ed2kFileTypes[strings.ToLower(filepath.Ext(filename))]
+}
@@ -185,3 +185,24 @@ func Test_searchSimple(t *testing.T) {
 		}
 	}
 }
+
+func Test_GetFileSources(t *testing.T) {
+	small := GetFileSources{Hash: EMULE, Filesize: 0xFFFFFFFF}
+	large := GetFileSources{Hash: EMULE, Filesize: 0x100000000}
+	if small.IsLarge() || !large.IsLarge() {
+		t.Error("Large file detection incorrect")
+	}
+
+	if DataSize(small) != 20 || DataSize(large) != 28 {
+		t.Errorf("Get sources size incorrect %d %d", DataSize(small), DataSize(large))
+	}
+
+	data := make([]byte, DataSize(large))
+	sb := StateBuffer{Data: data}
+	sb.Write(large)
+	if sb.Error() != nil || sb.Offset() != len(data) {
+		t.Errorf("Can not write large get sources %v", sb.Error())
+	} else if data[16] != 0 || data[17] != 0 || data[18] != 0 || data[19] != 0 || data[24] != 0x01 {
+		t.Errorf("Large get sources format incorrect %x", data)
+	}
+}
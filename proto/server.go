@@ -1,5 +1,7 @@
 package proto
 
+import "fmt"
+
 const SRV_TCPFLG_COMPRESSION = 0x00000001
 const SRV_TCPFLG_NEWTAGS = 0x00000008
 const SRV_TCPFLG_UNICODE = 0x00000010
@@ -92,6 +94,30 @@ func (i IdChange) Size() int {
 	return DataSize(i.AuxPort) + DataSize(i.ClientId) + DataSize(i.TcpFlags)
 }
 
+func IsLowId(id uint32) bool {
+	return id < HIGHEST_LOWID_ED2K
+}
+
+func (i IdChange) IsLowId() bool {
+	return IsLowId(i.ClientId)
+}
+
+func (i IdChange) SupportsCompression() bool {
+	return (i.TcpFlags & SRV_TCPFLG_COMPRESSION) != 0
+}
+
+func (i IdChange) SupportsUnicode() bool {
+	return (i.TcpFlags & SRV_TCPFLG_UNICODE) != 0
+}
+
+func (i IdChange) SupportsLargeFiles() bool {
+	return (i.TcpFlags & SRV_TCPFLG_LARGEFILES) != 0
+}
+
+func (i IdChange) SupportsObfuscation() bool {
+	return (i.TcpFlags & SRV_TCPFLG_TCPOBFUSCATION) != 0
+}
+
 type Status struct {
 	UsersCount uint32
 	FilesCount uint32
@@ -122,3 +148,46 @@ func (gl GetServerList) Put(sb *StateBuffer) *StateBuffer {
 func (gl GetServerList) Size() int {
 	return 0
 }
+
+// special client id and port in OP_OFFERFILES mark complete and incomplete files for servers supporting compression
+const OFFER_COMPLETE_ID uint32 = 0xFBFBFBFB
+const OFFER_COMPLETE_PORT uint16 = 0xFBFB
+const OFFER_INCOMPLETE_ID uint32 = 0xFCFCFCFC
+const OFFER_INCOMPLETE_PORT uint16 = 0xFCFC
+
+type OfferFiles struct {
+	Files []UsualPacket
+}
+
+func (of *OfferFiles) Get(sb *StateBuffer) *StateBuffer {
+	count := sb.ReadUint32()
+	if sb.err == nil {
+		if int(count) > MAX_ELEMS {
+			sb.err = fmt.Errorf("offer files count too large %d", count)
+			return sb
+		}
+
+		of.Files = make([]UsualPacket, count)
+		for i := range of.Files {
+			sb.Read(&of.Files[i])
+		}
+	}
+
+	return sb
+}
+
+func (of OfferFiles) Put(sb *StateBuffer) *StateBuffer {
+	sb.Write(uint32(len(of.Files)))
+	for _, x := range of.Files {
+		sb.Write(x)
+	}
+	return sb
+}
+
+func (of OfferFiles) Size() int {
+	res := DataSize(uint32(0))
+	for _, x := range of.Files {
+		res += DataSize(x)
+	}
+	return res
+}
@@ -0,0 +1,244 @@
+package proto
+
+import (
+	"fmt"
+)
+
+const MET_HEADER byte = 0x0E
+const MET_HEADER_WITH_LARGEFILES byte = 0x0F
+const MET_HEADER_SERVER byte = 0xE0
+
+const MAX_SERVERS int = 5000
+
+const SRV_PR_NORMAL uint32 = 0
+const SRV_PR_HIGH uint32 = 1
+const SRV_PR_LOW uint32 = 2
+
+const ST_USERS = "users"
+const ST_FILES = "files"
+
+// ServerInfo describes ed2k server properties from server.met entry or OP_SERVERIDENT packet
+type ServerInfo struct {
+	Hash        ED2KHash
+	Point       Endpoint
+	Name        string
+	Description string
+	DynIP       string
+	Version     string
+	UsersCount  uint32
+	FilesCount  uint32
+	MaxUsers    uint32
+	SoftFiles   uint32
+	HardFiles   uint32
+	LowIdUsers  uint32
+	FailCount   uint32
+	Priority    uint32
+	Ping        uint32
+	LastPing    uint32
+	UdpFlags    uint32
+}
+
+// tagUint32 returns value of integer tag, tag of other type gives zero which means unknown value
+func tagUint32(t Tag) uint32 {
+	if v := t.AsInt(); v >= 0 {
+		return uint32(v)
+	}
+
+	return 0
+}
+
+func ToServerInfo(hash ED2KHash, point Endpoint, tags TagCollection) ServerInfo {
+	res := ServerInfo{Hash: hash, Point: point}
+	for _, x := range tags {
+		if x.Name != "" {
+			switch x.Name {
+			case ST_USERS:
+				res.UsersCount = tagUint32(x)
+			case ST_FILES:
+				res.FilesCount = tagUint32(x)
+			}
+			continue
+		}
+
+		switch x.Id {
+		case ST_SERVERNAME:
+			res.Name = x.AsString()
+		case ST_DESCRIPTION:
+			res.Description = x.AsString()
+		case ST_DYNIP:
+			res.DynIP = x.AsString()
+		case ST_VERSION:
+			if x.IsString() {
+				res.Version = x.AsString()
+			} else if v := x.AsInt(); v >= 0 {
+				res.Version = fmt.Sprintf("%d.%d", v>>16, v&0xffff)
+			}
+		case ST_MAXUSERS:
+			res.MaxUsers = tagUint32(x)
+		case ST_SOFTFILES:
+			res.SoftFiles = tagUint32(x)
+		case ST_HARDFILES:
+			res.HardFiles = tagUint32(x)
+		case ST_LOWIDUSERS:
+			res.LowIdUsers = tagUint32(x)
+		case ST_FAIL:
+			res.FailCount = tagUint32(x)
+		case ST_PREFERENCE:
+			res.Priority = tagUint32(x)
+		case ST_PING:
+			res.Ping = tagUint32(x)
+		case ST_LASTPING:
+			res.LastPing = tagUint32(x)
+		case ST_UDPFLAGS:
+			res.UdpFlags = tagUint32(x)
+		}
+	}
+
+	return res
+}
+
+func (si ServerInfo) Tags() TagCollection {
+	res := TagCollection{}
+	if si.Name != "" {
+		res = append(res, CreateTag(si.Name, ST_SERVERNAME, ""))
+	}
+
+	if si.Description != "" {
+		res = append(res, CreateTag(si.Description, ST_DESCRIPTION, ""))
+	}
+
+	if si.DynIP != "" {
+		res = append(res, CreateTag(si.DynIP, ST_DYNIP, ""))
+	}
+
+	if si.Version != "" {
+		res = append(res, CreateTag(si.Version, ST_VERSION, ""))
+	}
+
+	numbers := []struct {
+		value uint32
+		id    byte
+		name  string
+	}{
+		{si.UsersCount, 0, ST_USERS},
+		{si.FilesCount, 0, ST_FILES},
+		{si.MaxUsers, ST_MAXUSERS, ""},
+		{si.SoftFiles, ST_SOFTFILES, ""},
+		{si.HardFiles, ST_HARDFILES, ""},
+		{si.LowIdUsers, ST_LOWIDUSERS, ""},
+		{si.FailCount, ST_FAIL, ""},
+		{si.Priority, ST_PREFERENCE, ""},
+		{si.Ping, ST_PING, ""},
+		{si.LastPing, ST_LASTPING, ""},
+		{si.UdpFlags, ST_UDPFLAGS, ""},
+	}
+
+	for _, x := range numbers {
+		if x.value != 0 {
+			res = append(res, CreateTag(x.value, x.id, x.name))
+		}
+	}
+
+	return res
+}
+
+// Get reads server info in OP_SERVERIDENT format
+func (si *ServerInfo) Get(sb *StateBuffer) *StateBuffer {
+	up := UsualPacket{}
+	sb.Read(&up)
+	if sb.err == nil {
+		*si = ToServerInfo(up.Hash, up.Point, up.Properties)
+	}
+
+	return sb
+}
+
+func (si ServerInfo) Put(sb *StateBuffer) *StateBuffer {
+	return sb.Write(UsualPacket{Hash: si.Hash, Point: si.Point, Properties: si.Tags()})
+}
+
+func (si ServerInfo) Size() int {
+	return DataSize(UsualPacket{Hash: si.Hash, Point: si.Point, Properties: si.Tags()})
+}
+
+type ServerMet struct {
+	Header  byte
+	Servers []ServerInfo
+}
+
+func (sm *ServerMet) Get(sb *StateBuffer) *StateBuffer {
+	sm.Header = sb.ReadUint8()
+	if sb.err != nil {
+		return sb
+	}
+
+	if sm.Header != MET_HEADER && sm.Header != MET_HEADER_WITH_LARGEFILES && sm.Header != MET_HEADER_SERVER {
+		sb.err = fmt.Errorf("server met header is incorrect %x", sm.Header)
+		return sb
+	}
+
+	count := sb.ReadUint32()
+	if sb.err == nil {
+		if int(count) > MAX_SERVERS {
+			sb.err = fmt.Errorf("servers count too large %d", count)
+			return sb
+		}
+
+		sm.Servers = make([]ServerInfo, 0, count)
+		for i := 0; i < int(count); i++ {
+			point := Endpoint{}
+			tags := TagCollection{}
+			sb.Read(&point).Read(&tags)
+			if sb.err != nil {
+				break
+			}
+			sm.Servers = append(sm.Servers, ToServerInfo(ZERO, point, tags))
+		}
+	}
+
+	return sb
+}
+
+func (sm ServerMet) Put(sb *StateBuffer) *StateBuffer {
+	sb.Write(sm.Header).Write(uint32(len(sm.Servers)))
+	for _, x := range sm.Servers {
+		sb.Write(x.Point).Write(x.Tags())
+	}
+	return sb
+}
+
+func (sm ServerMet) Size() int {
+	res := DataSize(sm.Header) + DataSize(uint32(0))
+	for _, x := range sm.Servers {
+		res += DataSize(x.Point) + DataSize(x.Tags())
+	}
+	return res
+}
+
+type ServerListAnswer struct {
+	Servers []Endpoint
+}
+
+func (sl *ServerListAnswer) Get(sb *StateBuffer) *StateBuffer {
+	count := sb.ReadUint8()
+	if sb.err == nil {
+		sl.Servers = make([]Endpoint, count)
+		for i := range sl.Servers {
+			sb.Read(&sl.Servers[i])
+		}
+	}
+
+	return sb
+}
+
+func (sl ServerListAnswer) Put(sb *StateBuffer) *StateBuffer {
+	sb.Write(uint8(len(sl.Servers)))
+	for _, x := range sl.Servers {
+		sb.Write(x)
+	}
+	return sb
+}
+
+func (sl ServerListAnswer) Size() int {
+	return DataSize(uint8(0)) + len(sl.Servers)*DataSize(Endpoint{})
+}
@@ -0,0 +1,107 @@
+package proto
+
+import (
+	"testing"
+)
+
+func Test_ServerMet(t *testing.T) {
+	sm := ServerMet{Header: MET_HEADER, Servers: []ServerInfo{
+		{Point: EndpointFromString("176.123.5.89:4725"), Name: "eMule Security", Description: "www.emule-security.org", UsersCount: 1000, FilesCount: 200000, Priority: SRV_PR_HIGH},
+		{Point: EndpointFromString("5.45.85.226:6584"), FailCount: 2, Version: "17.15", SoftFiles: 300, HardFiles: 500}}}
+
+	data := make([]byte, sm.Size())
+	sb := StateBuffer{Data: data}
+	sb.Write(sm)
+	if sb.Error() != nil {
+		t.Errorf("Can not write server met %v", sb.Error())
+	} else if sb.Offset() != len(data) {
+		t.Errorf("Written size %d does not match calculated %d", sb.Offset(), len(data))
+	}
+
+	sm2 := ServerMet{}
+	sb2 := StateBuffer{Data: data}
+	sb2.Read(&sm2)
+	if sb2.Error() != nil {
+		t.Errorf("Can not read server met %v", sb2.Error())
+	} else if sm2.Header != MET_HEADER || len(sm2.Servers) != 2 {
+		t.Errorf("Server met read incorrectly %v", sm2)
+	} else {
+		for i := range sm.Servers {
+			if sm.Servers[i] != sm2.Servers[i] {
+				t.Errorf("Server %d does not match: %v expected %v", i, sm2.Servers[i], sm.Servers[i])
+			}
+		}
+	}
+
+	sb3 := StateBuffer{Data: []byte{0x01, 0x00, 0x00, 0x00, 0x00}}
+	sb3.Read(&ServerMet{})
+	if sb3.Error() == nil {
+		t.Error("Server met with incorrect header was read")
+	}
+}
+
+func Test_ServerInfoFromIdent(t *testing.T) {
+	up := UsualPacket{Hash: EMULE, Point: EndpointFromString("10.0.0.1:4661"),
+		Properties: TagCollection{CreateTag("Server", ST_SERVERNAME, ""), CreateTag("Description", ST_DESCRIPTION, ""), CreateTag(uint32(0x0011000F), ST_VERSION, "")}}
+	data := make([]byte, up.Size())
+	sb := StateBuffer{Data: data}
+	sb.Write(up)
+
+	si := ServerInfo{}
+	sb2 := StateBuffer{Data: data}
+	sb2.Read(&si)
+	if sb2.Error() != nil {
+		t.Errorf("Can not read server info %v", sb2.Error())
+	} else if si.Hash != EMULE || si.Point != up.Point || si.Name != "Server" || si.Description != "Description" || si.Version != "17.15" {
+		t.Errorf("Server info read incorrectly %v", si)
+	}
+}
+
+func Test_ServerInfoNotIntegerTags(t *testing.T) {
+	tags := TagCollection{CreateTag("many", 0, ST_USERS), CreateTag(uint64(100), 0, ST_FILES), CreateTag("x", ST_MAXUSERS, ""), CreateTag(uint32(7), ST_SOFTFILES, "")}
+	si := ToServerInfo(EMULE, EndpointFromString("10.0.0.1:4661"), tags)
+	if si.UsersCount != 0 || si.FilesCount != 0 || si.MaxUsers != 0 || si.SoftFiles != 7 {
+		t.Errorf("Not integer tags were converted to counts %v", si)
+	}
+}
+
+func Test_ServerListAnswer(t *testing.T) {
+	data := []byte{0x02, 0x01, 0x02, 0x03, 0x04, 0x10, 0x00, 0x05, 0x06, 0x07, 0x08, 0x20, 0x00}
+	sl := ServerListAnswer{}
+	sb := StateBuffer{Data: data}
+	sb.Read(&sl)
+	if sb.Error() != nil {
+		t.Errorf("Can not read server list %v", sb.Error())
+	} else if len(sl.Servers) != 2 || sl.Servers[0].ToString() != "1.2.3.4:16" || sl.Servers[1].ToString() != "5.6.7.8:32" {
+		t.Errorf("Server list read incorrectly %v", sl.Servers)
+	}
+
+	if sl.Size() != len(data) {
+		t.Errorf("Server list size %d incorrect", sl.Size())
+	}
+}
+
+func Test_OfferFiles(t *testing.T) {
+	of := OfferFiles{Files: []UsualPacket{
+		{Hash: EMULE, Point: Endpoint{Ip: OFFER_COMPLETE_ID, Port: OFFER_COMPLETE_PORT}, Properties: TagCollection{CreateTag("a.txt", FT_FILENAME, ""), CreateTag(uint32(100), FT_FILESIZE, "")}},
+		{Hash: LIBED2K, Point: Endpoint{Ip: OFFER_INCOMPLETE_ID, Port: OFFER_INCOMPLETE_PORT}},
+	}}
+
+	data := make([]byte, DataSize(of))
+	sb := StateBuffer{Data: data}
+	sb.Write(of)
+	if sb.Error() != nil || sb.Offset() != len(data) {
+		t.Fatalf("Can not write offer files %v", sb.Error())
+	}
+
+	of2 := OfferFiles{}
+	sb2 := StateBuffer{Data: data}
+	sb2.Read(&of2)
+	if sb2.Error() != nil || len(of2.Files) != 2 || of2.Files[0].Hash != EMULE || of2.Files[1].Point.Ip != OFFER_INCOMPLETE_ID || len(of2.Files[0].Properties) != 2 {
+		t.Errorf("Offer files read incorrect %v %v", of2, sb2.Error())
+	}
+
+	if GetED2KFileType("/tmp/Song.MP3") != ED2KFTSTR_AUDIO || GetED2KFileType("noext") != "" {
+		t.Error("File type detection incorrect")
+	}
+}
@@ -544,7 +544,7 @@ func (t Tag) IsUint32() bool {
 }
 
 func (t Tag) AsUint32() uint32 {
-	return binary.BigEndian.Uint32(t.value)
+	return binary.LittleEndian.Uint32(t.value)
 }
 
 func (t Tag) IsUint64() bool {
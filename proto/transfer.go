@@ -33,15 +33,28 @@ func (pb PieceBlock) ToString() string {
 	return fmt.Sprintf("[%d:%d]", pb.PieceIndex, pb.BlockIndex)
 }
 
+const (
+	PIECE_PRIORITY_SKIP byte = iota
+	PIECE_PRIORITY_LOW
+	PIECE_PRIORITY_NORMAL
+	PIECE_PRIORITY_HIGH
+)
+
 type AddTransferParameters struct {
 	Hashes           HashSet
 	Filename         ByteContainer
 	Filesize         uint64
 	Pieces           BitField
 	DownloadedBlocks map[int]BitField
+	// Priorities of pieces, empty means normal priority for all pieces
+	Priorities []byte
+	Paused     bool
+	// Storage is mode of keeping transfer data, zero is sparse file
+	Storage byte
 }
 
-func (atp *AddTransferParameters) Get(sb *StateBuffer) *StateBuffer {
+// GetBase reads fields of resume data saved before priorities were introduced, the rest of data is not read
+func (atp *AddTransferParameters) GetBase(sb *StateBuffer) *StateBuffer {
 	sb.Read(&atp.Hashes).Read(&atp.Filename).Read(&atp.Filesize).Read(&atp.Pieces)
 	atp.DownloadedBlocks = make(map[int]BitField)
 	downloadedBlocksSize := int(sb.ReadUint16())
@@ -64,6 +77,41 @@ func (atp *AddTransferParameters) Get(sb *StateBuffer) *StateBuffer {
 	return sb
 }
 
+func (atp *AddTransferParameters) Get(sb *StateBuffer) *StateBuffer {
+	// resume data saved before priorities were introduced ends here
+	if atp.GetBase(sb); sb.Error() != nil || sb.Offset() == len(sb.Data) {
+		return sb
+	}
+
+	prioritiesSize := int(sb.ReadUint32())
+	if sb.Error() == nil {
+		if prioritiesSize > atp.Pieces.Bits() {
+			sb.err = fmt.Errorf("priorities size %v exceeds pieces count %v", prioritiesSize, atp.Pieces.Bits())
+			return sb
+		}
+
+		atp.Priorities = make([]byte, prioritiesSize)
+		for i := range atp.Priorities {
+			atp.Priorities[i] = sb.ReadUint8()
+		}
+	}
+
+	// resume data saved before paused flag was introduced ends here
+	if sb.Error() != nil || sb.Offset() == len(sb.Data) {
+		return sb
+	}
+
+	atp.Paused = sb.ReadUint8() != 0
+
+	// resume data saved before storage mode was introduced ends here
+	if sb.Error() != nil || sb.Offset() == len(sb.Data) {
+		return sb
+	}
+
+	atp.Storage = sb.ReadUint8()
+	return sb
+}
+
 func (atp AddTransferParameters) Put(sb *StateBuffer) *StateBuffer {
 	sb.Write(atp.Hashes).Write(atp.Filename).Write(atp.Filesize).Write(atp.Pieces)
 	sb.Write(uint16(len(atp.DownloadedBlocks)))
@@ -71,6 +119,15 @@ func (atp AddTransferParameters) Put(sb *StateBuffer) *StateBuffer {
 		sb.Write(uint32(i))
 		sb.Write(x)
 	}
+	sb.Write(uint32(len(atp.Priorities)))
+	for _, x := range atp.Priorities {
+		sb.Write(x)
+	}
+	paused := uint8(0)
+	if atp.Paused {
+		paused = 1
+	}
+	sb.Write(paused).Write(atp.Storage)
 	return sb
 }
 
@@ -86,13 +143,36 @@ func (atp AddTransferParameters) Size() int {
 		sz += DataSize(x)
 	}
 
-	return sz
+	return sz + DataSize(uint32(0)) + len(atp.Priorities) + DataSize(uint8(0)) + DataSize(atp.Storage)
 }
 
 func (atp AddTransferParameters) WantMoreData() bool {
 	return atp.Pieces.Bits() != atp.Pieces.Count() || len(atp.DownloadedBlocks) > 0
 }
 
+func (atp AddTransferParameters) PiecePriority(pieceIndex int) byte {
+	if pieceIndex < len(atp.Priorities) {
+		return atp.Priorities[pieceIndex]
+	}
+
+	return PIECE_PRIORITY_NORMAL
+}
+
+// WantedDataFinished returns true when all not skipped pieces are downloaded
+func (atp AddTransferParameters) WantedDataFinished() bool {
+	for i := 0; i < atp.Pieces.Bits(); i++ {
+		if atp.PiecePriority(i) == PIECE_PRIORITY_SKIP {
+			continue
+		}
+
+		if _, ok := atp.DownloadedBlocks[i]; !atp.Pieces.GetBit(i) || ok {
+			return false
+		}
+	}
+
+	return true
+}
+
 func CreateAddTransferParameters(hash ED2KHash, size uint64, filename string) AddTransferParameters {
 	piecesCount, _ := NumPiecesAndBlocks(size)
 	return AddTransferParameters{Hashes: HashSet{Hash: hash, PieceHashes: make([]ED2KHash, 0)},
@@ -145,3 +145,63 @@ func Test_InBlockOffset(t *testing.T) {
 		t.Errorf("In block offset incorrect: %v", o3)
 	}
 }
+
+func Test_AddTransferParametersPriorities(t *testing.T) {
+	atp := CreateAddTransferParameters(EMULE, PIECE_SIZE_UINT64*3, "file.iso")
+	atp.Priorities = []byte{PIECE_PRIORITY_SKIP, PIECE_PRIORITY_HIGH, PIECE_PRIORITY_NORMAL}
+	atp.Paused = true
+	atp.Storage = 1
+	data := make([]byte, DataSize(atp))
+	sb := StateBuffer{Data: data}
+	sb.Write(atp)
+	if sb.Error() != nil || sb.Offset() != len(data) {
+		t.Fatalf("Can not write parameters %v", sb.Error())
+	}
+
+	atp2 := AddTransferParameters{}
+	sb2 := StateBuffer{Data: data}
+	sb2.Read(&atp2)
+	if sb2.Error() != nil || len(atp2.Priorities) != 3 || atp2.PiecePriority(0) != PIECE_PRIORITY_SKIP || atp2.PiecePriority(1) != PIECE_PRIORITY_HIGH || !atp2.Paused || atp2.Storage != 1 {
+		t.Errorf("Priorities were not restored %v %v", atp2.Priorities, sb2.Error())
+	}
+
+	// resume data without storage mode
+	atp5 := AddTransferParameters{}
+	sb5 := StateBuffer{Data: data[:len(data)-DataSize(uint8(0))]}
+	sb5.Read(&atp5)
+	if sb5.Error() != nil || !atp5.Paused || atp5.Storage != 0 {
+		t.Errorf("Resume data without storage mode was not read %v", sb5.Error())
+	}
+
+	// resume data without paused flag
+	atp4 := AddTransferParameters{}
+	sb4 := StateBuffer{Data: data[:len(data)-2*DataSize(uint8(0))]}
+	sb4.Read(&atp4)
+	if sb4.Error() != nil || len(atp4.Priorities) != 3 || atp4.Paused {
+		t.Errorf("Resume data without paused flag was not read %v", sb4.Error())
+	}
+
+	// resume data without priorities
+	legacy := data[:len(data)-2*DataSize(uint8(0))-DataSize(uint32(0))-len(atp.Priorities)]
+	atp3 := AddTransferParameters{}
+	sb3 := StateBuffer{Data: legacy}
+	sb3.Read(&atp3)
+	if sb3.Error() != nil || len(atp3.Priorities) != 0 || atp3.PiecePriority(0) != PIECE_PRIORITY_NORMAL {
+		t.Errorf("Legacy resume data was not read %v", sb3.Error())
+	}
+
+	if atp.WantedDataFinished() {
+		t.Error("Wanted data finished without pieces")
+	}
+
+	atp.Pieces.SetBit(1)
+	atp.Pieces.SetBit(2)
+	if !atp.WantedDataFinished() || !atp.WantMoreData() {
+		t.Error("Skipped piece must not be wanted")
+	}
+
+	atp.DownloadedBlocks[2] = CreateBitField(BLOCKS_PER_PIECE)
+	if atp.WantedDataFinished() {
+		t.Error("Downloading piece is not finished")
+	}
+}
@@ -0,0 +1,92 @@
+package ged2k
+
+import (
+	"math"
+	"path/filepath"
+	"sort"
+
+	"github.com/a-pavlov/ged2k/proto"
+)
+
+const OFFER_FILES_PER_PACKET int = 200
+
+// OFFER_FILES_LIMIT is used when server did not announce its soft or hard files limit
+const OFFER_FILES_LIMIT int = 1000
+
+func (sf *SharedFile) Complete() bool {
+	return sf.Pieces.Bits() != 0 && sf.Pieces.Count() == sf.Pieces.Bits()
+}
+
+// Offer returns OP_OFFERFILES entry for the file. Servers supporting compression receive completeness
+// in the special client id and port, other servers receive our id and port for HighID only
+func (sf *SharedFile) Offer(idc proto.IdChange, port uint16) proto.UsualPacket {
+	res := proto.UsualPacket{Hash: sf.Hash}
+	switch {
+	case idc.SupportsCompression() && sf.Complete():
+		res.Point = proto.Endpoint{Ip: proto.OFFER_COMPLETE_ID, Port: proto.OFFER_COMPLETE_PORT}
+	case idc.SupportsCompression():
+		res.Point = proto.Endpoint{Ip: proto.OFFER_INCOMPLETE_ID, Port: proto.OFFER_INCOMPLETE_PORT}
+	case !idc.IsLowId():
+		res.Point = proto.Endpoint{Ip: idc.ClientId, Port: port}
+	}
+
+	res.Properties = append(res.Properties, proto.CreateTag(filepath.Base(sf.Filename), proto.FT_FILENAME, ""))
+	res.Properties = append(res.Properties, proto.CreateTag(uint32(sf.Size), proto.FT_FILESIZE, ""))
+	if sf.Size > math.MaxUint32 {
+		res.Properties = append(res.Properties, proto.CreateTag(uint32(sf.Size>>32), proto.FT_FILESIZE_HI, ""))
+	}
+
+	if fileType := proto.GetED2KFileType(sf.Filename); fileType != "" {
+		if fileType == proto.ED2KFTSTR_ARCHIVE || fileType == proto.ED2KFTSTR_CDIMAGE {
+			fileType = proto.ED2KFTSTR_PROGRAM
+		}
+		res.Properties = append(res.Properties, proto.CreateTag(fileType, proto.FT_FILETYPE, ""))
+	}
+
+	return res
+}
+
+// OfferLimit returns maximum count of files to offer to the server, soft limit has precedence over hard one
+func OfferLimit(info proto.ServerInfo) int {
+	res := OFFER_FILES_LIMIT
+	if info.HardFiles != 0 && int(info.HardFiles) < res {
+		res = int(info.HardFiles)
+	}
+
+	if info.SoftFiles != 0 && int(info.SoftFiles) < res {
+		res = int(info.SoftFiles)
+	}
+
+	return res
+}
+
+// CreateOffer collects next portion of not offered files respecting server limits and large files support
+func CreateOffer(files map[proto.ED2KHash]*SharedFile, offered map[proto.ED2KHash]bool, info proto.ServerInfo, idc proto.IdChange, port uint16) proto.OfferFiles {
+	res := proto.OfferFiles{Files: make([]proto.UsualPacket, 0)}
+	limit := OfferLimit(info) - len(offered)
+
+	candidates := make([]*SharedFile, 0)
+	for _, x := range files {
+		if !offered[x.Hash] && (x.Size <= math.MaxUint32 || idc.SupportsLargeFiles()) {
+			candidates = append(candidates, x)
+		}
+	}
+
+	// complete files first, then by name to make offers stable
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Complete() != candidates[j].Complete() {
+			return candidates[i].Complete()
+		}
+		return candidates[i].Filename < candidates[j].Filename
+	})
+
+	for _, x := range candidates {
+		if len(res.Files) >= limit || len(res.Files) >= OFFER_FILES_PER_PACKET {
+			break
+		}
+
+		res.Files = append(res.Files, x.Offer(idc, port))
+	}
+
+	return res
+}
@@ -0,0 +1,90 @@
+package ged2k
+
+import (
+	"math"
+	"testing"
+
+	"github.com/a-pavlov/ged2k/proto"
+)
+
+func Test_OfferEntry(t *testing.T) {
+	sf := NewSharedFile("/tmp/movie.avi", 100, proto.HashSet{Hash: proto.EMULE, PieceHashes: []proto.ED2KHash{proto.EMULE}})
+	entry := sf.Offer(proto.IdChange{ClientId: 0x10000000, TcpFlags: proto.SRV_TCPFLG_COMPRESSION}, 4662)
+	if entry.Hash != proto.EMULE || entry.Point.Ip != proto.OFFER_COMPLETE_ID || entry.Point.Port != proto.OFFER_COMPLETE_PORT {
+		t.Errorf("Complete file offer incorrect %v", entry)
+	}
+
+	if len(entry.Properties) != 3 || entry.Properties[0].AsString() != "movie.avi" || entry.Properties[1].AsUint32() != 100 || entry.Properties[2].AsString() != proto.ED2KFTSTR_VIDEO {
+		t.Errorf("Offer tags incorrect %v", entry.Properties)
+	}
+
+	sf.Pieces = proto.CreateBitField(1)
+	entry = sf.Offer(proto.IdChange{ClientId: 0x10000000, TcpFlags: proto.SRV_TCPFLG_COMPRESSION}, 4662)
+	if entry.Point.Ip != proto.OFFER_INCOMPLETE_ID || entry.Point.Port != proto.OFFER_INCOMPLETE_PORT {
+		t.Errorf("Incomplete file offer incorrect %v", entry.Point)
+	}
+
+	entry = sf.Offer(proto.IdChange{ClientId: 0x10000000}, 4662)
+	if entry.Point.Ip != 0x10000000 || entry.Point.Port != 4662 {
+		t.Errorf("High id offer incorrect %v", entry.Point)
+	}
+
+	entry = sf.Offer(proto.IdChange{ClientId: 100}, 4662)
+	if !entry.Point.IsEmpty() {
+		t.Errorf("Low id offer incorrect %v", entry.Point)
+	}
+
+	large := NewSharedFile("/tmp/large.iso", math.MaxUint32+10, proto.HashSet{Hash: proto.LIBED2K})
+	entry = large.Offer(proto.IdChange{}, 0)
+	if len(entry.Properties) != 4 || entry.Properties[1].AsUint32() != 9 || entry.Properties[2].AsUint32() != 1 || entry.Properties[3].AsString() != proto.ED2KFTSTR_PROGRAM {
+		t.Errorf("Large file offer tags incorrect %v", entry.Properties)
+	}
+}
+
+func Test_OfferLimits(t *testing.T) {
+	if OfferLimit(proto.ServerInfo{}) != OFFER_FILES_LIMIT || OfferLimit(proto.ServerInfo{SoftFiles: 10, HardFiles: 20}) != 10 || OfferLimit(proto.ServerInfo{HardFiles: 20}) != 20 {
+		t.Error("Offer limit incorrect")
+	}
+
+	files := make(map[proto.ED2KHash]*SharedFile)
+	for i := 0; i < 5; i++ {
+		h := proto.ED2KHash{byte(i)}
+		files[h] = NewSharedFile("/tmp/file"+string(rune('a'+i)), 100, proto.HashSet{Hash: h})
+	}
+
+	files[proto.EMULE] = NewSharedFile("/tmp/large.bin", math.MaxUint32+1, proto.HashSet{Hash: proto.EMULE})
+
+	offered := make(map[proto.ED2KHash]bool)
+	offer := CreateOffer(files, offered, proto.ServerInfo{SoftFiles: 3}, proto.IdChange{ClientId: 100}, 4662)
+	if len(offer.Files) != 3 {
+		t.Errorf("Offer must respect soft limit, offered %d", len(offer.Files))
+	}
+
+	offered[offer.Files[0].Hash] = true
+	offer = CreateOffer(files, offered, proto.ServerInfo{}, proto.IdChange{ClientId: 100}, 4662)
+	if len(offer.Files) != 4 {
+		t.Errorf("Offer must skip offered and large files, offered %d", len(offer.Files))
+	}
+
+	offer = CreateOffer(files, offered, proto.ServerInfo{}, proto.IdChange{ClientId: 100, TcpFlags: proto.SRV_TCPFLG_LARGEFILES}, 4662)
+	if len(offer.Files) != 5 {
+		t.Errorf("Offer must include large files, offered %d", len(offer.Files))
+	}
+}
+
+func Test_OfferLibraryChanges(t *testing.T) {
+	s := &Session{sharedFiles: make(map[proto.ED2KHash]*SharedFile), offeredFiles: make(map[proto.ED2KHash]bool), libraryFiles: make(map[proto.ED2KHash]bool)}
+	s.updateLibrary([]*SharedFile{NewSharedFile("/tmp/a.bin", 100, proto.HashSet{Hash: proto.EMULE})})
+	s.offeredFiles[proto.EMULE] = true
+
+	// file is removed and another file is added, so count of shared files matches count of offered files
+	s.updateLibrary([]*SharedFile{NewSharedFile("/tmp/b.bin", 100, proto.HashSet{Hash: proto.LIBED2K})})
+	if len(s.sharedFiles) != 1 || len(s.offeredFiles) != 0 {
+		t.Errorf("Removed file is still offered %v", s.offeredFiles)
+	}
+
+	offer := CreateOffer(s.sharedFiles, s.offeredFiles, proto.ServerInfo{}, proto.IdChange{ClientId: 100}, 4662)
+	if len(offer.Files) != 1 || offer.Files[0].Hash != proto.LIBED2K {
+		t.Errorf("Added file was not offered %v", offer.Files)
+	}
+}
@@ -0,0 +1,81 @@
+package ged2k
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/a-pavlov/ged2k/proto"
+	"golang.org/x/crypto/md4"
+)
+
+type recheckResult struct {
+	pieces proto.BitField
+	// hashes of data, used for file hash when all pieces match the hash set
+	hashes []proto.ED2KHash
+	err    error
+}
+
+// recheckData hashes data of the storage piece by piece and marks pieces matching the hash set,
+// data is read by blocks, so memory usage does not depend on piece size, closed stop cancels recheck
+func recheckData(storage Storage, hashSet proto.HashSet, size uint64, stop <-chan struct{}) recheckResult {
+	pieces, _ := proto.NumPiecesAndBlocks(size)
+	res := recheckResult{pieces: proto.CreateBitField(pieces)}
+	if len(hashSet.PieceHashes) != proto.HashSetSize(size) {
+		res.err = fmt.Errorf("hash set has %d hashes, expected %d", len(hashSet.PieceHashes), proto.HashSetSize(size))
+		return res
+	}
+
+	buffer := make([]byte, proto.BLOCK_SIZE)
+	for i := 0; i < pieces; i++ {
+		select {
+		case <-stop:
+			res.err = fmt.Errorf("recheck was cancelled")
+			return res
+		default:
+		}
+
+		hash := md4.New()
+		begin := uint64(i) * proto.PIECE_SIZE_UINT64
+		end := Min(begin+proto.PIECE_SIZE_UINT64, size)
+		complete := true
+		for offset := begin; offset < end && complete; offset += proto.BLOCK_SIZE_UINT64 {
+			data := buffer[:Min(end-offset, proto.BLOCK_SIZE_UINT64)]
+			if n, err := storage.ReadAt(data, int64(offset)); n != len(data) {
+				if err != io.EOF {
+					res.err = fmt.Errorf("can not read data at %d: %v", offset, err)
+					return res
+				}
+
+				// short data file has no data for the rest of pieces
+				complete = false
+			}
+
+			hash.Write(data)
+		}
+
+		h := proto.ED2KHash{}
+		hash.Sum(h[:0])
+		res.hashes = append(res.hashes, h)
+		if complete && h.Equals(hashSet.PieceHashes[i]) {
+			res.pieces.SetBit(i)
+		}
+	}
+
+	if len(res.hashes) < len(hashSet.PieceHashes) {
+		// size is multiple of piece size and hash set ends with hash of empty data
+		h := proto.ED2KHash{}
+		md4.New().Sum(h[:0])
+		res.hashes = append(res.hashes, h)
+	}
+
+	return res
+}
+
+// Recheck asks transfer to verify its data against the hash set and download again pieces which failed,
+// ignored when goroutine has exited
+func (transfer *Transfer) Recheck() {
+	select {
+	case transfer.recheckChan <- struct{}{}:
+	case <-transfer.done:
+	}
+}
@@ -0,0 +1,186 @@
+package ged2k
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/a-pavlov/ged2k/proto"
+)
+
+func Test_RecheckData(t *testing.T) {
+	dir := t.TempDir()
+	for _, size := range []uint64{proto.PIECE_SIZE_UINT64, proto.PIECE_SIZE_UINT64 + 100} {
+		filename := filepath.Join(dir, "a.bin")
+		content := make([]byte, size)
+		for i := range content {
+			content[i] = byte(i)
+		}
+
+		if err := os.WriteFile(filename, content, 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		hs, _, err := HashFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		storage := makeMemoryStorage(t, size)
+		storage.WriteAt(content, 0)
+		res := recheckData(storage, hs, size, nil)
+		if res.err != nil || res.pieces.Count() != res.pieces.Bits() || proto.ResultHash(res.hashes) != hs.Hash {
+			t.Errorf("Correct data of size %d was not verified %v", size, res.err)
+		}
+
+		// the last piece is missing
+		storage.Truncate(int64(proto.PIECE_SIZE_UINT64 - 1))
+		if res = recheckData(storage, hs, size, nil); res.err != nil || res.pieces.Count() != 0 {
+			t.Errorf("Missing data of size %d was verified %v", size, res.err)
+		}
+	}
+
+	stop := make(chan struct{})
+	close(stop)
+	hs := proto.HashSet{Hash: proto.EMULE, PieceHashes: []proto.ED2KHash{proto.EMULE}}
+	if res := recheckData(makeMemoryStorage(t, 10), hs, 10, stop); res.err == nil {
+		t.Error("Stopped recheck was not cancelled")
+	}
+}
+
+func Test_SessionRecheck(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "a.bin")
+	if err := os.WriteFile(filename, []byte("existing data"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	hs, size, err := HashFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSession(Config{IncomingDir: dir, UserAgent: proto.EMULE})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub := s.Subscribe(EVENT_CATEGORY_TRANSFER, 0)
+	defer s.Unsubscribe(sub)
+	s.Start()
+	defer s.Stop()
+	th, err := s.AddTransfer(TransferParams{Hash: hs.Hash, Size: size, Filename: filename})
+	if err != nil || th.Recheck() != nil {
+		t.Fatalf("Can not recheck transfer %v", err)
+	}
+
+	rechecked, finished := false, false
+	for !rechecked || !finished {
+		select {
+		case e := <-sub.Events():
+			switch x := e.(type) {
+			case TransferRecheckedEvent:
+				rechecked = true
+				if x.Err != nil || x.Pieces != 1 || x.VerifiedPieces != 1 {
+					t.Errorf("Existing data was not verified %v", x)
+				}
+			case TransferFinishedEvent:
+				finished = true
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Transfer was not rechecked %v finished %v", rechecked, finished)
+		}
+	}
+
+	if ts, err := th.Status(); err != nil || !ts.Finished || ts.VerifiedBytes != size {
+		t.Errorf("Transfer status was not rebuilt %v %v", ts.TransferSummary, err)
+	}
+}
+
+func Test_SessionRecheckPieces(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "b.bin")
+	content := make([]byte, proto.PIECE_SIZE_UINT64+100)
+	for i := range content {
+		content[i] = byte(i)
+	}
+
+	if err := os.WriteFile(filename, content, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	hs, size, err := HashFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the second piece is corrupted
+	content[proto.PIECE_SIZE_UINT64+5]++
+	if err = os.WriteFile(filename, content, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSession(Config{IncomingDir: dir, UserAgent: proto.EMULE})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub := s.Subscribe(EVENT_CATEGORY_TRANSFER, 0)
+	defer s.Unsubscribe(sub)
+	s.Start()
+	defer s.Stop()
+
+	waitRechecked := func(timeout time.Duration) *TransferRecheckedEvent {
+		for {
+			select {
+			case e := <-sub.Events():
+				if x, ok := e.(TransferRecheckedEvent); ok {
+					return &x
+				}
+			case <-time.After(timeout):
+				return nil
+			}
+		}
+	}
+
+	// transfer without hash set waits for it
+	th, err := s.AddTransfer(TransferParams{Hash: hs.Hash, Size: size, Filename: filename})
+	if err != nil || th.Recheck() != nil {
+		t.Fatalf("Can not recheck transfer %v", err)
+	}
+
+	if x := waitRechecked(time.Second); x != nil {
+		t.Fatalf("Transfer was rechecked without hash set %v", x)
+	}
+
+	// hash set is received from peer
+	s.transfers[hs.Hash].hashSetChan <- &hs
+	if x := waitRechecked(5 * time.Second); x == nil || x.Err != nil || x.Pieces != 2 || x.VerifiedPieces != 1 {
+		t.Errorf("Transfer was not rechecked with received hash set %v", x)
+	}
+
+	if th.Remove(false) != nil {
+		t.Fatal("Can not remove transfer")
+	}
+
+	// transfer with piece hashes from parameters is rechecked immediately
+	for i := 0; i < 50; i++ {
+		if th, err = s.AddTransfer(TransferParams{Hash: hs.Hash, Size: size, Filename: filename, PieceHashes: hs.PieceHashes}); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if err != nil || th.Recheck() != nil {
+		t.Fatalf("Can not recheck transfer %v", err)
+	}
+
+	if x := waitRechecked(5 * time.Second); x == nil || x.Err != nil || x.Pieces != 2 || x.VerifiedPieces != 1 {
+		t.Errorf("Transfer with piece hashes was not rechecked %v", x)
+	}
+
+	if ts, err := th.Status(); err != nil || ts.Finished || ts.VerifiedBytes != proto.PIECE_SIZE_UINT64 {
+		t.Errorf("Transfer status was not rebuilt %v %v", ts.TransferSummary, err)
+	}
+}
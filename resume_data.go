@@ -0,0 +1,309 @@
+package ged2k
+
+import (
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/a-pavlov/ged2k/proto"
+)
+
+const RESUME_DATA_EXT = ".rd"
+
+// resume data file starts with header: magic, format version, payload length and CRC32 of payload
+const RESUME_DATA_MAGIC uint32 = 0x44524b47 // "GKRD"
+const RESUME_DATA_HEADER_SIZE = 14
+
+const (
+	// RESUME_DATA_VERSION_LEGACY is add transfer parameters written without header
+	RESUME_DATA_VERSION_LEGACY uint16 = iota + 1
+	// RESUME_DATA_VERSION_HEADER is the first version with header, storage mode is not saved
+	RESUME_DATA_VERSION_HEADER
+	RESUME_DATA_VERSION
+)
+
+// RESUME_DATA_FLUSH_INTERVAL limits how often changed resume data is written to disk
+const RESUME_DATA_FLUSH_INTERVAL = 10 * time.Second
+
+func encodeResumeData(atp *proto.AddTransferParameters) ([]byte, error) {
+	data := make([]byte, RESUME_DATA_HEADER_SIZE+atp.Size())
+	payload := data[RESUME_DATA_HEADER_SIZE:]
+	sb := proto.StateBuffer{Data: payload}
+	sb.Write(atp)
+	if sb.Error() != nil {
+		return nil, sb.Error()
+	}
+
+	hb := proto.StateBuffer{Data: data[:RESUME_DATA_HEADER_SIZE]}
+	hb.Write(RESUME_DATA_MAGIC).Write(RESUME_DATA_VERSION).Write(uint32(len(payload))).Write(crc32.ChecksumIEEE(payload))
+	return data, hb.Error()
+}
+
+// decodeResumeData reads resume data of any known version, older versions are migrated to the current one
+func decodeResumeData(data []byte) (atp proto.AddTransferParameters, version uint16, err error) {
+	version = RESUME_DATA_VERSION_LEGACY
+	payload := data
+	hb := proto.StateBuffer{Data: data}
+	if len(data) >= RESUME_DATA_HEADER_SIZE && hb.ReadUint32() == RESUME_DATA_MAGIC {
+		version = hb.ReadUint16()
+		length := hb.ReadUint32()
+		checksum := hb.ReadUint32()
+		if version < RESUME_DATA_VERSION_HEADER || version > RESUME_DATA_VERSION {
+			return atp, version, fmt.Errorf("resume data version %d is not supported", version)
+		}
+
+		payload = data[RESUME_DATA_HEADER_SIZE:]
+		if uint32(len(payload)) != length {
+			return atp, version, fmt.Errorf("resume data length %d does not match header %d", len(payload), length)
+		}
+
+		if crc32.ChecksumIEEE(payload) != checksum {
+			return atp, version, fmt.Errorf("resume data checksum mismatch")
+		}
+	}
+
+	// legacy file has base fields only and could have garbage in the end since it was rewritten without truncation,
+	// so its tail is ignored and fields added later get default values
+	sb := proto.StateBuffer{Data: payload}
+	if version == RESUME_DATA_VERSION_LEGACY {
+		atp.GetBase(&sb)
+		return atp, version, sb.Error()
+	}
+
+	sb.Read(&atp)
+	if sb.Error() == nil && sb.Offset() != len(payload) {
+		return atp, version, fmt.Errorf("resume data has %d trailing bytes", len(payload)-sb.Offset())
+	}
+
+	return atp, version, sb.Error()
+}
+
+func readResumeData(file string) (proto.AddTransferParameters, uint16, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return proto.AddTransferParameters{}, 0, err
+	}
+
+	atp, version, err := decodeResumeData(data)
+	if err != nil {
+		return atp, version, fmt.Errorf("can not read resume data file %s: %v", file, err)
+	}
+
+	return atp, version, nil
+}
+
+// writeFileAtomic writes data to temporary file and renames it, so file has old or new content after crash
+func writeFileAtomic(filename string, data []byte) error {
+	tmp := filename + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp, filename)
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return syncDir(filepath.Dir(filename))
+}
+
+// syncDir writes directory entries to disk to keep rename after crash, directories can not be synced on windows
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// ResumeDataStore keeps changed resume data of transfers in memory and writes it with interval,
+// it is owned by the session goroutine
+type ResumeDataStore struct {
+	dir       string
+	dirty     map[proto.ED2KHash]proto.AddTransferParameters
+	lastFlush time.Time
+}
+
+func MakeResumeDataStore(dir string) ResumeDataStore {
+	return ResumeDataStore{dir: dir, dirty: make(map[proto.ED2KHash]proto.AddTransferParameters)}
+}
+
+func (rs *ResumeDataStore) Filename(hash proto.ED2KHash) string {
+	return filepath.Join(rs.dir, hash.ToString()+RESUME_DATA_EXT)
+}
+
+// Update replaces not yet written resume data of the transfer
+func (rs *ResumeDataStore) Update(atp proto.AddTransferParameters) {
+	rs.dirty[atp.Hashes.Hash] = atp
+}
+
+// Discard drops not yet written resume data, used before resume data file is deleted
+func (rs *ResumeDataStore) Discard(hash proto.ED2KHash) {
+	delete(rs.dirty, hash)
+}
+
+// Flush writes resume data of the transfer when it was changed, resume data which was not written is kept to retry
+func (rs *ResumeDataStore) Flush(hash proto.ED2KHash) error {
+	atp, ok := rs.dirty[hash]
+	if !ok {
+		return nil
+	}
+
+	data, err := encodeResumeData(&atp)
+	if err != nil {
+		// encoding fails the same way on retry
+		delete(rs.dirty, hash)
+		return err
+	}
+
+	if err = writeFileAtomic(rs.Filename(hash), data); err != nil {
+		return err
+	}
+
+	delete(rs.dirty, hash)
+	return nil
+}
+
+// FlushAll writes all changed resume data, returns the last error
+func (rs *ResumeDataStore) FlushAll(currentTime time.Time) error {
+	var res error
+	for hash := range rs.dirty {
+		if err := rs.Flush(hash); err != nil {
+			log.Printf("can not save resume data of %s: %v\n", hash.ToString(), err)
+			res = err
+		}
+	}
+
+	rs.lastFlush = currentTime
+	return res
+}
+
+// Tick writes changed resume data when flush interval has passed since the last flush
+func (rs *ResumeDataStore) Tick(currentTime time.Time) {
+	if len(rs.dirty) > 0 && currentTime.Sub(rs.lastFlush) >= RESUME_DATA_FLUSH_INTERVAL {
+		rs.FlushAll(currentTime)
+	}
+}
+
+// validateResumeData checks resume data is consistent with the transfer size and its data file,
+// orphaned is true when data file does not exist
+func validateResumeData(atp *proto.AddTransferParameters) (orphaned bool, err error) {
+	if atp.Hashes.Hash == proto.ZERO || atp.Filesize == 0 || atp.Filename.ToString() == "" {
+		return false, fmt.Errorf("resume data is incomplete: hash %s size %d filename \"%s\"", atp.Hashes.Hash.ToString(), atp.Filesize, atp.Filename.ToString())
+	}
+
+	pieces, _ := proto.NumPiecesAndBlocks(atp.Filesize)
+	if atp.Pieces.Bits() != pieces {
+		return false, fmt.Errorf("resume data pieces count %d does not match size %d", atp.Pieces.Bits(), atp.Filesize)
+	}
+
+	for i := range atp.DownloadedBlocks {
+		if i < 0 || i >= pieces {
+			return false, fmt.Errorf("resume data downloading piece %d is out of range", i)
+		}
+	}
+
+	if mode := StorageMode(atp.Storage); mode != STORAGE_SPARSE && mode != STORAGE_PREALLOCATED {
+		return false, fmt.Errorf("resume data storage mode %s can not be restored", mode)
+	}
+
+	if len(atp.Hashes.PieceHashes) > 0 && !atp.Hashes.IsValid(atp.Filesize) {
+		return false, fmt.Errorf("resume data has incorrect hash set")
+	}
+
+	fi, err := os.Stat(atp.Filename.ToString())
+	if os.IsNotExist(err) {
+		return true, fmt.Errorf("data file %s does not exist", atp.Filename.ToString())
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	if fi.IsDir() || uint64(fi.Size()) > atp.Filesize {
+		return false, fmt.Errorf("data file %s does not match transfer size %d", atp.Filename.ToString(), atp.Filesize)
+	}
+
+	return false, nil
+}
+
+// restoreTransfers adds transfers from all resume data files of the incoming directory,
+// files which can not be restored are reported by events and left untouched
+func (s *Session) restoreTransfers() {
+	entries, err := os.ReadDir(s.configuration.IncomingDir)
+	if err != nil {
+		log.Printf("can not read incoming directory %s: %v\n", s.configuration.IncomingDir, err)
+		return
+	}
+
+	for _, x := range entries {
+		if x.IsDir() || !strings.HasSuffix(x.Name(), RESUME_DATA_EXT) {
+			continue
+		}
+
+		file := filepath.Join(s.configuration.IncomingDir, x.Name())
+		orphaned, err := s.restoreTransfer(file)
+		if err != nil {
+			log.Printf("can not restore transfer from %s: %v\n", file, err)
+			s.events.publish(ResumeDataErrorEvent{File: file, Orphaned: orphaned, Err: err})
+		}
+	}
+}
+
+func (s *Session) restoreTransfer(file string) (bool, error) {
+	atp, version, err := readResumeData(file)
+	if err != nil {
+		return false, err
+	}
+
+	name := strings.TrimSuffix(filepath.Base(file), RESUME_DATA_EXT)
+	if len(name) != 2*proto.HASH_LEN || proto.String2Hash(name) != atp.Hashes.Hash {
+		return false, fmt.Errorf("resume data hash %s does not match file name", atp.Hashes.Hash.ToString())
+	}
+
+	orphaned, err := validateResumeData(&atp)
+	if err != nil {
+		return orphaned, err
+	}
+
+	log.Printf("restore transfer %s paused %v\n", atp.Hashes.Hash.ToString(), atp.Paused)
+	if err = s.addTransfer(&atp, nil, PEER_SRC_RESUME_DATA, StorageMode(atp.Storage)); err != nil {
+		return false, err
+	}
+
+	if version != RESUME_DATA_VERSION {
+		log.Printf("resume data %s is migrated from version %d\n", file, version)
+		s.resumeData.Update(atp)
+	}
+
+	return false, nil
+}
@@ -0,0 +1,241 @@
+package ged2k
+
+import (
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/a-pavlov/ged2k/proto"
+)
+
+func Test_ValidateResumeData(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "a.bin")
+	atp := proto.CreateAddTransferParameters(proto.EMULE, 100, filename)
+	if orphaned, err := validateResumeData(&atp); err == nil || !orphaned {
+		t.Errorf("Resume data without data file is not orphaned %v", err)
+	}
+
+	if err := os.WriteFile(filename, make([]byte, 100), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := validateResumeData(&atp); err != nil {
+		t.Errorf("Correct resume data was not accepted %v", err)
+	}
+
+	atp.Filesize = proto.PIECE_SIZE_UINT64 * 2
+	if _, err := validateResumeData(&atp); err == nil {
+		t.Error("Resume data with incorrect pieces count was accepted")
+	}
+
+	atp = proto.CreateAddTransferParameters(proto.EMULE, 10, filename)
+	if orphaned, err := validateResumeData(&atp); err == nil || orphaned {
+		t.Error("Data file larger than transfer was accepted")
+	}
+}
+
+func Test_SessionRestoreTransfers(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewSession(Config{IncomingDir: dir, UserAgent: proto.EMULE})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub := s.Subscribe(EVENT_CATEGORY_TRANSFER, 0)
+	s.Start()
+	th, err := s.AddTransfer(TransferParams{Hash: proto.EMULE, Size: 100, Filename: "a.bin", Storage: STORAGE_PREALLOCATED})
+	if err != nil || th.Pause() != nil {
+		t.Fatalf("Can not add paused transfer %v", err)
+	}
+
+	for paused := false; !paused; {
+		select {
+		case e := <-sub.Events():
+			_, paused = e.(TransferPausedEvent)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Transfer was not paused")
+		}
+	}
+
+	s.Unsubscribe(sub)
+	s.Stop()
+
+	// corrupt and orphaned resume data
+	corrupt := filepath.Join(dir, "DB48A1C00CC972488C29D3FEC9F16A79"+RESUME_DATA_EXT)
+	if err := os.WriteFile(corrupt, []byte{1, 2, 3}, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	hash := proto.String2Hash("31D6CFE0D16AE931B73C59D7E0C089C0")
+	atp := proto.CreateAddTransferParameters(hash, 100, filepath.Join(dir, "missing.bin"))
+	data := make([]byte, atp.Size())
+	sb := proto.StateBuffer{Data: data}
+	sb.Write(&atp)
+	orphaned := filepath.Join(dir, hash.ToString()+RESUME_DATA_EXT)
+	if err := os.WriteFile(orphaned, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = NewSession(Config{IncomingDir: dir, UserAgent: proto.EMULE})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub = s.Subscribe(EVENT_CATEGORY_ERROR, 0)
+	defer s.Unsubscribe(sub)
+	s.Start()
+	defer s.Stop()
+
+	reported := make(map[string]bool)
+	for len(reported) < 2 {
+		select {
+		case e := <-sub.Events():
+			if x, ok := e.(ResumeDataErrorEvent); ok {
+				reported[x.File] = x.Orphaned
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Resume data errors were not reported %v", reported)
+		}
+	}
+
+	if o, ok := reported[corrupt]; !ok || o {
+		t.Errorf("Corrupt resume data was not reported %v", reported)
+	}
+
+	if o, ok := reported[orphaned]; !ok || !o {
+		t.Errorf("Orphaned resume data was not reported %v", reported)
+	}
+
+	th = s.Transfer(proto.EMULE)
+	if th == nil {
+		t.Fatal("Transfer was not restored")
+	}
+
+	if ts, err := th.Status(); err != nil || !ts.Paused || ts.Size != 100 {
+		t.Errorf("Restored transfer status incorrect %v %v", ts.TransferSummary, err)
+	}
+
+	if mode := s.transfers[proto.EMULE].StorageMode; mode != STORAGE_PREALLOCATED {
+		t.Errorf("Restored transfer storage mode %s incorrect", mode)
+	}
+
+	if s.Transfer(hash) != nil {
+		t.Error("Orphaned transfer was restored")
+	}
+}
+
+func Test_ResumeDataEncoding(t *testing.T) {
+	atp := proto.CreateAddTransferParameters(proto.EMULE, proto.PIECE_SIZE_UINT64*2, "a.bin")
+	atp.Pieces.SetBit(1)
+	atp.Paused = true
+	atp.Storage = byte(STORAGE_PREALLOCATED)
+	data, err := encodeResumeData(&atp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	atp2, version, err := decodeResumeData(data)
+	if err != nil || version != RESUME_DATA_VERSION || atp2.Hashes.Hash != proto.EMULE || !atp2.Pieces.GetBit(1) || !atp2.Paused || StorageMode(atp2.Storage) != STORAGE_PREALLOCATED {
+		t.Errorf("Resume data was not decoded %v %v", version, err)
+	}
+
+	// resume data saved before storage mode was introduced is restored as sparse
+	header := proto.StateBuffer{Data: make([]byte, RESUME_DATA_HEADER_SIZE)}
+	payload := data[RESUME_DATA_HEADER_SIZE : len(data)-proto.DataSize(uint8(0))]
+	header.Write(RESUME_DATA_MAGIC).Write(RESUME_DATA_VERSION_HEADER).Write(uint32(len(payload))).Write(crc32.ChecksumIEEE(payload))
+	atp5, version, err := decodeResumeData(append(header.Data, payload...))
+	if err != nil || version != RESUME_DATA_VERSION_HEADER || !atp5.Paused || StorageMode(atp5.Storage) != STORAGE_SPARSE {
+		t.Errorf("Resume data without storage mode was not decoded %v %v", version, err)
+	}
+
+	corrupted := append([]byte{}, data...)
+	corrupted[len(corrupted)-1] ^= 0xff
+	if _, _, err = decodeResumeData(corrupted); err == nil {
+		t.Error("Corrupted resume data was accepted")
+	}
+
+	if _, _, err = decodeResumeData(data[:len(data)-1]); err == nil {
+		t.Error("Truncated resume data was accepted")
+	}
+
+	unknown := append([]byte{}, data...)
+	unknown[4] = 100
+	if _, version, err = decodeResumeData(unknown); err == nil || version != 100 {
+		t.Error("Unknown resume data version was accepted")
+	}
+
+	// legacy resume data has base fields without header and could have garbage from the previous longer state,
+	// the garbage looks like skipped priority of the first piece and paused flag
+	legacy := append([]byte{}, data[RESUME_DATA_HEADER_SIZE:len(data)-proto.DataSize(uint32(0))-2*proto.DataSize(uint8(0))]...)
+	legacy = append(legacy, 1, 0, 0, 0, proto.PIECE_PRIORITY_SKIP, 1)
+	atp3, version, err := decodeResumeData(legacy)
+	if err != nil || version != RESUME_DATA_VERSION_LEGACY || atp3.Hashes.Hash != proto.EMULE || !atp3.Pieces.GetBit(1) || len(atp3.Priorities) != 0 || atp3.Paused {
+		t.Errorf("Legacy resume data was not migrated %v %v %v", version, atp3.Priorities, err)
+	}
+
+	filename := filepath.Join(t.TempDir(), proto.EMULE.ToString()+RESUME_DATA_EXT)
+	if err = os.WriteFile(filename, legacy, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if atp4, version, err := readResumeData(filename); err != nil || version != RESUME_DATA_VERSION_LEGACY || len(atp4.Priorities) != 0 || atp4.Paused {
+		t.Errorf("Legacy resume data file was not read %v %v", version, err)
+	}
+}
+
+func Test_ResumeDataStore(t *testing.T) {
+	dir := t.TempDir()
+	rs := MakeResumeDataStore(dir)
+	start := time.Now()
+	rs.FlushAll(start)
+
+	atp := proto.CreateAddTransferParameters(proto.EMULE, 100, "a.bin")
+	atp.DownloadedBlocks[0] = proto.CreateBitField(1)
+	rs.Update(atp)
+	rs.Tick(start.Add(time.Second))
+	if _, err := os.Stat(rs.Filename(proto.EMULE)); !os.IsNotExist(err) {
+		t.Error("Resume data was written before flush interval")
+	}
+
+	// the last state is written only
+	atp.DownloadedBlocks = make(map[int]proto.BitField)
+	atp.Pieces.SetBit(0)
+	rs.Update(atp)
+	rs.Tick(start.Add(RESUME_DATA_FLUSH_INTERVAL))
+	restored, version, err := readResumeData(rs.Filename(proto.EMULE))
+	if err != nil || version != RESUME_DATA_VERSION || len(restored.DownloadedBlocks) != 0 || !restored.Pieces.GetBit(0) {
+		t.Errorf("Resume data was not flushed %v", err)
+	}
+
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(files) != 0 {
+		t.Errorf("Temporary files were left %v", files)
+	}
+
+	// failed write is retried on the next flush
+	rs.dir = filepath.Join(dir, "missing")
+	rs.Update(atp)
+	if rs.Flush(proto.EMULE) == nil || len(rs.dirty) != 1 {
+		t.Error("Resume data was dropped after failed write")
+	}
+
+	if err = os.Mkdir(rs.dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	if rs.FlushAll(start) != nil || len(rs.dirty) != 0 {
+		t.Error("Resume data was not written on retry")
+	}
+
+	if _, err = os.Stat(rs.Filename(proto.EMULE)); err != nil {
+		t.Errorf("Resume data file was not created %v", err)
+	}
+
+	rs.Update(atp)
+	rs.Discard(proto.EMULE)
+	if rs.Flush(proto.EMULE) != nil || len(rs.dirty) != 0 {
+		t.Error("Discarded resume data was kept")
+	}
+}
@@ -0,0 +1,57 @@
+package ged2k
+
+import "github.com/a-pavlov/ged2k/proto"
+
+type searchRequest struct {
+	handle  *SearchHandle
+	request proto.SearchRequest
+	res     chan error
+}
+
+// SearchHandle receives answer of the server on the search request
+type SearchHandle struct {
+	Query   string
+	results chan []proto.SearchItem
+}
+
+// Results returns channel receiving found files, channel is closed when server answered or search was cancelled
+// by the next search or server disconnect
+func (sh *SearchHandle) Results() <-chan []proto.SearchItem {
+	return sh.results
+}
+
+func (sh *SearchHandle) complete(items []proto.SearchItem) {
+	sh.results <- items
+	close(sh.results)
+}
+
+func (sh *SearchHandle) cancel() {
+	close(sh.results)
+}
+
+// Search sends search request to the current server, query uses eMule search syntax
+func (s *Session) Search(query string) (*SearchHandle, error) {
+	parsed, err := proto.BuildEntries(0, 0, 0, 0, "", "", "", 0, 0, query)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := proto.PackRequest(parsed)
+	if err != nil {
+		return nil, err
+	}
+
+	handle := &SearchHandle{Query: query, results: make(chan []proto.SearchItem, 1)}
+	res := make(chan error, 1)
+	select {
+	case s.searchRequest <- searchRequest{handle: handle, request: req, res: res}:
+	case <-s.done:
+		return nil, ErrSessionClosed
+	}
+
+	if err := <-res; err != nil {
+		return nil, err
+	}
+
+	return handle, nil
+}
@@ -1,6 +1,7 @@
-package main
+package ged2k
 
 import (
+	"fmt"
 	"log"
 	"net"
 	"reflect"
@@ -13,16 +14,24 @@ type ServerConnection struct {
 	buffer     []byte
 	connection net.Conn
 	address    string
+	endpoint   proto.Endpoint
 	lastError  error
+	loggedIn   bool
+	rejected   bool
+
+	// reason of disconnect requested by session
+	leaveReason int
 
 	Connected           bool
 	DisconnectRequested bool
+	IdChange            proto.IdChange
+	Info                proto.ServerInfo
 	LastReceivedTime    time.Time
 	LastSendTime        time.Time
 }
 
 func NewServerConnection(a string) *ServerConnection {
-	return &ServerConnection{buffer: make([]byte, 200), address: a}
+	return &ServerConnection{buffer: make([]byte, 200), address: a, endpoint: proto.EndpointFromString(a)}
 }
 
 func (serverConnection *ServerConnection) Start(s *Session) {
@@ -36,21 +45,13 @@ func (serverConnection *ServerConnection) Start(s *Session) {
 
 	log.Println("Connected!", time.Now())
 	serverConnection.connection = connection
+	if ep, err := proto.FromString(connection.RemoteAddr().String()); err == nil {
+		serverConnection.endpoint = ep
+	}
 
 	s.registerServerConnection <- serverConnection
 
-	var version uint32 = 0x3c
-	var versionClient uint32 = (proto.GED2K_VERSION_MAJOR << 24) | (proto.GED2K_VERSION_MINOR << 17) | (proto.GED2K_VERSION_TINY << 10) | (1 << 7)
-	var capability uint32 = proto.CAPABLE_AUXPORT | proto.CAPABLE_NEWTAGS | proto.CAPABLE_UNICODE | proto.CAPABLE_LARGEFILES | proto.CAPABLE_ZLIB
-
-	var hello proto.UsualPacket
-	hello.Hash = proto.EMULE
-	hello.Point = proto.Endpoint{Ip: 0, Port: 20033}
-	hello.Properties = append(hello.Properties, proto.CreateTag(version, proto.CT_VERSION, ""))
-	hello.Properties = append(hello.Properties, proto.CreateTag(capability, proto.CT_SERVER_FLAGS, ""))
-	hello.Properties = append(hello.Properties, proto.CreateTag("ged2k", proto.CT_NAME, ""))
-	hello.Properties = append(hello.Properties, proto.CreateTag(versionClient, proto.CT_EMULE_VERSION, ""))
-
+	hello := s.createLoginRequest()
 	_, serverConnection.lastError = serverConnection.SendPacket(&hello)
 	log.Println("Send hello", time.Now())
 
@@ -72,13 +73,11 @@ func (serverConnection *ServerConnection) Start(s *Session) {
 
 		switch ph.Packet {
 		case proto.OP_SERVERLIST:
-			elems := sb.ReadUint8()
-			if sb.Error() == nil && elems < 100 {
-				c := proto.Collection{}
-				for i := 0; i < int(elems); i++ {
-					c = append(c, &proto.Endpoint{})
-				}
-				sb.Read(&c)
+			sl := proto.ServerListAnswer{}
+			sb.Read(&sl)
+			if sb.Error() == nil {
+				log.Println("Server list received", len(sl.Servers))
+				s.serverPackets <- &sl
 			}
 		case proto.OP_GETSERVERLIST:
 			// ignore
@@ -101,13 +100,22 @@ func (serverConnection *ServerConnection) Start(s *Session) {
 			idc.Get(&sb)
 			if sb.Error() == nil {
 				log.Println("Server id change", idc.ClientId)
+				serverConnection.loggedIn = true
 				s.serverPackets <- &idc
 			}
+		case proto.OP_REJECT:
+			if !serverConnection.loggedIn {
+				serverConnection.rejected = true
+				serverConnection.lastError = fmt.Errorf("server rejected login")
+			} else {
+				log.Println("Server rejected last command")
+			}
 		case proto.OP_SERVERIDENT:
-			p := proto.UsualPacket{}
-			p.Get(&sb)
+			si := proto.ServerInfo{}
+			sb.Read(&si)
 			if sb.Error() == nil {
-				log.Println("Received server info packet")
+				log.Println("Received server info packet", si.Name)
+				s.serverPackets <- &si
 			}
 		case proto.OP_SEARCHRESULT:
 			p := proto.SearchResult{}
@@ -140,8 +148,13 @@ func (serverConnection *ServerConnection) Start(s *Session) {
 			serverConnection.lastError = sb.Error()
 			break
 		}
+
+		if serverConnection.rejected {
+			break
+		}
 	}
 
+	connection.Close()
 	s.unregisterServerConnection <- serverConnection
 }
 
@@ -174,13 +187,42 @@ func (sc *ServerConnection) SendPacket(data proto.Serializable) (int, error) {
 	case *proto.GetServerList:
 		ph = proto.PacketHeader{Protocol: proto.OP_EDONKEYHEADER, Bytes: bytesCount, Packet: proto.OP_GETSERVERLIST}
 		log.Printf("Server list request %d bytes\n", sz)
+	case *proto.OfferFiles:
+		ph = proto.PacketHeader{Protocol: proto.OP_EDONKEYHEADER, Bytes: bytesCount, Packet: proto.OP_OFFERFILES}
+		log.Printf("Offer files request %d bytes\n", sz)
+		if sc.IdChange.SupportsCompression() {
+			if packed := Compress(bytes[proto.HEADER_SIZE : proto.HEADER_SIZE+stateBuffer.Offset()]); packed != nil {
+				ph = proto.PacketHeader{Protocol: proto.OP_PACKEDPROT, Bytes: uint32(len(packed) + 1), Packet: proto.OP_OFFERFILES}
+				bytes = append(bytes[:proto.HEADER_SIZE], packed...)
+				log.Printf("Offer files request packed to %d bytes\n", len(packed))
+			}
+		}
 	default:
 		panic("ServerConnection Send with unknown type " + reflect.TypeOf(data).String())
 	}
 
 	sc.LastSendTime = time.Now()
 	ph.Write(bytes)
-	return sc.connection.Write(bytes[:stateBuffer.Offset()+proto.HEADER_SIZE])
+	return sc.connection.Write(bytes[:int(ph.Bytes)-1+proto.HEADER_SIZE])
+}
+
+// LoggedIn returns true when server has assigned client id to us, must be called from session
+func (sc *ServerConnection) LoggedIn() bool {
+	return sc.Connected && sc.IdChange.ClientId != 0
+}
+
+// LeaveReason returns the reason of the closed connection
+func (sc *ServerConnection) LeaveReason() int {
+	switch {
+	case sc.rejected:
+		return SERVER_LEAVE_REJECTED
+	case sc.leaveReason != SERVER_LEAVE_NONE:
+		return sc.leaveReason
+	case !sc.Connected:
+		return SERVER_LEAVE_CONNECT_FAILED
+	default:
+		return SERVER_LEAVE_CONNECTION_LOST
+	}
 }
 
 func (sc *ServerConnection) Close() {
@@ -0,0 +1,234 @@
+package ged2k
+
+import (
+	"os"
+	"sort"
+	"time"
+
+	"github.com/a-pavlov/ged2k/proto"
+)
+
+const SERVER_MAX_FAIL_COUNT int = 3
+const SERVER_LIST_SAVE_INTERVAL = time.Minute * time.Duration(5)
+
+type ServerList struct {
+	servers      map[proto.Endpoint]*proto.ServerInfo
+	maxFailCount int
+	dirty        bool
+}
+
+func MakeServerList(maxFailCount int) ServerList {
+	if maxFailCount <= 0 {
+		maxFailCount = SERVER_MAX_FAIL_COUNT
+	}
+
+	return ServerList{servers: make(map[proto.Endpoint]*proto.ServerInfo), maxFailCount: maxFailCount}
+}
+
+// Add inserts new server or merges server properties into the existing one
+func (sl *ServerList) Add(info proto.ServerInfo) bool {
+	if info.Point.IsEmpty() {
+		return false
+	}
+
+	si, ok := sl.servers[info.Point]
+	if !ok {
+		x := info
+		sl.servers[info.Point] = &x
+		sl.dirty = true
+		return true
+	}
+
+	old := *si
+
+	if info.Hash != proto.ZERO {
+		si.Hash = info.Hash
+	}
+
+	if info.Name != "" {
+		si.Name = info.Name
+	}
+
+	if info.Description != "" {
+		si.Description = info.Description
+	}
+
+	if info.DynIP != "" {
+		si.DynIP = info.DynIP
+	}
+
+	if info.Version != "" {
+		si.Version = info.Version
+	}
+
+	if info.UsersCount != 0 {
+		si.UsersCount = info.UsersCount
+	}
+
+	if info.FilesCount != 0 {
+		si.FilesCount = info.FilesCount
+	}
+
+	if info.MaxUsers != 0 {
+		si.MaxUsers = info.MaxUsers
+	}
+
+	if info.SoftFiles != 0 {
+		si.SoftFiles = info.SoftFiles
+	}
+
+	if info.HardFiles != 0 {
+		si.HardFiles = info.HardFiles
+	}
+
+	if info.LowIdUsers != 0 {
+		si.LowIdUsers = info.LowIdUsers
+	}
+
+	if info.UdpFlags != 0 {
+		si.UdpFlags = info.UdpFlags
+	}
+
+	// list is saved only when merge changed the server
+	if *si != old {
+		sl.dirty = true
+	}
+
+	return false
+}
+
+func (sl *ServerList) AddEndpoint(point proto.Endpoint) bool {
+	if _, ok := sl.servers[point]; ok {
+		return false
+	}
+
+	return sl.Add(proto.ServerInfo{Point: point})
+}
+
+func (sl *ServerList) Get(point proto.Endpoint) *proto.ServerInfo {
+	return sl.servers[point]
+}
+
+func (sl *ServerList) Remove(point proto.Endpoint) bool {
+	if _, ok := sl.servers[point]; ok {
+		delete(sl.servers, point)
+		sl.dirty = true
+		return true
+	}
+
+	return false
+}
+
+func (sl *ServerList) Len() int {
+	return len(sl.servers)
+}
+
+func (sl *ServerList) ServerConnected(point proto.Endpoint) {
+	if si, ok := sl.servers[point]; ok && si.FailCount != 0 {
+		si.FailCount = 0
+		sl.dirty = true
+	}
+}
+
+// ServerFailed increments fail count of the server which moves it down in ranking
+// returns true when server exceeded max fail count and was removed
+func (sl *ServerList) ServerFailed(point proto.Endpoint) bool {
+	si, ok := sl.servers[point]
+	if !ok {
+		return false
+	}
+
+	si.FailCount++
+	sl.dirty = true
+	if int(si.FailCount) > sl.maxFailCount {
+		delete(sl.servers, point)
+		return true
+	}
+
+	return false
+}
+
+func priorityRank(priority uint32) int {
+	switch priority {
+	case proto.SRV_PR_HIGH:
+		return 2
+	case proto.SRV_PR_LOW:
+		return 0
+	default:
+		return 1
+	}
+}
+
+// LeftBetterRightServer returns true if l is better connect candidate than r
+func LeftBetterRightServer(l *proto.ServerInfo, r *proto.ServerInfo) bool {
+	if l.FailCount != r.FailCount {
+		return l.FailCount < r.FailCount
+	}
+
+	if l.Priority != r.Priority {
+		return priorityRank(l.Priority) > priorityRank(r.Priority)
+	}
+
+	if l.UsersCount != r.UsersCount {
+		return l.UsersCount > r.UsersCount
+	}
+
+	return l.Point.Ip < r.Point.Ip || (l.Point.Ip == r.Point.Ip && l.Point.Port < r.Point.Port)
+}
+
+// Servers returns copy of servers ordered from the best to the worst
+func (sl *ServerList) Servers() []proto.ServerInfo {
+	res := make([]proto.ServerInfo, 0, len(sl.servers))
+	for _, x := range sl.servers {
+		res = append(res, *x)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return LeftBetterRightServer(&res[i], &res[j])
+	})
+
+	return res
+}
+
+func (sl *ServerList) Load(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	sm := proto.ServerMet{}
+	sb := proto.StateBuffer{Data: data}
+	sb.Read(&sm)
+	if sb.Error() != nil {
+		return sb.Error()
+	}
+
+	for _, x := range sm.Servers {
+		sl.Add(x)
+	}
+
+	sl.dirty = false
+	return nil
+}
+
+func (sl *ServerList) Save(filename string) error {
+	sm := proto.ServerMet{Header: proto.MET_HEADER, Servers: sl.Servers()}
+	data := make([]byte, sm.Size())
+	sb := proto.StateBuffer{Data: data}
+	sb.Write(sm)
+	if sb.Error() != nil {
+		return sb.Error()
+	}
+
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, data, 0666); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, filename); err != nil {
+		return err
+	}
+
+	sl.dirty = false
+	return nil
+}
@@ -0,0 +1,111 @@
+package ged2k
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/a-pavlov/ged2k/proto"
+)
+
+func Test_ServerListMerge(t *testing.T) {
+	sl := MakeServerList(2)
+	e1 := proto.EndpointFromString("176.123.5.89:4725")
+	e2 := proto.EndpointFromString("5.45.85.226:6584")
+
+	if !sl.AddEndpoint(e1) || sl.AddEndpoint(e1) {
+		t.Error("Add endpoint error")
+	}
+
+	if sl.Add(proto.ServerInfo{Point: e1, Name: "first", UsersCount: 10}) {
+		t.Error("Existing server was added as new")
+	}
+
+	sl.dirty = false
+	if sl.Add(proto.ServerInfo{Point: e1, Name: "first"}); sl.dirty {
+		t.Error("Server list was changed by the same server info")
+	}
+
+	sl.Add(proto.ServerInfo{Point: e1, FilesCount: 20})
+	si := sl.Get(e1)
+	if si == nil || si.Name != "first" || si.UsersCount != 10 || si.FilesCount != 20 || !sl.dirty {
+		t.Errorf("Server info was not merged %v", si)
+	}
+
+	if !sl.Add(proto.ServerInfo{Point: e2, Name: "second", UsersCount: 5}) {
+		t.Error("New server was not added")
+	}
+
+	servers := sl.Servers()
+	if len(servers) != 2 || servers[0].Point != e1 || servers[1].Point != e2 {
+		t.Errorf("Servers order is incorrect %v", servers)
+	}
+
+	// failed server moves down
+	sl.ServerFailed(e1)
+	servers = sl.Servers()
+	if servers[0].Point != e2 {
+		t.Errorf("Failed server was not demoted %v", servers)
+	}
+
+	sl.ServerConnected(e1)
+	if sl.Get(e1).FailCount != 0 {
+		t.Error("Fail count was not reset")
+	}
+
+	if sl.ServerFailed(e2) || sl.ServerFailed(e2) || !sl.ServerFailed(e2) {
+		t.Error("Server was not removed after fails")
+	}
+
+	if sl.Len() != 1 || sl.Get(e2) != nil {
+		t.Error("Removed server is still in list")
+	}
+}
+
+func Test_ServerListPriority(t *testing.T) {
+	sl := MakeServerList(0)
+	e1 := proto.EndpointFromString("1.1.1.1:4661")
+	e2 := proto.EndpointFromString("2.2.2.2:4661")
+	e3 := proto.EndpointFromString("3.3.3.3:4661")
+	sl.Add(proto.ServerInfo{Point: e1, Priority: proto.SRV_PR_LOW, UsersCount: 100})
+	sl.Add(proto.ServerInfo{Point: e2, Priority: proto.SRV_PR_NORMAL, UsersCount: 1})
+	sl.Add(proto.ServerInfo{Point: e3, Priority: proto.SRV_PR_HIGH})
+
+	servers := sl.Servers()
+	if servers[0].Point != e3 || servers[1].Point != e2 || servers[2].Point != e1 {
+		t.Errorf("Servers priority order incorrect %v", servers)
+	}
+}
+
+func Test_ServerListPersistence(t *testing.T) {
+	dir, err := os.MkdirTemp("", "ged2k")
+	if err != nil {
+		t.Fatalf("Can not create temp dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "server.met")
+	sl := MakeServerList(0)
+	sl.Add(proto.ServerInfo{Point: proto.EndpointFromString("1.1.1.1:4661"), Name: "first", FailCount: 1})
+	sl.Add(proto.ServerInfo{Point: proto.EndpointFromString("2.2.2.2:4661"), Name: "second", Description: "desc"})
+	if err := sl.Save(filename); err != nil {
+		t.Errorf("Can not save server list %v", err)
+	}
+
+	if sl.dirty {
+		t.Error("Server list still dirty after save")
+	}
+
+	sl2 := MakeServerList(0)
+	if err := sl2.Load(filename); err != nil {
+		t.Errorf("Can not load server list %v", err)
+	} else if sl2.Len() != 2 {
+		t.Errorf("Loaded servers count incorrect %d", sl2.Len())
+	} else {
+		s1 := sl2.Get(proto.EndpointFromString("1.1.1.1:4661"))
+		s2 := sl2.Get(proto.EndpointFromString("2.2.2.2:4661"))
+		if s1 == nil || s1.Name != "first" || s1.FailCount != 1 || s2 == nil || s2.Description != "desc" {
+			t.Errorf("Loaded servers incorrect %v %v", s1, s2)
+		}
+	}
+}
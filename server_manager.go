@@ -0,0 +1,175 @@
+package ged2k
+
+import (
+	"time"
+
+	"github.com/a-pavlov/ged2k/proto"
+)
+
+const SERVER_RECONNECT_MIN_SEC = 10
+const SERVER_RECONNECT_MAX_SEC = 600
+const SERVER_REJECT_TIMEOUT = time.Hour
+
+const (
+	SERVER_LEAVE_NONE = iota
+	SERVER_LEAVE_REQUESTED
+	SERVER_LEAVE_CONNECT_FAILED
+	SERVER_LEAVE_CONNECTION_LOST
+	SERVER_LEAVE_TIMEOUT
+	SERVER_LEAVE_REJECTED
+	SERVER_LEAVE_LOWID
+)
+
+func ServerLeaveReason2String(reason int) string {
+	switch reason {
+	case SERVER_LEAVE_NONE:
+		return "none"
+	case SERVER_LEAVE_REQUESTED:
+		return "requested"
+	case SERVER_LEAVE_CONNECT_FAILED:
+		return "connect failed"
+	case SERVER_LEAVE_CONNECTION_LOST:
+		return "connection lost"
+	case SERVER_LEAVE_TIMEOUT:
+		return "no answer timeout"
+	case SERVER_LEAVE_REJECTED:
+		return "rejected"
+	case SERVER_LEAVE_LOWID:
+		return "low id"
+	default:
+		return "unknown"
+	}
+}
+
+type serverAttempt struct {
+	failures int
+	nextTry  time.Time
+	lowId    bool
+}
+
+type ServerStatus struct {
+	Current         proto.Endpoint
+	Connected       bool
+	LowId           bool
+	LastLeft        proto.Endpoint
+	LastLeaveReason int
+	AutoConnect     bool
+	ClientId        uint32
+	TcpFlags        uint32
+	Info            proto.ServerInfo
+}
+
+// ServerManager chooses servers to connect from the server list and tracks connection attempts
+type ServerManager struct {
+	AutoConnect     bool
+	Current         proto.Endpoint
+	LastLeft        proto.Endpoint
+	LastLeaveReason int
+	attempts        map[proto.Endpoint]*serverAttempt
+}
+
+func MakeServerManager(autoConnect bool) ServerManager {
+	return ServerManager{AutoConnect: autoConnect, attempts: make(map[proto.Endpoint]*serverAttempt)}
+}
+
+func (sm *ServerManager) attempt(point proto.Endpoint) *serverAttempt {
+	a, ok := sm.attempts[point]
+	if !ok {
+		a = &serverAttempt{}
+		sm.attempts[point] = a
+	}
+	return a
+}
+
+func (sm *ServerManager) candidate(servers []proto.ServerInfo, t time.Time, allowLowId bool) (proto.Endpoint, bool) {
+	for _, x := range servers {
+		if x.Point == sm.Current {
+			continue
+		}
+
+		if a, ok := sm.attempts[x.Point]; ok {
+			if !a.nextTry.IsZero() && t.Before(a.nextTry) {
+				continue
+			}
+
+			if a.lowId && !allowLowId {
+				continue
+			}
+		}
+
+		return x.Point, true
+	}
+
+	return proto.Endpoint{}, false
+}
+
+// NextCandidate returns the best server to connect to, servers gave us LowID are used only when no other servers are available
+func (sm *ServerManager) NextCandidate(sl *ServerList, t time.Time) (proto.Endpoint, bool) {
+	servers := sl.Servers()
+	if ep, ok := sm.candidate(servers, t, false); ok {
+		return ep, true
+	}
+
+	return sm.candidate(servers, t, true)
+}
+
+// HasHighIdCandidate returns true when there is a server which did not give us LowID yet
+func (sm *ServerManager) HasHighIdCandidate(sl *ServerList, t time.Time) bool {
+	_, ok := sm.candidate(sl.Servers(), t, false)
+	return ok
+}
+
+func (sm *ServerManager) Connected(point proto.Endpoint) {
+	sm.Current = point
+	a := sm.attempt(point)
+	a.failures = 0
+	a.nextTry = time.Time{}
+}
+
+func (sm *ServerManager) LoggedIn(point proto.Endpoint, lowId bool) {
+	sm.attempt(point).lowId = lowId
+}
+
+func (sm *ServerManager) IsLowId() bool {
+	if a, ok := sm.attempts[sm.Current]; ok {
+		return a.lowId
+	}
+
+	return false
+}
+
+// Left registers leaving the server with reason and schedules the next attempt to it
+func (sm *ServerManager) Left(point proto.Endpoint, reason int, t time.Time) {
+	if sm.Current == point {
+		sm.Current = proto.Endpoint{}
+	}
+
+	sm.LastLeft = point
+	sm.LastLeaveReason = reason
+
+	a := sm.attempt(point)
+	switch reason {
+	case SERVER_LEAVE_CONNECT_FAILED, SERVER_LEAVE_CONNECTION_LOST, SERVER_LEAVE_TIMEOUT:
+		a.failures++
+		timeout := SERVER_RECONNECT_MIN_SEC << uint(a.failures-1)
+		if timeout > SERVER_RECONNECT_MAX_SEC || timeout <= 0 {
+			timeout = SERVER_RECONNECT_MAX_SEC
+		}
+		a.nextTry = t.Add(time.Second * time.Duration(timeout))
+	case SERVER_LEAVE_REJECTED:
+		a.nextTry = t.Add(SERVER_REJECT_TIMEOUT)
+	case SERVER_LEAVE_LOWID:
+		a.nextTry = t.Add(time.Second * time.Duration(SERVER_RECONNECT_MIN_SEC))
+	}
+}
+
+func (sm *ServerManager) Status(connected bool) ServerStatus {
+	return ServerStatus{
+		Current:         sm.Current,
+		Connected:       connected,
+		LowId:           sm.IsLowId(),
+		LastLeft:        sm.LastLeft,
+		LastLeaveReason: sm.LastLeaveReason,
+		AutoConnect:     sm.AutoConnect,
+	}
+}
@@ -0,0 +1,90 @@
+package ged2k
+
+import (
+	"testing"
+	"time"
+
+	"github.com/a-pavlov/ged2k/proto"
+)
+
+func Test_ServerManagerFailover(t *testing.T) {
+	sl := MakeServerList(0)
+	e1 := proto.EndpointFromString("1.1.1.1:4661")
+	e2 := proto.EndpointFromString("2.2.2.2:4661")
+	sl.Add(proto.ServerInfo{Point: e1, Priority: proto.SRV_PR_HIGH})
+	sl.Add(proto.ServerInfo{Point: e2})
+
+	sm := MakeServerManager(true)
+	tm := time.Now()
+	if ep, ok := sm.NextCandidate(&sl, tm); !ok || ep != e1 {
+		t.Errorf("First candidate is not correct %v", ep)
+	}
+
+	sm.Left(e1, SERVER_LEAVE_CONNECT_FAILED, tm)
+	if sm.LastLeft != e1 || sm.LastLeaveReason != SERVER_LEAVE_CONNECT_FAILED {
+		t.Error("Last left server is not correct")
+	}
+
+	if ep, ok := sm.NextCandidate(&sl, tm); !ok || ep != e2 {
+		t.Errorf("Failover candidate is not correct %v", ep)
+	}
+
+	sm.Left(e2, SERVER_LEAVE_REJECTED, tm)
+	if _, ok := sm.NextCandidate(&sl, tm.Add(time.Second)); ok {
+		t.Error("Candidate found while all servers are in backoff")
+	}
+
+	// first server after backoff, rejected server still skipped
+	ep, ok := sm.NextCandidate(&sl, tm.Add(time.Second*time.Duration(SERVER_RECONNECT_MIN_SEC+1)))
+	if !ok || ep != e1 {
+		t.Errorf("Server after backoff is not correct %v", ep)
+	}
+
+	// backoff grows with failures
+	sm.Left(e1, SERVER_LEAVE_CONNECTION_LOST, tm)
+	if _, ok := sm.NextCandidate(&sl, tm.Add(time.Second*time.Duration(SERVER_RECONNECT_MIN_SEC+1))); ok {
+		t.Error("Backoff does not grow")
+	}
+
+	if ep, ok := sm.NextCandidate(&sl, tm.Add(time.Second*time.Duration(SERVER_RECONNECT_MIN_SEC*2+1))); !ok || ep != e1 {
+		t.Errorf("Server after second backoff is not correct %v", ep)
+	}
+
+	sm.Connected(e1)
+	if sm.Current != e1 || sm.attempts[e1].failures != 0 {
+		t.Error("Connected state is not correct")
+	}
+}
+
+func Test_ServerManagerLowId(t *testing.T) {
+	sl := MakeServerList(0)
+	e1 := proto.EndpointFromString("1.1.1.1:4661")
+	e2 := proto.EndpointFromString("2.2.2.2:4661")
+	sl.Add(proto.ServerInfo{Point: e1, UsersCount: 100})
+	sl.Add(proto.ServerInfo{Point: e2, UsersCount: 10})
+
+	sm := MakeServerManager(true)
+	tm := time.Now()
+	sm.Connected(e1)
+	sm.LoggedIn(e1, true)
+	if !sm.IsLowId() {
+		t.Error("Low id was not registered")
+	}
+
+	if !sm.HasHighIdCandidate(&sl, tm) {
+		t.Error("High id candidate not found")
+	}
+
+	sm.Left(e1, SERVER_LEAVE_LOWID, tm)
+	sm.Connected(e2)
+	sm.LoggedIn(e2, true)
+	if sm.HasHighIdCandidate(&sl, tm.Add(time.Hour)) {
+		t.Error("High id candidate found when all servers gave low id")
+	}
+
+	sm.Left(e2, SERVER_LEAVE_REQUESTED, tm)
+	// low id servers are used when nothing else available
+	if ep, ok := sm.NextCandidate(&sl, tm.Add(time.Hour)); !ok || ep != e1 {
+		t.Errorf("Low id server was not returned as last resort %v", ep)
+	}
+}
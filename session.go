@@ -1,29 +1,86 @@
-package main
+package ged2k
 
 import (
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
-	"strconv"
-	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/a-pavlov/ged2k/proto"
 )
 
+// ErrSessionClosed is returned by requests to the session which was stopped
+var ErrSessionClosed = errors.New("session is closed")
+
+// SERVER_MET_DOWNLOAD_TIMEOUT limits download of server list from link
+const SERVER_MET_DOWNLOAD_TIMEOUT = 30 * time.Second
+
+// SERVER_MET_MAX_SIZE is the largest server list accepted from link
+const SERVER_MET_MAX_SIZE = 4 * 1024 * 1024
+
+const (
+	sessionCommandStop = iota
+	sessionCommandConnect
+	sessionCommandDisconnect
+	sessionCommandAutoConnect
+	sessionCommandRescan
+	sessionCommandServerList
+	sessionCommandUploadPriority
+)
+
+// sessionCommand is a request without answer executed by the session goroutine
+type sessionCommand struct {
+	action   int
+	address  string
+	hash     proto.ED2KHash
+	priority int
+}
+
 type Session struct {
 	configuration   Config
-	comm            chan string
-	wg              sync.WaitGroup
+	comm            chan sessionCommand
+	done            chan struct{} // closed when session goroutine exits
 	listener        net.Listener
 	peerConnections map[proto.Endpoint]*PeerConnection
 	transfers       map[proto.ED2KHash]*Transfer
+	addLinkChan     chan proto.EMuleLink
+
+	addTransferRequest chan addTransferRequest
+	transferRequest    chan transferRequest
+	searchRequest      chan searchRequest
+	search             *SearchHandle
+	events             eventBus
+
+	// status snapshots
+	sessionStatusRequest  chan chan SessionStatus
+	transferStatusRequest chan transferStatusRequest
+
+	// upload section
+	sharedFiles       map[proto.ED2KHash]*SharedFile
+	sharedFileRequest chan sharedFileRequest
+	uploadQueue       UploadQueue
+	uploadSlotRequest chan uploadSlotRequest
+	uploadQueueStatus chan chan UploadQueueStatus
+	credits           map[proto.ED2KHash]*ClientCredit
+	libraryFiles      map[proto.ED2KHash]bool
+	libraryChan       chan []*SharedFile
+	libraryScanning   bool
+	offeredFiles      map[proto.ED2KHash]bool
+	streamServer      *StreamServer
+	resumeData        ResumeDataStore
+	disk              *DiskIO
 
 	// server section
 	serverConnection           *ServerConnection
+	serverList                 ServerList
+	serverManager              ServerManager
+	serverStatusRequest        chan chan ServerStatus
+	addServersChan             chan []proto.ServerInfo
 	serverPackets              chan proto.Serializable
 	registerServerConnection   chan *ServerConnection
 	unregisterServerConnection chan *ServerConnection
@@ -31,10 +88,12 @@ type Session struct {
 	// peer connection
 	registerPeerConnection   chan *PeerConnection
 	unregisterPeerConnection chan PeerConnectionPacket
+	peerInfoChan             chan PeerInfoPacket
 
 	//transfer
 	transferChanResumeDataRead chan *Transfer
 	transferChanFinished       chan *Transfer
+	transferChanUnfinished     chan *Transfer
 	transferChanPaused         chan *Transfer
 	transferResumeData         chan proto.AddTransferParameters
 	transferChanError          chan TransferError
@@ -48,20 +107,59 @@ type Session struct {
 	Stat     Statistics
 }
 
-func NewSession(config Config) *Session {
+// NewSession creates session, incoming directory is created when it does not exist
+func NewSession(config Config) (*Session, error) {
+	if config.IncomingDir == "" {
+		return nil, fmt.Errorf("incoming directory is not set")
+	}
+
+	if err := os.MkdirAll(config.IncomingDir, 0777); err != nil {
+		return nil, fmt.Errorf("can not create incoming directory %s: %v", config.IncomingDir, err)
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", config.ListenPort))
+	if err != nil {
+		return nil, fmt.Errorf("can not listen on port %d: %v", config.ListenPort, err)
+	}
+
 	log.Println("Create session")
 	return &Session{
 		configuration:              config,
-		comm:                       make(chan string),
+		comm:                       make(chan sessionCommand),
+		done:                       make(chan struct{}),
+		listener:                   listener,
 		peerConnections:            make(map[proto.Endpoint]*PeerConnection, 0),
 		serverPackets:              make(chan proto.Serializable),
+		serverList:                 MakeServerList(config.MaxServerFailCount),
+		serverManager:              MakeServerManager(config.ServerAutoConnect),
+		serverStatusRequest:        make(chan chan ServerStatus),
+		addServersChan:             make(chan []proto.ServerInfo),
 		registerServerConnection:   make(chan *ServerConnection),
 		unregisterServerConnection: make(chan *ServerConnection),
 		registerPeerConnection:     make(chan *PeerConnection),
 		unregisterPeerConnection:   make(chan PeerConnectionPacket),
+		peerInfoChan:               make(chan PeerInfoPacket),
 		transfers:                  make(map[proto.ED2KHash]*Transfer),
+		addLinkChan:                make(chan proto.EMuleLink),
+		addTransferRequest:         make(chan addTransferRequest),
+		transferRequest:            make(chan transferRequest),
+		searchRequest:              make(chan searchRequest),
+		sessionStatusRequest:       make(chan chan SessionStatus),
+		transferStatusRequest:      make(chan transferStatusRequest),
+		sharedFiles:                make(map[proto.ED2KHash]*SharedFile),
+		sharedFileRequest:          make(chan sharedFileRequest),
+		uploadQueue:                MakeUploadQueue(UploadSlotsCount(config.MaxUploadRate, config.MaxUploadSlots)),
+		uploadSlotRequest:          make(chan uploadSlotRequest),
+		uploadQueueStatus:          make(chan chan UploadQueueStatus),
+		credits:                    make(map[proto.ED2KHash]*ClientCredit),
+		libraryFiles:               make(map[proto.ED2KHash]bool),
+		libraryChan:                make(chan []*SharedFile),
+		offeredFiles:               make(map[proto.ED2KHash]bool),
+		resumeData:                 MakeResumeDataStore(config.IncomingDir),
+		disk:                       NewDiskIO(),
 		transferChanResumeDataRead: make(chan *Transfer),
 		transferChanFinished:       make(chan *Transfer),
+		transferChanUnfinished:     make(chan *Transfer),
 		transferChanPaused:         make(chan *Transfer),
 		transferResumeData:         make(chan proto.AddTransferParameters),
 		transferChanError:          make(chan TransferError),
@@ -69,28 +167,32 @@ func NewSession(config Config) *Session {
 		statReceiveChan:            make(chan StatPacket),
 		statSendChan:               make(chan StatPacket),
 		Stat:                       MakeStatistics(),
-	}
+	}, nil
 }
 
-func (s *Session) Tick() {
+func (s *Session) tick() {
 	tick := time.Tick(1000 * time.Millisecond)
 	execute := true
-	s.wg.Add(1)
-	defer s.wg.Done()
-
-	// start listener
-	var e error
-	s.listener, e = net.Listen("tcp", ":12345")
-	if e != nil {
-		// can not listen
+	defer close(s.done)
+	s.disk.Start(DISK_WORKERS, HASH_WORKERS)
+	go s.accept(s.listener)
 
-	} else {
-		go s.accept(&s.listener)
+	if s.configuration.ServerMetFile != "" {
+		if err := s.serverList.Load(s.configuration.ServerMetFile); err != nil && !os.IsNotExist(err) {
+			log.Printf("can not load server list from %s: %v\n", s.configuration.ServerMetFile, err)
+		} else {
+			log.Printf("server list loaded %d servers\n", s.serverList.Len())
+		}
 	}
 
+	// transfers are restored before library scan to exclude their files
+	s.restoreTransfers()
+	s.rescanLibrary()
+
 	var candidate *ServerConnection
 
 	lastTick := time.Time{}
+	lastServerListSave := time.Now()
 
 	stopped := false
 
@@ -98,8 +200,23 @@ func (s *Session) Tick() {
 		select {
 		case sc := <-s.unregisterServerConnection:
 			{
-				log.Printf("Server connection closed, reason: \"%v\"\n", sc.lastError)
+				if s.search != nil {
+					s.search.cancel()
+					s.search = nil
+				}
+
+				reason := sc.LeaveReason()
+				log.Printf("Server connection %s closed, reason: %s error: \"%v\"\n", sc.endpoint.ToString(), ServerLeaveReason2String(reason), sc.lastError)
+				s.events.publish(ServerDisconnectedEvent{Endpoint: sc.endpoint, Reason: reason, Err: sc.lastError})
 				s.serverConnection = nil
+				atomic.StoreUint32(&s.ClientId, 0)
+				s.offeredFiles = make(map[proto.ED2KHash]bool)
+				s.serverManager.Left(sc.endpoint, reason, time.Now())
+				if !stopped && reason != SERVER_LEAVE_REQUESTED && reason != SERVER_LEAVE_LOWID {
+					if s.serverList.ServerFailed(sc.endpoint) {
+						log.Printf("Server %s removed from server list after failures\n", sc.endpoint.ToString())
+					}
+				}
 				if stopped && len(s.peerConnections) == 0 && len(s.transfers) == 0 {
 					execute = false
 					break
@@ -117,6 +234,9 @@ func (s *Session) Tick() {
 				log.Println("Server connection established")
 				sc.Connected = true
 				sc.LastReceivedTime = time.Now().Add(time.Duration(30) * time.Second)
+				s.serverList.AddEndpoint(sc.endpoint)
+				s.serverList.ServerConnected(sc.endpoint)
+				s.serverManager.Connected(sc.endpoint)
 
 				if candidate != nil || sc.DisconnectRequested {
 					log.Println("Server disconnect was requested")
@@ -124,169 +244,133 @@ func (s *Session) Tick() {
 					s.serverConnection.connection.Close()
 				}
 			}
-		case cmd, ok := <-s.comm:
-			if !ok {
-				log.Println("Session exit requested")
-				execute = false
-			} else {
-				log.Println("Session received cmd:", cmd)
-				elems := strings.Split(cmd, " ")
-
-				switch elems[0] {
-				case "stop":
-					stopped = true
-					if len(s.peerConnections) == 0 && len(s.transfers) == 0 {
-						execute = false
-						break
-					}
+		case cmd := <-s.comm:
+			switch cmd.action {
+			case sessionCommandStop:
+				stopped = true
+				if len(s.peerConnections) == 0 && len(s.transfers) == 0 {
+					execute = false
+					break
+				}
 
-					for _, x := range s.transfers {
-						// ask transfers to do not ask for new peers and so on
-						x.Stopped = true
-						if len(s.peerConnections) == 0 {
-							go x.Stop()
-						}
+				for _, x := range s.transfers {
+					// ask transfers to do not ask for new peers and so on
+					x.Stopped = true
+					if len(s.peerConnections) == 0 {
+						s.stopTransfer(x)
 					}
+				}
 
-					// close all peer connections
-					for _, x := range s.peerConnections {
-						go x.Close(true)
-					}
+				// close all peer connections
+				for _, x := range s.peerConnections {
+					go x.Close(true)
+				}
 
-					if s.serverConnection != nil {
-						go s.serverConnection.Close()
-					}
-				case "hello":
-					log.Println("Hello !!!")
-				case "connect":
-					log.Println("Requested connect to", elems[1])
-					if s.serverConnection == nil {
-						s.serverConnection = NewServerConnection(elems[1])
-						go s.serverConnection.Start(s)
-					} else {
-						candidate = NewServerConnection(elems[1])
-						if s.serverConnection != nil && s.serverConnection.Connected {
-							if !s.serverConnection.DisconnectRequested {
-								go s.serverConnection.Close()
-							}
-							s.serverConnection.DisconnectRequested = true
-						}
-					}
-				case "disconnect":
-					if s.serverConnection != nil {
-						if s.serverConnection.Connected && !s.serverConnection.DisconnectRequested {
-							go s.serverConnection.Close()
-						}
-						s.serverConnection.DisconnectRequested = true
-					}
+				s.closeServerConnection(SERVER_LEAVE_REQUESTED)
+			case sessionCommandConnect:
+				log.Println("Requested connect to", cmd.address)
+				if s.serverConnection == nil {
+					s.serverConnection = NewServerConnection(cmd.address)
+					go s.serverConnection.Start(s)
+				} else {
+					candidate = NewServerConnection(cmd.address)
+					s.closeServerConnection(SERVER_LEAVE_REQUESTED)
+				}
+			case sessionCommandRescan:
+				s.rescanLibrary()
+			case sessionCommandUploadPriority:
+				if sf, ok := s.sharedFiles[cmd.hash]; ok {
+					sf.Priority = cmd.priority
+				}
+			case sessionCommandAutoConnect:
+				s.serverManager.AutoConnect = true
+			case sessionCommandDisconnect:
+				s.serverManager.AutoConnect = false
+				s.closeServerConnection(SERVER_LEAVE_REQUESTED)
+
+				for ep, x := range s.peerConnections {
+					fmt.Printf("REQ ds %s\n", ep.ToString())
+					x.Close(true)
+				}
+			case sessionCommandServerList:
+				if s.serverConnection != nil && s.serverConnection.Connected {
+					req := proto.GetServerList{}
+					s.serverConnection.SendPacket(&req)
+				}
+			}
+		case req := <-s.addTransferRequest:
+			if stopped {
+				req.res <- fmt.Errorf("session is stopping")
+				break
+			}
 
-					for ep, x := range s.peerConnections {
-						fmt.Printf("REQ ds %s\n", ep.ToString())
-						x.Close(true)
-					}
-				case "search":
-					if s.serverConnection != nil && s.serverConnection.Connected {
-						parsed, err := proto.BuildEntries(0, 0, 0, 0, "", "", "", 0, 0, elems[1])
-						if err == nil {
-							req, err := proto.PackRequest(parsed)
-							if err == nil {
-								_, err = s.serverConnection.SendPacket(&req)
-								//if err == nil {
-								//	serverLastReq = time.Now()
-								//}
-							}
-						}
-					}
-				case "serverlist":
-					if s.serverConnection != nil && s.serverConnection.Connected {
-						req := proto.GetServerList{}
-						s.serverConnection.SendPacket(&req)
-						/*if err != nil {
-							s.serverConnection.connection.Close()
-						} else {
-							serverLastReq = time.Now()
-						}*/
-					}
-				case "peer":
-					proto.FromString(elems[1])
-					/*if err == nil {
-						pc := NewPeerConnection(ep, nil, )
-						ep, _ := proto.FromString(elems[1])
-						pc.Start(s)
-					}*/
-				case "load":
-					for i := 1; i < len(elems); i++ {
-						rd, err := ioutil.ReadFile(elems[1])
-						if err != nil {
-							log.Println("Error read resume data file", err)
-						} else {
-							sb := proto.StateBuffer{Data: rd}
-							var atp proto.AddTransferParameters
-							sb.Read(&atp)
-							if sb.Error() == nil {
-								t := NewTransfer(atp.Hashes.Hash, atp.Filename.ToString(), atp.Filesize)
-								go t.Start(s, &atp)
-							} else {
-								log.Printf("Can not read resume data file %v\n", sb.Error())
-							}
-						}
-					}
-				case "tran":
-					log.Println("tran command accepted")
-					name := elems[1]
-					hash := proto.String2Hash(elems[2])
-					size, err := strconv.ParseUint(elems[3], 10, 64)
-					if err == nil {
-						filename := s.configuration.IncomingDir + "/" + name
-						log.Printf(" add transfer %v to file %s\n", hash.ToString(), filename)
-						tran := NewTransfer(hash, filename, size)
-						s.transfers[hash] = tran
-						if tran.policy.AddPeer(&Peer{endpoint: proto.EndpointFromString("127.0.0.1:4662"), SourceFlag: 'S'}) {
-							log.Printf("Added peer 127.0.0.1:4662\n")
-						}
-						if tran.policy.AddPeer(&Peer{endpoint: proto.EndpointFromString("127.0.0.1:4663"), SourceFlag: 'S'}) {
-							log.Printf("Added peer 127.0.0.1:4663\n")
-						}
+			req.res <- s.addTransfer(&req.atp, req.sources, req.sourceFlag, req.storageMode)
+		case req := <-s.transferRequest:
+			req.res <- s.transferAction(req)
+		case req := <-s.searchRequest:
+			if s.serverConnection == nil || !s.serverConnection.LoggedIn() {
+				req.res <- fmt.Errorf("not connected to server")
+				break
+			}
 
-						go tran.Start(s, nil)
-					} else {
-						log.Println("Error on transfer adding", err)
-					}
-				case "restore":
-					log.Printf("restore %s\n", elems[1])
-					data, err := os.ReadFile(s.configuration.IncomingDir + "/" + elems[1] + ".rd")
-					if err != nil {
-						log.Printf("can not read resum data file %v\n", err)
-					} else {
-						parameters := proto.AddTransferParameters{}
-						sb := proto.StateBuffer{Data: data}
-						sb.Read(&parameters)
-						if sb.Error() != nil {
-							log.Printf("can not serialize add transfer parameters: %v", err)
-						} else {
-							tran := NewTransfer(parameters.Hashes.Hash, parameters.Filename.ToString(), parameters.Filesize)
-							s.transfers[parameters.Hashes.Hash] = tran
+			if s.search != nil {
+				s.search.cancel()
+			}
 
-							if parameters.WantMoreData() {
+			s.search = req.handle
+			go s.serverConnection.SendPacket(&req.request)
+			req.res <- nil
+		case res := <-s.serverStatusRequest:
+			res <- s.serverStatus()
+		case res := <-s.sessionStatusRequest:
+			res <- s.status()
+		case req := <-s.transferStatusRequest:
+			req.res <- s.transferStatus(req.hash)
+		case req := <-s.sharedFileRequest:
+			if sf, ok := s.sharedFiles[req.hash]; ok {
+				res := *sf
+				res.Pieces = proto.CloneBitField(sf.Pieces)
+				req.res <- &res
+			} else if tran, ok := s.transfers[req.hash]; ok && req.transfers {
+				pieces, _ := proto.NumPiecesAndBlocks(tran.Size)
+				req.res <- &SharedFile{Hash: tran.Hash, Size: tran.Size, Filename: tran.Filename, Pieces: proto.CreateBitField(pieces), memory: tran.StorageMode == STORAGE_MEMORY}
+			} else {
+				req.res <- nil
+			}
+		case files := <-s.libraryChan:
+			s.libraryScanning = false
+			s.updateLibrary(files)
+			log.Printf("library scan finished, shared files %d\n", len(s.sharedFiles))
+		case req := <-s.uploadSlotRequest:
+			if req.checkOnly {
+				if s.uploadQueue.HasSlot(req.connection) {
+					req.res <- 0
+				} else {
+					req.res <- -1
+				}
+				break
+			}
 
-								if tran.policy.AddPeer(&Peer{endpoint: proto.EndpointFromString("127.0.0.1:4662"), SourceFlag: 'S'}) {
-									log.Printf("Added peer 127.0.0.1:4662\n")
-								}
-								if tran.policy.AddPeer(&Peer{endpoint: proto.EndpointFromString("127.0.0.1:4663"), SourceFlag: 'S'}) {
-									log.Printf("Added peer 127.0.0.1:4663\n")
-								}
+			priority := UPLOAD_PRIORITY_NORMAL
+			if sf, ok := s.sharedFiles[req.hash]; ok {
+				priority = sf.Priority
+			}
 
-								go tran.Start(s, &parameters)
-							} else {
-								go tran.StartFinished(s, &parameters)
-							}
-						}
-					}
+			credit := 1.0
+			if cc, ok := s.credits[req.userHash]; ok {
+				credit = cc.Ratio()
+			}
 
-				default:
-					log.Printf("Unknown command %s\n", cmd)
-				}
+			req.res <- s.uploadQueue.Request(req.connection, req.userHash, req.hash, priority, credit, time.Now())
+		case res := <-s.uploadQueueStatus:
+			res <- s.uploadQueue.Status(time.Now())
+		case link := <-s.addLinkChan:
+			s.addFileLink(link)
+		case servers := <-s.addServersChan:
+			for _, x := range servers {
+				s.serverList.Add(x)
 			}
+			log.Printf("Server list updated, servers %d\n", s.serverList.Len())
 		case c, ok := <-s.serverPackets:
 			if ok {
 				if s.serverConnection != nil {
@@ -299,12 +383,22 @@ func (s *Session) Tick() {
 					switch data := c.(type) {
 					case *proto.SearchResult:
 						log.Printf("session received search result size %d\n", data.Size())
+						items := make([]proto.SearchItem, 0, len(data.Items))
 						for _, x := range data.Items {
-							a := proto.ToSearchItem(&x)
-							log.Println("File", a.Filename, "size", a.Filesize, "sources", a.Sources, "complete sources", a.CompleteSources)
+							items = append(items, proto.ToSearchItem(&x))
+						}
+
+						query := ""
+						if s.search != nil {
+							query = s.search.Query
+							s.search.complete(items)
+							s.search = nil
 						}
+
+						s.events.publish(SearchResultEvent{Query: query, Items: items})
 					case *proto.FoundFileSources:
 						log.Printf("session found file sources %d\n", data.Size())
+						s.events.publish(SourcesFoundEvent{Hash: data.Hash, Sources: data.Sources})
 						transfer, ok := s.transfers[data.Hash]
 						if ok {
 							log.Printf("Got sources for %s\n", data.Hash)
@@ -320,8 +414,45 @@ func (s *Session) Tick() {
 						}
 					case *proto.ByteContainer:
 						log.Println("Message from server", string(*data))
+						s.events.publish(ServerMessageEvent{Message: string(*data)})
 					case *proto.Status:
 						log.Printf("Server status[users: %d, files:%d]\n", data.UsersCount, data.FilesCount)
+						s.events.publish(ServerStatusEvent{UsersCount: data.UsersCount, FilesCount: data.FilesCount})
+						if s.serverConnection != nil {
+							s.serverConnection.Info.UsersCount = data.UsersCount
+							s.serverConnection.Info.FilesCount = data.FilesCount
+							s.serverList.Add(proto.ServerInfo{Point: s.serverConnection.endpoint, UsersCount: data.UsersCount, FilesCount: data.FilesCount})
+						}
+					case *proto.IdChange:
+						log.Printf("Server login: client id %d low id %v, compression %v unicode %v large files %v obfuscation %v\n",
+							data.ClientId, data.IsLowId(), data.SupportsCompression(), data.SupportsUnicode(), data.SupportsLargeFiles(), data.SupportsObfuscation())
+						atomic.StoreUint32(&s.ClientId, data.ClientId)
+						if s.serverConnection != nil {
+							s.serverConnection.IdChange = *data
+							lowId := data.IsLowId()
+							s.events.publish(ServerConnectedEvent{Endpoint: s.serverConnection.endpoint, ClientId: data.ClientId, LowId: lowId})
+							s.serverManager.LoggedIn(s.serverConnection.endpoint, lowId)
+							if lowId && s.serverManager.AutoConnect && s.serverManager.HasHighIdCandidate(&s.serverList, time.Now()) {
+								log.Printf("Server %s gave low id, try another server\n", s.serverConnection.endpoint.ToString())
+								s.closeServerConnection(SERVER_LEAVE_LOWID)
+							}
+						}
+					case *proto.ServerListAnswer:
+						for _, x := range data.Servers {
+							if s.serverList.AddEndpoint(x) {
+								log.Printf("Server %s added to server list\n", x.ToString())
+							}
+						}
+					case *proto.ServerInfo:
+						log.Printf("Server info name: %s description: %s\n", data.Name, data.Description)
+						if s.serverConnection != nil {
+							info := *data
+							info.Point = s.serverConnection.endpoint
+							info.UsersCount = s.serverConnection.Info.UsersCount
+							info.FilesCount = s.serverConnection.Info.FilesCount
+							s.serverConnection.Info = info
+							s.serverList.Add(info)
+						}
 					default:
 						log.Println("session: unknown server packet received")
 					}
@@ -330,12 +461,19 @@ func (s *Session) Tick() {
 		case statPacket := <-s.statReceiveChan:
 			statPacket.Connection.Stat.ReceiveBytes(statPacket.Counter)
 			s.Stat.ReceiveBytes(statPacket.Counter)
+			if statPacket.UserHash != proto.ZERO {
+				s.credit(statPacket.UserHash).Downloaded += uint64(statPacket.Counter)
+			}
 			if statPacket.Connection.transfer != nil {
 				statPacket.Connection.transfer.Stat.ReceiveBytes(statPacket.Counter)
 			}
 		case statPacket := <-s.statSendChan:
 			statPacket.Connection.Stat.SendBytes(statPacket.Counter)
 			s.Stat.SendBytes(statPacket.Counter)
+			s.uploadQueue.AddBytes(statPacket.Connection, statPacket.Counter)
+			if statPacket.UserHash != proto.ZERO {
+				s.credit(statPacket.UserHash).Uploaded += uint64(statPacket.Counter)
+			}
 			if statPacket.Connection.transfer != nil {
 				statPacket.Connection.transfer.Stat.SendBytes(statPacket.Counter)
 			}
@@ -361,12 +499,21 @@ func (s *Session) Tick() {
 					log.Printf("server connection no answer for a long time %v last send time %v - reconnect required",
 						s.serverConnection.LastReceivedTime, s.serverConnection.LastSendTime)
 					// no answer from server connection for a long time, reconnect
-					candidate = NewServerConnection(s.serverConnection.address)
-					s.serverConnection.DisconnectRequested = true
-					go s.serverConnection.Close()
+					if !s.serverManager.AutoConnect {
+						candidate = NewServerConnection(s.serverConnection.address)
+					}
+					s.closeServerConnection(SERVER_LEAVE_TIMEOUT)
+				}
+			} else if candidate == nil && !stopped && s.serverManager.AutoConnect {
+				if ep, ok := s.serverManager.NextCandidate(&s.serverList, currentTime); ok {
+					log.Printf("Auto connect to server %s\n", ep.ToString())
+					s.serverConnection = NewServerConnection(ep.ToString())
+					go s.serverConnection.Start(s)
 				}
 			}
 
+			s.publishFiles()
+
 			// enumerate transfer to get new peers
 			stepsSinceLastConnect := 0
 			connectionsReserve := s.configuration.MaxConnectsPerSecond
@@ -375,9 +522,13 @@ func (s *Session) Tick() {
 				for enumerateCandidates {
 					for _, transfer := range s.transfers {
 						if transfer.WantMoreSources(currentTime) {
-							if s.serverConnection != nil && s.serverConnection.Connected {
-								req := proto.GetFileSources{Hash: transfer.Hash}
-								go s.serverConnection.SendPacket(&req)
+							if s.serverConnection != nil && s.serverConnection.LoggedIn() {
+								req := proto.GetFileSources{Hash: transfer.Hash, Filesize: transfer.Size}
+								if req.IsLarge() && !s.serverConnection.IdChange.SupportsLargeFiles() {
+									log.Printf("Server does not support large files, skip sources request for %s\n", transfer.Hash.ToString())
+								} else {
+									go s.serverConnection.SendPacket(&req)
+								}
 								// request next time in one minute
 								transfer.RequestSourcesNextTime = time.Now().Add(time.Minute * time.Duration(1))
 							}
@@ -432,6 +583,25 @@ func (s *Session) Tick() {
 
 			lastTick = currentTime
 
+			s.uploadQueue.MaxSlots = UploadSlotsCount(s.configuration.MaxUploadRate, s.configuration.MaxUploadSlots)
+			rotated, accepted := s.uploadQueue.Tick(currentTime)
+			for _, x := range rotated {
+				log.Printf("upload slot of %s expired\n", x.Endpoint.ToString())
+				go x.SendPacket(s, proto.OP_EDONKEYPROT, proto.OP_OUTOFPARTREQS, nil)
+			}
+
+			for _, x := range accepted {
+				log.Printf("upload slot given to %s\n", x.Endpoint.ToString())
+				go x.SendPacket(s, proto.OP_EDONKEYPROT, proto.OP_ACCEPTUPLOADREQ, nil)
+			}
+
+			s.resumeData.Tick(currentTime)
+
+			if s.serverList.dirty && currentTime.After(lastServerListSave.Add(SERVER_LIST_SAVE_INTERVAL)) {
+				s.saveServerList()
+				lastServerListSave = currentTime
+			}
+
 		case peerConnection := <-s.registerPeerConnection:
 			fmt.Printf("register peer connection %s", peerConnection.Endpoint.ToString())
 			if peerConnection.DisconnectLater {
@@ -439,14 +609,23 @@ func (s *Session) Tick() {
 			}
 			peerConnection.Connected = true
 			s.peerConnections[peerConnection.Endpoint] = peerConnection
+			event := PeerConnectedEvent{Endpoint: peerConnection.Endpoint}
+			if peerConnection.transfer != nil {
+				event.Hash = peerConnection.transfer.Hash
+			}
+			s.events.publish(event)
 			if peerConnection.transfer == nil {
 				//looking for corresponding transfer
 				// policy - newConnection
 				//peerConnection.transfer.
 			}
+		case packet := <-s.peerInfoChan:
+			packet.Connection.info = packet.Info
 		case peerConnectionPacket := <-s.unregisterPeerConnection:
 			log.Printf("unregister peer connection, peer %v", peerConnectionPacket.Connection.peer)
 			delete(s.peerConnections, peerConnectionPacket.Connection.Endpoint)
+			s.events.publish(PeerDisconnectedEvent{Endpoint: peerConnectionPacket.Connection.Endpoint, Err: peerConnectionPacket.Error})
+			s.uploadQueue.Disconnected(peerConnectionPacket.Connection, time.Now())
 
 			if peerConnectionPacket.Connection.peer != nil {
 				peerConnectionPacket.Connection.peer.peerConnection = nil
@@ -455,11 +634,22 @@ func (s *Session) Tick() {
 				if !peerConnectionPacket.Connection.closedByRequest && peerConnectionPacket.Error != nil {
 					peerConnectionPacket.Connection.peer.FailCount += 1
 				}
+
+				if errors.Is(peerConnectionPacket.Error, ErrInvalidHashSet) && peerConnectionPacket.Connection.transfer != nil {
+					peerConnectionPacket.Connection.peer.FailCount = MAX_PEER_FAIL_COUNT + 1
+					s.events.publish(HashSetRejectedEvent{Hash: peerConnectionPacket.Connection.transfer.Hash, Endpoint: peerConnectionPacket.Connection.Endpoint, Err: peerConnectionPacket.Error})
+				}
 			}
 
+			transfer := peerConnectionPacket.Connection.transfer
 			peerConnectionPacket.Connection.transfer = nil
 			peerConnectionPacket.Connection.peer = nil
 
+			// removed transfer is stopped after its last connection was closed
+			if transfer != nil && transfer.Stopped && !stopped && !s.hasTransferConnections(transfer) {
+				s.stopTransfer(transfer)
+			}
+
 			if stopped && len(s.peerConnections) == 0 {
 				if len(s.transfers) == 0 {
 					execute = false
@@ -467,29 +657,48 @@ func (s *Session) Tick() {
 				}
 
 				for _, x := range s.transfers {
-					go x.Stop()
+					s.stopTransfer(x)
 				}
 			}
 		case transfer := <-s.transferChanFinished:
 			transfer.Finished = true
+			s.flushResumeData(transfer.Hash)
+			s.events.publish(TransferFinishedEvent{Hash: transfer.Hash})
 			for _, x := range s.peerConnections {
 				if x.transfer == transfer {
 					x.Close(true)
 				}
 			}
+		case transfer := <-s.transferChanUnfinished:
+			transfer.Finished = false
 		case transfer := <-s.transferChanPaused:
-			transfer.Paused = true
-		// close all transfer's peers
+			s.flushResumeData(transfer.Hash)
+			// transfer could be resumed while its goroutine was saving resume data
+			if transfer.Paused {
+				s.events.publish(TransferPausedEvent{Hash: transfer.Hash})
+			}
 		case transfer := <-s.transferChanResumeDataRead:
 			transfer.ReadingResumeData = false
 		case atp := <-s.transferResumeData:
-			log.Println("Save resume data", atp.Filename.ToString())
-			s.saveResumeData(atp)
+			// transfer in memory has nothing to restore after restart and to upload from
+			if transfer, ok := s.transfers[atp.Hashes.Hash]; ok && transfer.StorageMode == STORAGE_MEMORY {
+				break
+			}
+
+			s.resumeData.Update(atp)
+			s.updateSharedFile(&atp)
 		case te := <-s.transferChanError:
 			te.transfer.LastError = te.err
 			log.Printf("Transfer %s error %v\n", te.transfer.Hash.ToString(), te.err)
+			s.events.publish(TransferErrorEvent{Hash: te.transfer.Hash, Err: te.err})
 		case transfer := <-s.transferChanClosed:
 			delete(s.transfers, transfer.Hash)
+			if transfer.deleteData {
+				s.deleteTransferData(transfer)
+			} else {
+				s.flushResumeData(transfer.Hash)
+			}
+			s.events.publish(TransferRemovedEvent{Hash: transfer.Hash})
 			log.Println("close transfer transfers", len(s.transfers), "peers ", len(s.peerConnections))
 			if stopped && len(s.peerConnections) == 0 && len(s.transfers) == 0 {
 				execute = false
@@ -498,8 +707,20 @@ func (s *Session) Tick() {
 		}
 	}
 
-	e = s.listener.Close()
-	if e != nil {
+	if s.search != nil {
+		s.search.cancel()
+		s.search = nil
+	}
+
+	if s.serverList.dirty {
+		s.saveServerList()
+	}
+
+	// transfers are closed and do not send write jobs anymore
+	s.disk.Close()
+	s.resumeData.FlushAll(time.Now())
+
+	if e := s.listener.Close(); e != nil {
 		log.Printf("Listener stop error %v\n", e)
 	}
 
@@ -507,42 +728,468 @@ func (s *Session) Tick() {
 }
 
 func (s *Session) Start() {
-	go s.Tick()
+	go s.tick()
+	if s.configuration.StreamAddress != "" {
+		s.streamServer = NewStreamServer(s, s.configuration.StreamAddress)
+		if err := s.streamServer.Start(); err != nil {
+			log.Printf("can not start stream server on %s: %v\n", s.configuration.StreamAddress, err)
+			s.streamServer = nil
+		}
+	}
 }
 
 func (s *Session) Stop() {
 	log.Println("Session stop requested")
-	s.comm <- "stop"
-	s.wg.Wait()
+	if s.streamServer != nil {
+		s.streamServer.Close()
+	}
+	if s.command(sessionCommand{action: sessionCommandStop}) == nil {
+		<-s.done
+	}
+}
+
+// command passes command to the session goroutine, returns error when session was stopped
+func (s *Session) command(cmd sessionCommand) error {
+	select {
+	case s.comm <- cmd:
+		return nil
+	case <-s.done:
+		return ErrSessionClosed
+	}
 }
 
-func (s *Session) accept(listener *net.Listener) {
+func (s *Session) accept(listener net.Listener) {
 	log.Println("Session listener started")
 	for {
-		conn, e := (*listener).Accept()
+		conn, e := listener.Accept()
 		if e != nil {
 			log.Printf("Accepting error %v\n", e)
 			break
 		} else {
-			pc := PeerConnection{connection: conn}
-			go pc.Start(s)
-			s.registerPeerConnection <- &pc
+			pc := NewPeerConnection(proto.EndpointFromString(conn.RemoteAddr().String()), nil, nil)
+			pc.connection = conn
+			select {
+			case s.registerPeerConnection <- pc:
+				go pc.Start(s)
+			case <-s.done:
+				conn.Close()
+				return
+			}
 		}
 	}
 }
 
-func (s *Session) Search(keyword string) {
-	s.comm <- "search " + keyword
+// GetServerList requests list of servers from the current server
+func (s *Session) GetServerList() error {
+	return s.command(sessionCommand{action: sessionCommandServerList})
 }
 
-func (s *Session) GetServerList() {
-	s.comm <- "serverlist"
+// AddLink adds transfer for the ed2k file link or connects to the server from the ed2k server link
+func (s *Session) AddLink(link string) error {
+	l, err := proto.ParseEMuleLink(link)
+	if err != nil {
+		return err
+	}
+
+	switch l.Type {
+	case proto.LINK_FILE:
+		select {
+		case s.addLinkChan <- l:
+		case <-s.done:
+			return ErrSessionClosed
+		}
+	case proto.LINK_SERVER:
+		return s.Connect(l.Address())
+	case proto.LINK_SERVERLIST:
+		go func() {
+			if err := s.downloadServerMet(l.Url); err != nil {
+				log.Printf("can not download server list %s: %v\n", l.Url, err)
+			}
+		}()
+	default:
+		return fmt.Errorf("link type %d is not supported", l.Type)
+	}
+
+	return nil
 }
 
-func (s *Session) CreateHelloAnswer() proto.HelloAnswer {
+// downloadServerMet adds servers from list downloaded by link, list is dropped when session was stopped
+func (s *Session) downloadServerMet(url string) error {
+	client := http.Client{Timeout: SERVER_MET_DOWNLOAD_TIMEOUT}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, SERVER_MET_MAX_SIZE+1))
+	if err != nil {
+		return err
+	}
+
+	if len(data) > SERVER_MET_MAX_SIZE {
+		return fmt.Errorf("server list is larger than %d bytes", SERVER_MET_MAX_SIZE)
+	}
+
+	sm := proto.ServerMet{}
+	sb := proto.StateBuffer{Data: data}
+	sb.Read(&sm)
+	if sb.Error() != nil {
+		return sb.Error()
+	}
+
+	select {
+	case s.addServersChan <- sm.Servers:
+		return nil
+	case <-s.done:
+		return ErrSessionClosed
+	}
+}
+
+func (s *Session) saveServerList() {
+	if s.configuration.ServerMetFile == "" {
+		return
+	}
+
+	if err := s.serverList.Save(s.configuration.ServerMetFile); err != nil {
+		log.Printf("can not save server list to %s: %v\n", s.configuration.ServerMetFile, err)
+	}
+}
+
+func (s *Session) addFileLink(link proto.EMuleLink) {
+	params := TransferParams{Hash: link.Hash, Size: link.Size, Filename: link.Name, PieceHashes: link.PieceHashes, Sources: link.Sources, link: true}
+	atp, err := params.AddTransferParameters(s.configuration.IncomingDir)
+	if err != nil {
+		log.Printf("can not add transfer from link: %v\n", err)
+		return
+	}
+
+	if err := s.addTransfer(&atp, link.Sources, PEER_SRC_LINK, STORAGE_SPARSE); err != nil {
+		log.Printf("can not add transfer from link: %v\n", err)
+	}
+}
+
+// addTransfer starts new transfer or adds sources to the existing one, storage mode of the existing transfer is kept
+func (s *Session) addTransfer(atp *proto.AddTransferParameters, sources []proto.Endpoint, sourceFlag byte, storageMode StorageMode) error {
+	transfer, ok := s.transfers[atp.Hashes.Hash]
+	if ok && transfer.Stopped {
+		return fmt.Errorf("transfer %s is being removed", atp.Hashes.Hash.ToString())
+	}
+
+	if !ok {
+		log.Printf("add transfer %s to file %s\n", atp.Hashes.Hash.ToString(), atp.Filename.ToString())
+		transfer = NewTransfer(atp.Hashes.Hash, atp.Filename.ToString(), atp.Filesize)
+		transfer.Paused = atp.Paused
+		transfer.StorageMode = storageMode
+		atp.Storage = byte(storageMode)
+		s.transfers[atp.Hashes.Hash] = transfer
+		if storageMode != STORAGE_MEMORY {
+			s.updateSharedFile(atp)
+		}
+		s.events.publish(TransferAddedEvent{Hash: transfer.Hash, Filename: transfer.Filename, Size: transfer.Size})
+		if atp.WantMoreData() {
+			go transfer.Start(s, atp)
+		} else {
+			transfer.seeding = true
+			go transfer.StartFinished(s, atp)
+		}
+	}
+
+	for _, x := range sources {
+		if transfer.policy.AddPeer(&Peer{SourceFlag: sourceFlag, endpoint: x}) {
+			log.Printf("Transfer %s added source %s\n", atp.Hashes.Hash.ToString(), x.ToString())
+		}
+	}
+
+	return nil
+}
+
+// transferAction executes request of the transfer handle
+func (s *Session) transferAction(req transferRequest) error {
+	transfer, ok := s.transfers[req.hash]
+	if !ok || transfer.Stopped {
+		return fmt.Errorf("transfer %s not found", req.hash.ToString())
+	}
+
+	switch req.action {
+	case transferActionPause:
+		if transfer.Paused {
+			break
+		}
+
+		log.Printf("pause transfer %s\n", transfer.Hash.ToString())
+		transfer.Paused = true
+		s.closeTransferConnections(transfer)
+		transfer.setPaused(true)
+	case transferActionResume:
+		if !transfer.Paused {
+			break
+		}
+
+		log.Printf("resume transfer %s\n", transfer.Hash.ToString())
+		transfer.Paused = false
+		// request sources on the next tick
+		transfer.RequestSourcesNextTime = time.Time{}
+		transfer.setPaused(false)
+		s.events.publish(TransferResumedEvent{Hash: transfer.Hash})
+	case transferActionRemove:
+		log.Printf("remove transfer %s delete data %v\n", transfer.Hash.ToString(), req.deleteData)
+		transfer.Stopped = true
+		transfer.deleteData = req.deleteData
+		delete(s.sharedFiles, transfer.Hash)
+		delete(s.offeredFiles, transfer.Hash)
+		if !s.closeTransferConnections(transfer) {
+			s.stopTransfer(transfer)
+		}
+	case transferActionPriority:
+		if transfer.seeding {
+			return fmt.Errorf("transfer %s is complete", transfer.Hash.ToString())
+		}
+		transfer.SetPriority(req.begin, req.end, req.priority)
+	case transferActionStrategy:
+		if transfer.seeding {
+			return fmt.Errorf("transfer %s is complete", transfer.Hash.ToString())
+		}
+		transfer.SetPickStrategy(req.strategy)
+	case transferActionBoost:
+		if transfer.seeding {
+			return fmt.Errorf("transfer %s is complete", transfer.Hash.ToString())
+		}
+		transfer.boostRange(req.begin, req.end, req.boost)
+	case transferActionRecheck:
+		if transfer.seeding {
+			return fmt.Errorf("transfer %s is complete", transfer.Hash.ToString())
+		}
+
+		log.Printf("recheck transfer %s\n", transfer.Hash.ToString())
+		s.closeTransferConnections(transfer)
+		go transfer.Recheck()
+	}
+
+	return nil
+}
+
+// deleteTransferData removes data and resume data of the closed transfer, transfer sends no resume data after close
+func (s *Session) deleteTransferData(transfer *Transfer) {
+	s.resumeData.Discard(transfer.Hash)
+	files := []string{s.resumeData.Filename(transfer.Hash)}
+	if transfer.storage != nil {
+		if err := transfer.storage.Remove(); err != nil {
+			log.Printf("can not remove data of %s: %v\n", transfer.Filename, err)
+		}
+	} else if transfer.StorageMode != STORAGE_MEMORY {
+		// seeding transfer has no storage
+		files = append(files, transfer.Filename)
+	}
+
+	for _, x := range files {
+		if err := os.Remove(x); err != nil && !os.IsNotExist(err) {
+			log.Printf("can not remove file %s: %v\n", x, err)
+		}
+	}
+}
+
+// stopTransfer closes transfer goroutine, transfer could be stopped by remove and by session stop
+func (s *Session) stopTransfer(transfer *Transfer) {
+	if !transfer.stopped {
+		transfer.stopped = true
+		go transfer.Stop()
+	}
+}
+
+func (s *Session) hasTransferConnections(transfer *Transfer) bool {
+	for _, x := range s.peerConnections {
+		if x.transfer == transfer {
+			return true
+		}
+	}
+
+	return false
+}
+
+// closeTransferConnections closes peer connections of the transfer, returns false when transfer has no connections
+func (s *Session) closeTransferConnections(transfer *Transfer) bool {
+	res := false
+	for _, x := range s.peerConnections {
+		if x.transfer == transfer {
+			go x.Close(true)
+			res = true
+		}
+	}
+
+	return res
+}
+
+// updateSharedFile makes transfer available for upload as soon as it has verified pieces and valid hash set
+func (s *Session) updateSharedFile(atp *proto.AddTransferParameters) {
+	if sf := FromAddTransferParameters(atp); sf != nil {
+		if x, ok := s.sharedFiles[sf.Hash]; ok {
+			sf.Priority = x.Priority
+			if !x.Complete() && sf.Complete() {
+				// offer file again to the server as complete source
+				delete(s.offeredFiles, sf.Hash)
+			}
+		} else {
+			log.Printf("share file %s %s pieces %d of %d\n", sf.Hash.ToString(), sf.Filename, sf.Pieces.Count(), sf.Pieces.Bits())
+		}
+		s.sharedFiles[sf.Hash] = sf
+	}
+}
+
+// publishFiles offers not yet published shared files to the current server
+func (s *Session) publishFiles() {
+	if s.serverConnection == nil || !s.serverConnection.LoggedIn() || len(s.offeredFiles) >= OfferLimit(s.serverConnection.Info) {
+		return
+	}
+
+	offer := CreateOffer(s.sharedFiles, s.offeredFiles, s.serverConnection.Info, s.serverConnection.IdChange, s.configuration.ListenPort)
+	if len(offer.Files) == 0 {
+		return
+	}
+
+	for _, x := range offer.Files {
+		s.offeredFiles[x.Hash] = true
+	}
+
+	log.Printf("offer %d files to server, total offered %d\n", len(offer.Files), len(s.offeredFiles))
+	go s.serverConnection.SendPacket(&offer)
+}
+
+// updateLibrary shares files found by the library scan, removed files are not shared and are offered again when they come back
+func (s *Session) updateLibrary(files []*SharedFile) {
+	current := make(map[proto.ED2KHash]bool)
+	for _, x := range files {
+		current[x.Hash] = true
+		if _, ok := s.sharedFiles[x.Hash]; !ok {
+			s.sharedFiles[x.Hash] = x
+		}
+	}
+
+	for x := range s.libraryFiles {
+		if !current[x] {
+			delete(s.sharedFiles, x)
+			delete(s.offeredFiles, x)
+		}
+	}
+
+	s.libraryFiles = current
+}
+
+// rescanLibrary starts scanning of the shared directories unless it is already running
+func (s *Session) rescanLibrary() {
+	if s.libraryScanning || len(s.configuration.SharedDirs) == 0 {
+		return
+	}
+
+	exclude := make(map[string]bool)
+	for _, x := range s.transfers {
+		exclude[x.Filename] = true
+	}
+
+	s.libraryScanning = true
+	go s.scanLibrary(s.configuration.SharedDirs, s.configuration.KnownMetFile, exclude)
+}
+
+func (s *Session) scanLibrary(dirs []string, knownMetFile string, exclude map[string]bool) {
+	library := MakeLibrary()
+	if knownMetFile != "" {
+		if err := library.LoadKnown(knownMetFile); err != nil && !os.IsNotExist(err) {
+			log.Printf("can not load known files from %s: %v\n", knownMetFile, err)
+		}
+	}
+
+	files := library.Scan(dirs, exclude)
+	if knownMetFile != "" && library.dirty {
+		if err := library.SaveKnown(knownMetFile); err != nil {
+			log.Printf("can not save known files to %s: %v\n", knownMetFile, err)
+		}
+	}
+
+	s.libraryChan <- files
+}
+
+// Rescan requests scanning of the shared directories
+func (s *Session) Rescan() error {
+	return s.command(sessionCommand{action: sessionCommandRescan})
+}
+
+func (s *Session) credit(userHash proto.ED2KHash) *ClientCredit {
+	cc, ok := s.credits[userHash]
+	if !ok {
+		cc = &ClientCredit{}
+		s.credits[userHash] = cc
+	}
+
+	return cc
+}
+
+// requestUploadSlot returns 0 when upload slot was given, position in the upload queue or -1 when queue is full
+func (s *Session) requestUploadSlot(connection *PeerConnection, hash proto.ED2KHash) int {
+	res := make(chan int, 1)
+	s.uploadSlotRequest <- uploadSlotRequest{connection: connection, userHash: connection.remoteHash, hash: hash, res: res}
+	return <-res
+}
+
+func (s *Session) hasUploadSlot(connection *PeerConnection) bool {
+	res := make(chan int, 1)
+	s.uploadSlotRequest <- uploadSlotRequest{connection: connection, checkOnly: true, res: res}
+	return <-res == 0
+}
+
+// UploadQueue returns current upload slots and waiting peers, queue is empty when session was stopped
+func (s *Session) UploadQueue() UploadQueueStatus {
+	res := make(chan UploadQueueStatus, 1)
+	select {
+	case s.uploadQueueStatus <- res:
+		return <-res
+	case <-s.done:
+		return UploadQueueStatus{}
+	}
+}
+
+// SetUploadPriority changes upload priority of the shared file
+func (s *Session) SetUploadPriority(hash proto.ED2KHash, priority int) error {
+	return s.command(sessionCommand{action: sessionCommandUploadPriority, hash: hash, priority: priority})
+}
+
+// getSharedFile returns copy of the shared file or nil, called from peer connections
+func (s *Session) getSharedFile(hash proto.ED2KHash) *SharedFile {
+	res := make(chan *SharedFile, 1)
+	s.sharedFileRequest <- sharedFileRequest{hash: hash, res: res}
+	return <-res
+}
+
+// getStreamFile returns copy of the shared file or file of the active transfer without verified pieces or nil
+func (s *Session) getStreamFile(hash proto.ED2KHash) *SharedFile {
+	res := make(chan *SharedFile, 1)
+	s.sharedFileRequest <- sharedFileRequest{hash: hash, transfers: true, res: res}
+	return <-res
+}
+
+func (s *Session) createLoginRequest() proto.UsualPacket {
+	var version uint32 = 0x3c
+	var versionClient uint32 = (proto.GED2K_VERSION_MAJOR << 24) | (proto.GED2K_VERSION_MINOR << 17) | (proto.GED2K_VERSION_TINY << 10) | (1 << 7)
+	var capability uint32 = proto.CAPABLE_AUXPORT | proto.CAPABLE_NEWTAGS | proto.CAPABLE_UNICODE | proto.CAPABLE_LARGEFILES | proto.CAPABLE_ZLIB
+
+	var login proto.UsualPacket
+	login.Hash = s.configuration.UserAgent
+	login.Point = proto.Endpoint{Ip: 0, Port: s.configuration.ListenPort}
+	login.Properties = append(login.Properties, proto.CreateTag(version, proto.CT_VERSION, ""))
+	login.Properties = append(login.Properties, proto.CreateTag(capability, proto.CT_SERVER_FLAGS, ""))
+	login.Properties = append(login.Properties, proto.CreateTag(s.configuration.ClientName, proto.CT_NAME, ""))
+	login.Properties = append(login.Properties, proto.CreateTag(versionClient, proto.CT_EMULE_VERSION, ""))
+	return login
+}
+
+func (s *Session) createHelloAnswer() proto.HelloAnswer {
 	hello := proto.HelloAnswer{}
 	hello.Hash = s.configuration.UserAgent
-	hello.Point.Ip = s.ClientId
+	// called from peer connections while session goroutine changes client id
+	hello.Point.Ip = atomic.LoadUint32(&s.ClientId)
 	hello.Point.Port = s.configuration.ListenPort
 
 	hello.Properties = append(hello.Properties, proto.CreateTag(s.configuration.ClientName, proto.CT_NAME, ""))
@@ -573,39 +1220,61 @@ func makeFullED2KVersion(clientId uint32, a uint32, b uint32, c uint32) uint32 {
 	return (clientId << 24) | (a << 17) | (b << 10) | (c << 7)
 }
 
-func (s *Session) Connect(address string) {
-	s.comm <- "connect " + address
+// Connect connects to the server, current server connection is closed
+func (s *Session) Connect(address string) error {
+	return s.command(sessionCommand{action: sessionCommandConnect, address: address})
 }
 
-func (s *Session) Disconnect() {
-	s.comm <- "disconnect"
+// AutoConnect enables connection to servers from the server list
+func (s *Session) AutoConnect() error {
+	return s.command(sessionCommand{action: sessionCommandAutoConnect})
 }
 
-func (s *Session) DiscardPacket() {
-	s.serverPackets <- nil
+// ServerStatus returns state of the server connection, status is empty when session was stopped
+func (s *Session) ServerStatus() ServerStatus {
+	res := make(chan ServerStatus, 1)
+	select {
+	case s.serverStatusRequest <- res:
+		return <-res
+	case <-s.done:
+		return ServerStatus{}
+	}
 }
 
-func (s *Session) Cmd(cmd string) {
-	s.comm <- cmd
+func (s *Session) serverStatus() ServerStatus {
+	status := s.serverManager.Status(s.serverConnection != nil && s.serverConnection.Connected)
+	if s.serverConnection != nil {
+		status.ClientId = s.serverConnection.IdChange.ClientId
+		status.TcpFlags = s.serverConnection.IdChange.TcpFlags
+		status.Info = s.serverConnection.Info
+	}
+
+	return status
 }
 
-func (s *Session) saveResumeData(parameters proto.AddTransferParameters) {
-	data := make([]byte, parameters.Size())
-	file, err := os.OpenFile(s.configuration.IncomingDir+"/"+parameters.Hashes.Hash.ToString()+".rd", os.O_WRONLY|os.O_CREATE, 0666)
-	if err != nil {
-		log.Printf("error on create resume data file: %v\n", err)
+func (s *Session) closeServerConnection(reason int) {
+	if s.serverConnection == nil {
 		return
 	}
 
-	defer file.Close()
-	sb := proto.StateBuffer{Data: data}
-	sb.Write(&parameters)
-	if sb.Error() != nil {
-		log.Printf("can not serialize resume data: %v\n", sb.Error())
+	if s.serverConnection.leaveReason == SERVER_LEAVE_NONE {
+		s.serverConnection.leaveReason = reason
 	}
 
-	_, err = file.Write(data)
-	if err != nil {
-		log.Printf("can not write data to file: %v\n", err)
+	if s.serverConnection.Connected && !s.serverConnection.DisconnectRequested {
+		go s.serverConnection.Close()
+	}
+	s.serverConnection.DisconnectRequested = true
+}
+
+// Disconnect closes server and peer connections and disables auto connect
+func (s *Session) Disconnect() error {
+	return s.command(sessionCommand{action: sessionCommandDisconnect})
+}
+
+// flushResumeData writes resume data of the transfer immediately on its state change
+func (s *Session) flushResumeData(hash proto.ED2KHash) {
+	if err := s.resumeData.Flush(hash); err != nil {
+		log.Printf("can not save resume data of %s: %v\n", hash.ToString(), err)
 	}
 }
@@ -1,14 +1,20 @@
-package main
+package ged2k
 
 import (
-	"github.com/a-pavlov/ged2k/proto"
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+
+	"github.com/a-pavlov/ged2k/proto"
 )
 
 func Test_HelloAnswer(t *testing.T) {
 	cfg := Config{ListenPort: 30000, Name: "TestGed2k", MaxConnections: 100, ClientName: "test"}
 	session := Session{configuration: cfg}
-	ha := session.CreateHelloAnswer()
+	ha := session.createHelloAnswer()
 	data := make([]byte, proto.DataSize(ha))
 	sb := proto.StateBuffer{Data: data}
 	sb.Write(ha)
@@ -23,3 +29,105 @@ func Test_HelloAnswer(t *testing.T) {
 		}
 	}
 }
+
+func Test_LoginRequest(t *testing.T) {
+	cfg := Config{ListenPort: 30000, UserAgent: proto.EMULE, ClientName: "test"}
+	session := Session{configuration: cfg}
+	login := session.createLoginRequest()
+	if login.Hash != proto.EMULE || login.Point.Port != 30000 || login.Point.Ip != 0 {
+		t.Errorf("Login request header incorrect %v", login)
+	}
+
+	var flags uint32
+	for _, x := range login.Properties {
+		if x.Id == proto.CT_SERVER_FLAGS {
+			flags = x.AsUint32()
+		}
+	}
+
+	if (flags&proto.CAPABLE_LARGEFILES) == 0 || (flags&proto.CAPABLE_ZLIB) == 0 || (flags&proto.CAPABLE_UNICODE) == 0 {
+		t.Errorf("Login request capabilities incorrect %x", flags)
+	}
+}
+
+func Test_SessionClosed(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+	if _, err = NewSession(Config{IncomingDir: t.TempDir(), ListenPort: uint16(l.Addr().(*net.TCPAddr).Port)}); err == nil {
+		t.Error("Session was created on the busy port")
+	}
+
+	s, err := NewSession(Config{IncomingDir: t.TempDir(), UserAgent: proto.EMULE})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Start()
+	s.Stop()
+	// requests after stop do not block
+	s.Stop()
+	if _, err = s.AddTransfer(TransferParams{Hash: proto.EMULE, Size: 100, Filename: "a.bin"}); err != ErrSessionClosed {
+		t.Errorf("Transfer was added to the stopped session %v", err)
+	}
+
+	if s.Transfer(proto.EMULE) != nil || s.Connect("127.0.0.1:4661") != ErrSessionClosed || s.Rescan() != ErrSessionClosed {
+		t.Error("Stopped session accepted request")
+	}
+
+	if _, err = s.Search("abc"); err != ErrSessionClosed {
+		t.Errorf("Search was started by the stopped session %v", err)
+	}
+
+	if th := (&TransferHandle{hash: proto.EMULE, session: s}); th.Pause() != ErrSessionClosed {
+		t.Error("Transfer handle of the stopped session was paused")
+	}
+
+	if len(s.Status().Transfers) != 0 || s.AddLink("ed2k://|file|a.bin|100|31D6CFE0D16AE931B73C59D7E0C089C0|/") != ErrSessionClosed {
+		t.Error("Stopped session returned status or accepted link")
+	}
+}
+
+func Test_DownloadServerMet(t *testing.T) {
+	sm := proto.ServerMet{Header: proto.MET_HEADER, Servers: []proto.ServerInfo{{Point: proto.EndpointFromString("176.123.5.89:4725"), Name: "eMule Security"}}}
+	data := make([]byte, sm.Size())
+	sb := proto.StateBuffer{Data: data}
+	if sb.Write(sm); sb.Error() != nil {
+		t.Fatal(sb.Error())
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/server.met":
+			w.Write(data)
+		case "/large.met":
+			w.Write(append(data, bytes.Repeat([]byte{0}, SERVER_MET_MAX_SIZE)...))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	s, err := NewSession(Config{IncomingDir: t.TempDir(), UserAgent: proto.EMULE})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Start()
+	if err = s.downloadServerMet(server.URL + "/server.met"); err != nil {
+		t.Errorf("Server list was not added %v", err)
+	}
+
+	if s.downloadServerMet(server.URL+"/large.met") == nil || s.downloadServerMet(server.URL+"/missing.met") == nil {
+		t.Error("Oversized or missing server list was accepted")
+	}
+
+	// downloaded list does not block after stop
+	s.Stop()
+	if err = s.downloadServerMet(server.URL + "/server.met"); !errors.Is(err, ErrSessionClosed) {
+		t.Errorf("Server list was added to the stopped session %v", err)
+	}
+}
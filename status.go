@@ -0,0 +1,285 @@
+package ged2k
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/a-pavlov/ged2k/proto"
+)
+
+const (
+	PIECE_STATE_NONE = iota
+	PIECE_STATE_DOWNLOADING
+	PIECE_STATE_VERIFIED
+)
+
+// ETA_UNKNOWN is reported when transfer wants more data and nothing is downloaded now
+const ETA_UNKNOWN time.Duration = -1
+
+type PieceStatus struct {
+	State          int
+	Priority       byte
+	Availability   int
+	Blocks         int
+	BlocksFinished int
+}
+
+// TransferSummary is the part of the transfer state owned by the session
+type TransferSummary struct {
+	Hash         proto.ED2KHash
+	Filename     string
+	Size         uint64
+	Paused       bool
+	Finished     bool
+	Seeding      bool
+	Error        error
+	DownloadRate int
+	UploadRate   int
+	Peers        int
+}
+
+// TransferStatus is a snapshot of the transfer, it is not changed after return
+type TransferStatus struct {
+	TransferSummary
+	Strategy        string
+	DownloadedBytes uint64
+	VerifiedBytes   uint64
+	WantedBytes     uint64
+	ETA             time.Duration
+	Pieces          []PieceStatus
+}
+
+// PeerStatus is a snapshot of the peer connection of the transfer
+type PeerStatus struct {
+	Endpoint      proto.Endpoint
+	UserHash      proto.ED2KHash
+	ClientName    string
+	ClientVersion uint32
+	ModName       string
+	SourceFlag    byte
+	DownloadRate  int
+	UploadRate    int
+	Requests      []proto.PieceBlock
+}
+
+// SessionStatus is a snapshot of the session, transfers are ordered by filename
+type SessionStatus struct {
+	Server          ServerStatus
+	Transfers       []TransferSummary
+	PeerConnections int
+	SharedFiles     int
+	DownloadRate    int
+	UploadRate      int
+	UploadQueue     UploadQueueStatus
+}
+
+// transferPieces is the part of the transfer state owned by the transfer goroutine
+type transferPieces struct {
+	strategy   string
+	downloaded uint64
+	verified   uint64
+	wanted     uint64
+	remaining  uint64
+	pieces     []PieceStatus
+	requests   map[proto.Endpoint][]proto.PieceBlock
+}
+
+type transferStatusRequest struct {
+	hash proto.ED2KHash
+	res  chan transferStatusAnswer
+}
+
+type transferStatusAnswer struct {
+	transfer *Transfer
+	summary  TransferSummary
+	peers    []PeerStatus
+	err      error
+}
+
+// Status returns snapshot of the session state, status is empty when session was stopped
+func (s *Session) Status() SessionStatus {
+	res := make(chan SessionStatus, 1)
+	select {
+	case s.sessionStatusRequest <- res:
+		return <-res
+	case <-s.done:
+		return SessionStatus{}
+	}
+}
+
+func (s *Session) status() SessionStatus {
+	res := SessionStatus{
+		Server:          s.serverStatus(),
+		Transfers:       make([]TransferSummary, 0, len(s.transfers)),
+		PeerConnections: len(s.peerConnections),
+		SharedFiles:     len(s.sharedFiles),
+		DownloadRate:    s.Stat.DownloadRate(),
+		UploadRate:      s.Stat.UploadRate(),
+		UploadQueue:     s.uploadQueue.Status(time.Now()),
+	}
+
+	for _, x := range s.transfers {
+		if !x.Stopped {
+			res.Transfers = append(res.Transfers, s.transferSummary(x))
+		}
+	}
+
+	sort.Slice(res.Transfers, func(i, j int) bool { return res.Transfers[i].Filename < res.Transfers[j].Filename })
+	return res
+}
+
+func (s *Session) transferSummary(transfer *Transfer) TransferSummary {
+	return TransferSummary{
+		Hash:         transfer.Hash,
+		Filename:     transfer.Filename,
+		Size:         transfer.Size,
+		Paused:       transfer.Paused,
+		Finished:     transfer.Finished,
+		Seeding:      transfer.seeding,
+		Error:        transfer.LastError,
+		DownloadRate: transfer.Stat.DownloadRate(),
+		UploadRate:   transfer.Stat.UploadRate(),
+		Peers:        len(s.transferPeers(transfer)),
+	}
+}
+
+// transferPeers returns peer connections of the transfer without requested blocks, ordered by endpoint
+func (s *Session) transferPeers(transfer *Transfer) []PeerStatus {
+	res := []PeerStatus{}
+	for _, x := range s.peerConnections {
+		if x.transfer != transfer {
+			continue
+		}
+
+		ps := PeerStatus{
+			Endpoint:      x.Endpoint,
+			UserHash:      x.info.UserHash,
+			ClientName:    x.info.ClientName,
+			ClientVersion: x.info.ClientVersion,
+			ModName:       x.info.ModName,
+			DownloadRate:  x.Stat.DownloadRate(),
+			UploadRate:    x.Stat.UploadRate(),
+		}
+
+		if x.peer != nil {
+			ps.SourceFlag = x.peer.SourceFlag
+		}
+
+		res = append(res, ps)
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].Endpoint.ToString() < res[j].Endpoint.ToString() })
+	return res
+}
+
+func (s *Session) transferStatus(hash proto.ED2KHash) transferStatusAnswer {
+	transfer, ok := s.transfers[hash]
+	if !ok || transfer.Stopped {
+		return transferStatusAnswer{err: fmt.Errorf("transfer %s not found", hash.ToString())}
+	}
+
+	return transferStatusAnswer{transfer: transfer, summary: s.transferSummary(transfer), peers: s.transferPeers(transfer)}
+}
+
+// status collects state of the session and of the transfer goroutine, both are copies
+func (th *TransferHandle) status() (transferStatusAnswer, transferPieces, error) {
+	res := make(chan transferStatusAnswer, 1)
+	select {
+	case th.session.transferStatusRequest <- transferStatusRequest{hash: th.hash, res: res}:
+	case <-th.session.done:
+		return transferStatusAnswer{}, transferPieces{}, ErrSessionClosed
+	}
+
+	answer := <-res
+	if answer.err != nil {
+		return answer, transferPieces{}, answer.err
+	}
+
+	pieces, err := answer.transfer.piecesStatus()
+	return answer, pieces, err
+}
+
+// Status returns snapshot of the transfer with pieces state and rates
+func (th *TransferHandle) Status() (TransferStatus, error) {
+	answer, pieces, err := th.status()
+	if err != nil {
+		return TransferStatus{}, err
+	}
+
+	res := TransferStatus{
+		TransferSummary: answer.summary,
+		Strategy:        pieces.strategy,
+		DownloadedBytes: pieces.downloaded,
+		VerifiedBytes:   pieces.verified,
+		WantedBytes:     pieces.wanted,
+		Pieces:          pieces.pieces,
+	}
+
+	switch {
+	case pieces.remaining == 0:
+		res.ETA = 0
+	case res.DownloadRate == 0:
+		res.ETA = ETA_UNKNOWN
+	default:
+		res.ETA = time.Duration(pieces.remaining/uint64(res.DownloadRate)) * time.Second
+	}
+
+	return res, nil
+}
+
+// Peers returns connected peers of the transfer with blocks requested from them
+func (th *TransferHandle) Peers() ([]PeerStatus, error) {
+	answer, pieces, err := th.status()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range answer.peers {
+		answer.peers[i].Requests = pieces.requests[answer.peers[i].Endpoint]
+	}
+
+	return answer.peers, nil
+}
+
+// piecesStatus requests state of pieces from the transfer goroutine
+func (transfer *Transfer) piecesStatus() (transferPieces, error) {
+	res := make(chan transferPieces, 1)
+	select {
+	case transfer.statusRequest <- res:
+		return <-res, nil
+	case <-transfer.done:
+		return transferPieces{}, fmt.Errorf("transfer %s is closed", transfer.Hash.ToString())
+	}
+}
+
+// makeTransferPieces is called in the transfer goroutine
+func (transfer *Transfer) makeTransferPieces(piecePicker *PiecePicker) transferPieces {
+	res := transferPieces{strategy: piecePicker.Strategy().Name(), pieces: piecePicker.PiecesStatus(), requests: piecePicker.RequestedBlocks()}
+	for i, x := range res.pieces {
+		pieceBegin := uint64(i) * proto.PIECE_SIZE_UINT64
+		pieceSize := Min(proto.PIECE_SIZE_UINT64, transfer.Size-pieceBegin)
+		downloaded := uint64(0)
+		switch x.State {
+		case PIECE_STATE_VERIFIED:
+			downloaded = pieceSize
+			res.verified += pieceSize
+		case PIECE_STATE_DOWNLOADING:
+			dp := piecePicker.getDownloadingPiece(i)
+			for b := 0; b < dp.NumBlocks(); b++ {
+				if dp.IsBlockFinished(b) {
+					pb := proto.PieceBlock{PieceIndex: i, BlockIndex: b}
+					downloaded += Min(proto.BLOCK_SIZE_UINT64, transfer.Size-pb.Start())
+				}
+			}
+		}
+
+		res.downloaded += downloaded
+		if x.Priority != proto.PIECE_PRIORITY_SKIP {
+			res.wanted += pieceSize
+			res.remaining += pieceSize - downloaded
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,62 @@
+package ged2k
+
+import (
+	"testing"
+
+	"github.com/a-pavlov/ged2k/proto"
+)
+
+func Test_SessionStatus(t *testing.T) {
+	s, err := NewSession(Config{IncomingDir: t.TempDir(), UserAgent: proto.EMULE})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Start()
+	defer s.Stop()
+
+	hash := proto.String2Hash("DB48A1C00CC972488C29D3FEC9F16A79")
+	th, err := s.AddTransfer(TransferParams{Hash: hash, Size: proto.PIECE_SIZE_UINT64 + 100, Filename: "b.bin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = th.SetPriority(proto.PIECE_SIZE_UINT64, proto.PIECE_SIZE_UINT64+1, proto.PIECE_PRIORITY_SKIP); err != nil {
+		t.Fatal(err)
+	}
+
+	ts, err := th.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ts.Hash != hash || ts.Size != proto.PIECE_SIZE_UINT64+100 || ts.Finished || ts.Seeding || ts.Strategy != PICK_STRATEGY_RAREST_FIRST {
+		t.Errorf("Transfer status incorrect %v", ts.TransferSummary)
+	}
+
+	if len(ts.Pieces) != 2 || ts.Pieces[0].State != PIECE_STATE_NONE || ts.Pieces[1].Priority != proto.PIECE_PRIORITY_SKIP {
+		t.Errorf("Pieces status incorrect %v", ts.Pieces)
+	}
+
+	if ts.DownloadedBytes != 0 || ts.VerifiedBytes != 0 || ts.WantedBytes != proto.PIECE_SIZE_UINT64 || ts.ETA != ETA_UNKNOWN {
+		t.Errorf("Transfer progress incorrect downloaded %d verified %d wanted %d eta %v", ts.DownloadedBytes, ts.VerifiedBytes, ts.WantedBytes, ts.ETA)
+	}
+
+	peers, err := th.Peers()
+	if err != nil || len(peers) != 0 {
+		t.Errorf("Transfer peers incorrect %v %v", peers, err)
+	}
+
+	ss := s.Status()
+	if ss.Server.Connected || ss.PeerConnections != 0 || len(ss.Transfers) != 1 || ss.Transfers[0].Hash != hash {
+		t.Errorf("Session status incorrect %v", ss)
+	}
+
+	if err = th.Remove(false); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = th.Status(); err == nil {
+		t.Error("Status of removed transfer was returned")
+	}
+}
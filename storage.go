@@ -0,0 +1,273 @@
+package ged2k
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// StorageMode selects how transfer keeps its data
+type StorageMode int
+
+const (
+	// STORAGE_SPARSE file is extended to the transfer size without allocation, disk space is taken on write
+	STORAGE_SPARSE StorageMode = iota
+	// STORAGE_PREALLOCATED file is filled up to the transfer size when free space is enough
+	STORAGE_PREALLOCATED
+	// STORAGE_MEMORY keeps data in memory only, transfer has no data file, resume data and is not shared
+	STORAGE_MEMORY
+)
+
+// PREALLOCATE_CHUNK_SIZE is size of zero chunk written while file is preallocated
+const PREALLOCATE_CHUNK_SIZE = 1024 * 1024
+
+// Storage keeps data of the transfer, methods are safe for concurrent use by transfer and disk workers
+type Storage interface {
+	ReadAt(p []byte, off int64) (int, error)
+	WriteAt(p []byte, off int64) (int, error)
+	// Truncate changes size of data
+	Truncate(size int64) error
+	// Finalize flushes data and releases resources, storage is not used after it except Remove
+	Finalize() error
+	// Remove deletes data
+	Remove() error
+}
+
+// syncer is implemented by storages flushed to the disk with interval
+type syncer interface {
+	Sync() error
+}
+
+func (mode StorageMode) String() string {
+	switch mode {
+	case STORAGE_SPARSE:
+		return "sparse"
+	case STORAGE_PREALLOCATED:
+		return "preallocated"
+	case STORAGE_MEMORY:
+		return "memory"
+	}
+
+	return fmt.Sprintf("unknown(%d)", int(mode))
+}
+
+// OpenStorage creates storage of the transfer with data of size bytes, existing data is kept
+func OpenStorage(mode StorageMode, filename string, size uint64) (Storage, error) {
+	switch mode {
+	case STORAGE_SPARSE:
+		return OpenFileStorage(filename, size, false)
+	case STORAGE_PREALLOCATED:
+		return OpenFileStorage(filename, size, true)
+	case STORAGE_MEMORY:
+		return NewMemoryStorage(size)
+	}
+
+	return nil, fmt.Errorf("storage mode %d is not supported", int(mode))
+}
+
+// FileStorage keeps data in the file
+type FileStorage struct {
+	file     *os.File
+	filename string
+}
+
+// OpenFileStorage opens or creates file of the size, sparse file is extended by truncate and
+// preallocated file is filled by zeroes after check of free space
+func OpenFileStorage(filename string, size uint64, preallocate bool) (*FileStorage, error) {
+	_, err := os.Stat(filename)
+	created := os.IsNotExist(err)
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	fs := &FileStorage{file: file, filename: filename}
+	fi, err := file.Stat()
+	if err == nil && uint64(fi.Size()) < size {
+		if preallocate {
+			err = fs.preallocate(fi.Size(), int64(size))
+		} else {
+			err = file.Truncate(int64(size))
+		}
+	}
+
+	if err != nil {
+		file.Close()
+		// file created for the transfer which can not start is not left on disk
+		if created {
+			os.Remove(filename)
+		}
+		return nil, err
+	}
+
+	return fs, nil
+}
+
+func (fs *FileStorage) preallocate(begin int64, end int64) error {
+	if free, ok := freeSpace(filepath.Dir(fs.filename)); ok && free < uint64(end-begin) {
+		return fmt.Errorf("not enough free space for %s: required %d available %d", fs.filename, end-begin, free)
+	}
+
+	zero := make([]byte, PREALLOCATE_CHUNK_SIZE)
+	for begin < end {
+		n := Min(uint64(end-begin), PREALLOCATE_CHUNK_SIZE)
+		if _, err := fs.file.WriteAt(zero[:n], begin); err != nil {
+			return err
+		}
+		begin += int64(n)
+	}
+
+	return fs.file.Sync()
+}
+
+func (fs *FileStorage) ReadAt(p []byte, off int64) (int, error) {
+	return fs.file.ReadAt(p, off)
+}
+
+func (fs *FileStorage) WriteAt(p []byte, off int64) (int, error) {
+	return fs.file.WriteAt(p, off)
+}
+
+func (fs *FileStorage) Truncate(size int64) error {
+	return fs.file.Truncate(size)
+}
+
+func (fs *FileStorage) Sync() error {
+	return fs.file.Sync()
+}
+
+func (fs *FileStorage) Finalize() error {
+	err := fs.file.Sync()
+	if closeErr := fs.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func (fs *FileStorage) Remove() error {
+	fs.file.Close()
+	if err := os.Remove(fs.filename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// MEMORY_STORAGE_CHUNK_SIZE is size of memory allocated by memory storage at once
+const MEMORY_STORAGE_CHUNK_SIZE = 1024 * 1024
+
+// MemoryStorage keeps data in memory, it is used when data must not touch the disk,
+// memory is allocated by chunks on write, so not received data takes no memory
+type MemoryStorage struct {
+	mutex  sync.RWMutex
+	size   int64
+	chunks map[int64][]byte
+}
+
+// NewMemoryStorage creates storage of size bytes, size must be addressable in memory
+func NewMemoryStorage(size uint64) (*MemoryStorage, error) {
+	if size > uint64(^uint(0)>>1) {
+		return nil, fmt.Errorf("size %d can not be kept in memory", size)
+	}
+
+	return &MemoryStorage{size: int64(size), chunks: make(map[int64][]byte)}, nil
+}
+
+func (ms *MemoryStorage) ReadAt(p []byte, off int64) (int, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+
+	if off >= ms.size {
+		return 0, io.EOF
+	}
+
+	n := int(Min(uint64(len(p)), uint64(ms.size-off)))
+	for i := 0; i < n; {
+		index, offset := (off+int64(i))/MEMORY_STORAGE_CHUNK_SIZE, (off+int64(i))%MEMORY_STORAGE_CHUNK_SIZE
+		size := int(Min(uint64(n-i), uint64(MEMORY_STORAGE_CHUNK_SIZE-offset)))
+		if chunk, ok := ms.chunks[index]; ok {
+			copy(p[i:i+size], chunk[offset:])
+		} else {
+			// data was not written
+			zeroBytes(p[i : i+size])
+		}
+		i += size
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (ms *MemoryStorage) WriteAt(p []byte, off int64) (int, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+
+	for i := 0; i < len(p); {
+		index, offset := (off+int64(i))/MEMORY_STORAGE_CHUNK_SIZE, (off+int64(i))%MEMORY_STORAGE_CHUNK_SIZE
+		chunk, ok := ms.chunks[index]
+		if !ok {
+			chunk = make([]byte, MEMORY_STORAGE_CHUNK_SIZE)
+			ms.chunks[index] = chunk
+		}
+		i += copy(chunk[offset:], p[i:])
+	}
+
+	if end := off + int64(len(p)); end > ms.size {
+		ms.size = end
+	}
+
+	return len(p), nil
+}
+
+func (ms *MemoryStorage) Truncate(size int64) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if size < 0 {
+		return fmt.Errorf("negative size %d", size)
+	}
+
+	if size < ms.size {
+		// removed data is read as zeros when storage is extended again
+		for index, chunk := range ms.chunks {
+			begin := index * MEMORY_STORAGE_CHUNK_SIZE
+			if begin >= size {
+				delete(ms.chunks, index)
+			} else if size-begin < MEMORY_STORAGE_CHUNK_SIZE {
+				zeroBytes(chunk[size-begin:])
+			}
+		}
+	}
+
+	ms.size = size
+	return nil
+}
+
+func zeroBytes(p []byte) {
+	for i := range p {
+		p[i] = 0
+	}
+}
+
+func (ms *MemoryStorage) Finalize() error {
+	return nil
+}
+
+func (ms *MemoryStorage) Remove() error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.size = 0
+	ms.chunks = make(map[int64][]byte)
+	return nil
+}
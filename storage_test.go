@@ -0,0 +1,156 @@
+package ged2k
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/a-pavlov/ged2k/proto"
+)
+
+func makeMemoryStorage(t *testing.T, size uint64) *MemoryStorage {
+	ms, err := NewMemoryStorage(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ms
+}
+
+func Test_MemoryStorage(t *testing.T) {
+	ms := makeMemoryStorage(t, 10)
+	if n, err := ms.WriteAt([]byte{1, 2, 3}, 8); err != nil || n != 3 {
+		t.Errorf("Data was not written %d %v", n, err)
+	}
+
+	data := make([]byte, 4)
+	if n, err := ms.ReadAt(data, 7); n != 4 || err != nil || !bytes.Equal(data, []byte{0, 1, 2, 3}) {
+		t.Errorf("Incorrect data %v %v", data, err)
+	}
+
+	if n, err := ms.ReadAt(data, 9); n != 2 || err != io.EOF {
+		t.Errorf("Read beyond end was not reported %d %v", n, err)
+	}
+
+	if ms.Truncate(5) != nil || ms.size != 5 {
+		t.Error("Storage was not truncated")
+	}
+
+	// truncated data is not restored by extension
+	if n, err := ms.ReadAt(data, 7); n != 0 || err != io.EOF || ms.Truncate(10) != nil {
+		t.Errorf("Truncated data was read %d %v", n, err)
+	}
+
+	if n, err := ms.ReadAt(data, 6); n != 4 || err != nil || !bytes.Equal(data, []byte{0, 0, 0, 0}) {
+		t.Errorf("Truncated data was restored %v %v", data, err)
+	}
+
+	if ms.Finalize() != nil || ms.Remove() != nil || ms.size != 0 || len(ms.chunks) != 0 {
+		t.Error("Data was not removed")
+	}
+}
+
+func Test_MemoryStorageChunks(t *testing.T) {
+	// large storage takes memory for written data only
+	ms := makeMemoryStorage(t, 1<<40)
+	content := bytes.Repeat([]byte{1, 2, 3}, MEMORY_STORAGE_CHUNK_SIZE)
+	offset := int64(1<<39 - 100)
+	if n, err := ms.WriteAt(content, offset); err != nil || n != len(content) || len(ms.chunks) != 4 {
+		t.Errorf("Data was not written %d %v chunks %d", n, err, len(ms.chunks))
+	}
+
+	data := make([]byte, len(content)+200)
+	if n, err := ms.ReadAt(data, offset-100); n != len(data) || err != nil || !bytes.Equal(data[100:len(content)+100], content) ||
+		!bytes.Equal(data[:100], make([]byte, 100)) || !bytes.Equal(data[len(content)+100:], make([]byte, 100)) {
+		t.Errorf("Written data was not read %d %v", n, err)
+	}
+
+	if _, err := NewMemoryStorage(1 << 63); err == nil {
+		t.Error("Storage larger than memory was created")
+	}
+}
+
+func Test_FileStorage(t *testing.T) {
+	dir := t.TempDir()
+	for _, mode := range []StorageMode{STORAGE_SPARSE, STORAGE_PREALLOCATED} {
+		filename := filepath.Join(dir, mode.String())
+		storage, err := OpenStorage(mode, filename, 3*PREALLOCATE_CHUNK_SIZE/2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fi, err := os.Stat(filename); err != nil || fi.Size() != 3*PREALLOCATE_CHUNK_SIZE/2 {
+			t.Errorf("File %s was not extended to transfer size %v", mode, err)
+		}
+
+		if _, err = storage.WriteAt([]byte{1, 2}, 10); err != nil || storage.Finalize() != nil {
+			t.Errorf("Data was not written %v", err)
+		}
+
+		// existing data is kept on open
+		storage, err = OpenStorage(mode, filename, 3*PREALLOCATE_CHUNK_SIZE/2)
+		data := make([]byte, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = storage.ReadAt(data, 10); err != nil || !bytes.Equal(data, []byte{1, 2}) {
+			t.Errorf("Data was not kept %v %v", data, err)
+		}
+
+		if storage.Remove() != nil {
+			t.Error("Storage was not removed")
+		}
+
+		if _, err = os.Stat(filename); !os.IsNotExist(err) {
+			t.Errorf("File %s was not removed", filename)
+		}
+	}
+
+	// preallocation fails on free space check and does not leave empty file
+	huge := filepath.Join(dir, "huge.bin")
+	if _, err := OpenFileStorage(huge, 1<<62, true); err == nil {
+		t.Error("File larger than free space was preallocated")
+	}
+
+	if _, err := os.Stat(huge); !os.IsNotExist(err) {
+		t.Errorf("File %s was left after failed preallocation", huge)
+	}
+
+	if _, err := OpenStorage(STORAGE_MEMORY+1, filepath.Join(dir, "a.bin"), 10); err == nil {
+		t.Error("Unknown storage mode was accepted")
+	}
+}
+
+func Test_SessionMemoryStorage(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewSession(Config{IncomingDir: dir, UserAgent: proto.EMULE})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub := s.Subscribe(EVENT_CATEGORY_TRANSFER, 0)
+	defer s.Unsubscribe(sub)
+	s.Start()
+	th, err := s.AddTransfer(TransferParams{Hash: proto.EMULE, Size: 100, Filename: "a.bin", Storage: STORAGE_MEMORY})
+	if err != nil || th.Pause() != nil {
+		t.Fatalf("Can not add paused transfer %v", err)
+	}
+
+	for paused := false; !paused; {
+		select {
+		case e := <-sub.Events():
+			_, paused = e.(TransferPausedEvent)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Transfer was not paused")
+		}
+	}
+
+	s.Stop()
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Errorf("Transfer in memory touched the disk %v %v", entries, err)
+	}
+}
@@ -0,0 +1,222 @@
+package ged2k
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/a-pavlov/ged2k/proto"
+)
+
+// STREAM_POLL_INTERVAL is how often stream reader checks verified pieces while waiting for data
+const STREAM_POLL_INTERVAL = time.Millisecond * time.Duration(500)
+
+// STREAM_BOOST_SIZE is the size of data after the read position downloaded before other pieces
+const STREAM_BOOST_SIZE uint64 = proto.PIECE_SIZE_UINT64 * 2
+
+// StreamServer serves files of transfers and shared files by hash over HTTP, e.g. http://127.0.0.1:8080/<hash>.
+// Reading of not verified data blocks until pieces are downloaded
+type StreamServer struct {
+	session *Session
+	server  *http.Server
+}
+
+func NewStreamServer(s *Session, address string) *StreamServer {
+	ss := &StreamServer{session: s}
+	ss.server = &http.Server{Addr: address, Handler: ss}
+	return ss
+}
+
+func (ss *StreamServer) Start() error {
+	listener, err := net.Listen("tcp", ss.server.Addr)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("stream server listening on %s\n", listener.Addr().String())
+	go func() {
+		if err := ss.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("stream server error %v\n", err)
+		}
+	}()
+
+	return nil
+}
+
+func (ss *StreamServer) Close() error {
+	return ss.server.Close()
+}
+
+func (ss *StreamServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := strings.Trim(r.URL.Path, "/")
+	if len(path) != proto.HASH_LEN*2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	hash := proto.String2Hash(path)
+	if hash == proto.ZERO {
+		http.NotFound(w, r)
+		return
+	}
+
+	sf := ss.session.getStreamFile(hash)
+	if sf == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if sf.memory {
+		http.Error(w, fmt.Sprintf("transfer %s keeps data in memory and can not be streamed", hash.ToString()), http.StatusConflict)
+		return
+	}
+
+	reader, err := NewStreamReader(r.Context(), ss.session, sf)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer reader.Close()
+
+	// content type is set in advance to avoid content sniffing which waits for the first piece
+	contentType := mime.TypeByExtension(filepath.Ext(sf.Filename))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, filepath.Base(sf.Filename), time.Time{}, reader)
+}
+
+// StreamReader reads file of the transfer and waits until requested data is verified
+type StreamReader struct {
+	ctx     context.Context
+	session *Session
+	file    *os.File
+	sf      *SharedFile
+	offset  int64
+	boosted map[int]bool
+	// ranges boosted by the reader, boost is removed on close
+	boosts []PiecesPriority
+}
+
+func NewStreamReader(ctx context.Context, s *Session, sf *SharedFile) (*StreamReader, error) {
+	if sf.memory {
+		return nil, fmt.Errorf("transfer %s keeps data in memory and can not be streamed", sf.Hash.ToString())
+	}
+
+	file, err := os.Open(sf.Filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StreamReader{ctx: ctx, session: s, file: file, sf: sf, boosted: make(map[int]bool)}, nil
+}
+
+func (sr *StreamReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += sr.offset
+	case io.SeekEnd:
+		offset += int64(sr.sf.Size)
+	default:
+		return 0, fmt.Errorf("incorrect whence %d", whence)
+	}
+
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position %d", offset)
+	}
+
+	sr.offset = offset
+	return offset, nil
+}
+
+func (sr *StreamReader) Read(p []byte) (int, error) {
+	if uint64(sr.offset) >= sr.sf.Size {
+		return 0, io.EOF
+	}
+
+	// read no more than till the end of the current piece to wait for one piece only
+	begin := uint64(sr.offset)
+	end := Min(Min(begin+uint64(len(p)), (begin/proto.PIECE_SIZE_UINT64+1)*proto.PIECE_SIZE_UINT64), sr.sf.Size)
+	if err := sr.wait(begin, end); err != nil {
+		return 0, err
+	}
+
+	n, err := sr.file.ReadAt(p[:end-begin], sr.offset)
+	sr.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+
+	return n, err
+}
+
+// wait boosts priority of the data after position and waits until range [begin, end) is verified
+func (sr *StreamReader) wait(begin uint64, end uint64) error {
+	if sr.sf.HaveRange(begin, end) {
+		return nil
+	}
+
+	ticker := time.NewTicker(STREAM_POLL_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		if !sr.boosted[int(begin/proto.PIECE_SIZE_UINT64)] {
+			boostEnd := Min(begin+STREAM_BOOST_SIZE, sr.sf.Size)
+			for i := int(begin / proto.PIECE_SIZE_UINT64); i <= int((boostEnd-1)/proto.PIECE_SIZE_UINT64); i++ {
+				sr.boosted[i] = true
+			}
+
+			log.Printf("stream %s waits for range [%d:%d]\n", sr.sf.Hash.ToString(), begin, end)
+			th := TransferHandle{hash: sr.sf.Hash, session: sr.session}
+			if err := th.boost(begin, boostEnd, true); err != nil {
+				log.Printf("stream %s can not boost priority: %v\n", sr.sf.Hash.ToString(), err)
+			} else {
+				sr.boosts = append(sr.boosts, PiecesPriority{begin: begin, end: boostEnd})
+			}
+		}
+
+		select {
+		case <-sr.ctx.Done():
+			return sr.ctx.Err()
+		case <-ticker.C:
+			sf := sr.session.getStreamFile(sr.sf.Hash)
+			if sf == nil {
+				return fmt.Errorf("file %s is not available anymore", sr.sf.Hash.ToString())
+			}
+
+			sr.sf = sf
+			if sr.sf.HaveRange(begin, end) {
+				return nil
+			}
+		}
+	}
+}
+
+func (sr *StreamReader) Close() error {
+	th := TransferHandle{hash: sr.sf.Hash, session: sr.session}
+	for _, x := range sr.boosts {
+		if err := th.boost(x.begin, x.end, false); err != nil {
+			log.Printf("stream %s can not remove boost: %v\n", sr.sf.Hash.ToString(), err)
+		}
+	}
+
+	sr.boosts = nil
+	return sr.file.Close()
+}
@@ -0,0 +1,104 @@
+package ged2k
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/a-pavlov/ged2k/proto"
+)
+
+func Test_StreamServerRange(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "movie.avi")
+	content := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	if err := os.WriteFile(filename, content, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Session{transferRequest: make(chan transferRequest), sharedFileRequest: make(chan sharedFileRequest)}
+	done := make(chan bool)
+	defer close(done)
+
+	// fake session has no verified pieces until the range was boosted
+	requests := make(chan transferRequest, 10)
+	boosted := false
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case req := <-s.transferRequest:
+				boosted = true
+				requests <- req
+				req.res <- nil
+			case req := <-s.sharedFileRequest:
+				if req.hash == proto.Terminal && req.transfers {
+					req.res <- &SharedFile{Hash: proto.Terminal, Size: 10, Filename: "memory.bin", Pieces: proto.CreateBitField(1), memory: true}
+					break
+				}
+
+				if req.hash != proto.EMULE || !req.transfers {
+					req.res <- nil
+					break
+				}
+
+				pieces := proto.CreateBitField(1)
+				if boosted {
+					pieces.SetBit(0)
+				}
+				req.res <- &SharedFile{Hash: proto.EMULE, Size: uint64(len(content)), Filename: filename, Pieces: pieces}
+			}
+		}
+	}()
+
+	server := httptest.NewServer(NewStreamServer(s, ""))
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/"+proto.EMULE.ToString(), nil)
+	req.Header.Set("Range", "bytes=10-19")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusPartialContent || string(data) != "abcdefghij" {
+		t.Errorf("Range response incorrect %d %s %v", resp.StatusCode, string(data), err)
+	}
+
+	if resp.Header.Get("Content-Type") != "video/x-msvideo" || resp.Header.Get("Content-Range") != "bytes 10-19/36" {
+		t.Errorf("Range headers incorrect %v", resp.Header)
+	}
+
+	// boost is removed when reader is closed
+	for _, boost := range []bool{true, false} {
+		select {
+		case req := <-requests:
+			if req.hash != proto.EMULE || req.action != transferActionBoost || req.begin != 10 || req.end != 36 || req.boost != boost {
+				t.Errorf("Range boost %v incorrect: %v", boost, req)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Range boost %v was not requested", boost)
+		}
+	}
+
+	resp, err = http.Get(server.URL + "/" + proto.Terminal.ToString())
+	if err != nil || resp.StatusCode != http.StatusConflict {
+		t.Errorf("Transfer in memory was streamed %v", err)
+	}
+	resp.Body.Close()
+
+	for _, x := range []string{"/" + proto.LIBED2K.ToString(), "/xyz", "/" + strings.Repeat("1", 40)} {
+		resp, err := http.Get(server.URL + x)
+		if err != nil || resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Unknown file %s was served", x)
+		}
+		resp.Body.Close()
+	}
+}
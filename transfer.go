@@ -1,13 +1,13 @@
-package main
+package ged2k
 
 import (
+	"errors"
 	"fmt"
 	"log"
-	"os"
+	"sync"
 	"time"
 
 	"github.com/a-pavlov/ged2k/proto"
-	"golang.org/x/crypto/md4"
 )
 
 type TransferError struct {
@@ -15,18 +15,39 @@ type TransferError struct {
 	err      error
 }
 
+// PeerPieces carries pieces available on the remote peer from its file status answer
+type PeerPieces struct {
+	peer   *Peer
+	pieces proto.BitField
+}
+
+// PiecesPriority sets priority of pieces intersecting byte range [begin, end)
+type PiecesPriority struct {
+	begin    uint64
+	end      uint64
+	priority byte
+}
+
 type Transfer struct {
 	stopped  bool
 	Hash     proto.ED2KHash
 	Size     uint64
 	Filename string
-
-	ReadingResumeData      bool
-	Paused                 bool
-	Finished               bool
-	Stopped                bool
+	// StorageMode is selected when transfer is added and does not change
+	StorageMode StorageMode
+
+	ReadingResumeData bool
+	Paused            bool
+	Finished          bool
+	Stopped           bool
+	// seeding transfer was started with all data and has no piece picker
+	seeding                bool
 	RequestSourcesNextTime time.Time
 	LastError              error
+	// deleteData removes file and resume data when removed transfer is closed
+	deleteData bool
+	// storage is set by transfer goroutine before it reports close
+	storage Storage
 
 	policy                Policy
 	cmdChan               chan string
@@ -35,11 +56,48 @@ type Transfer struct {
 	peerConnChan          chan *PeerConnection
 	hashSetChan           chan *proto.HashSet
 	abortPendingBlockChan chan AbortPendingBlock
+	peerPiecesChan        chan PeerPieces
+	removePeerChan        chan *Peer
+	statusRequest         chan chan transferPieces
+	commandsLock          sync.Mutex
+	commands              []transferCommand
+	commandsReady         chan struct{} // signals queued commands
+	recheckChan           chan struct{}
+	done                  chan struct{} // closed when transfer goroutine exits
 	incomingPieces        map[int]*ReceivingPiece
 
 	Stat Statistics
 }
 
+// transferCommand is a state change requested by the session, commands are queued without blocking the session
+// and applied by transfer goroutine in order of requests
+type transferCommand struct {
+	action   int
+	priority PiecesPriority
+	strategy PickStrategy
+	boost    bool
+}
+
+// ErrInvalidHashSet is reported for hash set which does not match the transfer
+var ErrInvalidHashSet = errors.New("invalid hash set")
+
+// validateHashSet checks hash set belongs to the transfer, its result hash matches and pieces count matches the size
+func validateHashSet(hs *proto.HashSet, hash proto.ED2KHash, size uint64) error {
+	if hs.Hash != hash {
+		return fmt.Errorf("%w: hash %s does not match transfer %s", ErrInvalidHashSet, hs.Hash.ToString(), hash.ToString())
+	}
+
+	if len(hs.PieceHashes) != proto.HashSetSize(size) {
+		return fmt.Errorf("%w: %d piece hashes, expected %d", ErrInvalidHashSet, len(hs.PieceHashes), proto.HashSetSize(size))
+	}
+
+	if !proto.ResultHash(hs.PieceHashes).Equals(hash) {
+		return fmt.Errorf("%w: result hash %s does not match transfer %s", ErrInvalidHashSet, proto.ResultHash(hs.PieceHashes).ToString(), hash.ToString())
+	}
+
+	return nil
+}
+
 func NewTransfer(hash proto.ED2KHash, filename string, size uint64) *Transfer {
 	return &Transfer{
 		Hash:                  hash,
@@ -51,6 +109,12 @@ func NewTransfer(hash proto.ED2KHash, filename string, size uint64) *Transfer {
 		peerConnChan:          make(chan *PeerConnection),
 		hashSetChan:           make(chan *proto.HashSet),
 		abortPendingBlockChan: make(chan AbortPendingBlock),
+		peerPiecesChan:        make(chan PeerPieces),
+		removePeerChan:        make(chan *Peer),
+		statusRequest:         make(chan chan transferPieces),
+		commandsReady:         make(chan struct{}, 1),
+		recheckChan:           make(chan struct{}),
+		done:                  make(chan struct{}),
 		policy:                MakePolicy(MAX_PEER_LIST_SIZE),
 		incomingPieces:        make(map[int]*ReceivingPiece),
 		Stat:                  MakeStatistics(),
@@ -63,12 +127,28 @@ func (transfer *Transfer) AttachPeer(connection *PeerConnection) {
 }
 
 func (transfer *Transfer) StartFinished(s *Session, atp *proto.AddTransferParameters) {
+	defer close(transfer.done)
 	execute := true
 	if atp != nil && !atp.WantMoreData() {
 		log.Printf("transfer %s is finished\n", transfer.Hash.ToString())
+		// picker is used only to report pieces status
+		piecePicker := FromResumeData(atp)
 		// transfer finished
 		s.transferChanFinished <- transfer
 		s.transferChanResumeDataRead <- transfer
+		applyCommands := func() {
+			for _, cmd := range transfer.takeCommands() {
+				// seeding transfer has no pieces to change, other commands are rejected by the session
+				if cmd.action == transferActionPause || cmd.action == transferActionResume {
+					atp.Paused = cmd.action == transferActionPause
+					s.transferResumeData <- *atp
+					if atp.Paused {
+						s.transferChanPaused <- transfer
+					}
+				}
+			}
+		}
+
 		for execute {
 			select {
 			case _, ok := <-transfer.cmdChan:
@@ -76,97 +156,394 @@ func (transfer *Transfer) StartFinished(s *Session, atp *proto.AddTransferParame
 					log.Println("Transfer exit requested")
 					execute = false
 				}
+			case res := <-transfer.statusRequest:
+				applyCommands()
+				res <- transfer.makeTransferPieces(&piecePicker)
+			case <-transfer.commandsReady:
+				applyCommands()
 			}
 		}
 
+		applyCommands()
 		s.transferChanClosed <- transfer
 		return
 	}
 }
 
 func (transfer *Transfer) Start(s *Session, atp *proto.AddTransferParameters) {
+	defer close(transfer.done)
 	execute := true
+	paused := atp != nil && atp.Paused
 	var lastError error
 
 	var hashSet *proto.HashSet
-	file, openFileError := os.OpenFile(transfer.Filename, os.O_RDWR|os.O_CREATE, 0666)
+	storage, openStorageError := OpenStorage(transfer.StorageMode, transfer.Filename, transfer.Size)
 
-	if openFileError != nil {
-		lastError = openFileError
-		s.transferChanError <- TransferError{transfer: transfer, err: fmt.Errorf("can not open file %s with error %v", transfer.Filename, openFileError)}
-	} else {
-		defer file.Close()
+	if openStorageError != nil {
+		lastError = openStorageError
+		s.transferChanError <- TransferError{transfer: transfer, err: fmt.Errorf("can not open %s storage %s with error %v", transfer.StorageMode, transfer.Filename, openStorageError)}
 	}
 
 	hashes := proto.HashSet{Hash: transfer.Hash, PieceHashes: make([]proto.ED2KHash, 0)}
-	localFilename := proto.ByteContainer(transfer.Filename)
 
 	var piecePicker PiecePicker
 
 	if atp != nil {
 		// restore state
 		hashes = atp.Hashes // can be empty
+		if validateHashSet(&hashes, transfer.Hash, transfer.Size) == nil {
+			hashSet = &hashes
+		}
+		piecePicker = FromResumeData(atp)
 		for pieceIndex, x := range atp.DownloadedBlocks {
-			rp, ok := transfer.incomingPieces[pieceIndex]
-			if !ok {
-				rp = &ReceivingPiece{hash: md4.New(), blocks: make([]*PendingBlock, 0)}
-				transfer.incomingPieces[pieceIndex] = rp
-			}
-
+			// data of blocks is read from storage by hashing worker
+			rp := NewReceivingPiece(pieceIndex, piecePicker.BlocksInPiece(pieceIndex))
+			transfer.incomingPieces[pieceIndex] = rp
 			for b := 0; b < x.Bits(); b++ {
 				if x.GetBit(b) {
-					pb := proto.PieceBlock{PieceIndex: pieceIndex, BlockIndex: b}
-					pbSize := Min(transfer.Size-pb.Start(), proto.BLOCK_SIZE_UINT64)
-					pendingBlock := PendingBlock{block: pb, data: make([]byte, pbSize)}
-					_, err := file.Seek(int64(pb.Start()), 0)
-					if err != nil {
-						lastError = fmt.Errorf("seek in file %s to position %d failed %v", transfer.Filename, pb.Start(), err)
-						s.transferChanError <- TransferError{transfer: transfer, err: lastError}
-						break
-					} else {
-						n, err := file.Read(pendingBlock.data)
-						if err != nil || n != len(pendingBlock.data) {
-							lastError = fmt.Errorf("can not read block %s from file %s with error %v", pb.ToString(), transfer.Filename, err)
-							s.transferChanError <- TransferError{transfer: transfer, err: lastError}
-							break
-						} else {
-							rp.InsertBlock(&pendingBlock)
-							log.Printf("%s: block %s data size: %d was restored\n", transfer.Filename, pb.ToString(), len(pendingBlock.data))
-						}
-					}
+					rp.RestoreBlock(b)
 				}
 			}
 		}
 
-		piecePicker = FromResumeData(atp)
-
 		// report resume data read is finished
 		s.transferChanResumeDataRead <- transfer
 	} else {
 		piecePicker = CreatePiecePicker(proto.NumPiecesAndBlocks(transfer.Size))
 		// create initial add transfer parameters here
-		s.transferResumeData <- proto.AddTransferParameters{
-			Hashes:           hashes,
-			Filename:         localFilename,
-			Filesize:         transfer.Size,
-			Pieces:           piecePicker.GetPieces(),
-			DownloadedBlocks: piecePicker.GetDownloadedBlocks(),
+		s.transferResumeData <- transfer.resumeData(hashes, &piecePicker, paused)
+	}
+
+	wantedFinished := piecePicker.IsWantedFinished()
+	if wantedFinished {
+		// restored transfer has all wanted data, skipped pieces could be requested later
+		s.transferChanFinished <- transfer
+	}
+
+	// received blocks wait in the write queue until disk workers take them, writing is count of blocks taken
+	writeQueue := []*PendingBlock{}
+	writeResults := make(chan diskWriteResult, TRANSFER_WRITE_QUEUE_SIZE)
+	writing := 0
+
+	// queuedJob returns job of the first adjacent queued blocks and nil channel when queue is empty
+	queuedJob := func() (chan diskWriteJob, diskWriteJob) {
+		if len(writeQueue) == 0 {
+			return nil, diskWriteJob{}
+		}
+
+		return s.disk.jobs, diskWriteJob{storage: storage, blocks: nextWriteBatch(writeQueue), res: writeResults}
+	}
+
+	jobSent := func(job diskWriteJob) {
+		writeQueue = writeQueue[len(job.blocks):]
+		writing += len(job.blocks)
+	}
+
+	// unverified pieces were completely downloaded before trusted hash set was received
+	unverified := make(map[int]proto.ED2KHash)
+
+	// aborted blocks with received data wait for the next peer which downloads missing segments only
+	partialBlocks := make(map[proto.PieceBlock]*PendingBlock)
+
+	// pieces with written blocks wait in the hash queue until hashing worker takes them, hashing is count of pieces taken
+	hashQueue := []*ReceivingPiece{}
+	hashResults := make(chan diskHashResult, DISK_QUEUE_SIZE)
+	hashing := 0
+
+	queueHash := func(rp *ReceivingPiece) {
+		if !rp.queued && rp.CanHash() {
+			rp.queued = true
+			hashQueue = append(hashQueue, rp)
+		}
+	}
+
+	if storage != nil {
+		// restored blocks are hashed again
+		for _, rp := range transfer.incomingPieces {
+			queueHash(rp)
+		}
+	}
+
+	queuedHashJob := func() (chan diskHashJob, diskHashJob) {
+		if len(hashQueue) == 0 {
+			return nil, diskHashJob{}
+		}
+
+		return s.disk.hashes, hashQueue[0].hashJob(storage, transfer.Size, hashResults)
+	}
+
+	hashSent := func(job diskHashJob) {
+		hashQueue[0].hashStarted(job)
+		hashQueue = hashQueue[1:]
+		hashing++
+	}
+
+	// blocksWritten finishes written blocks and passes them to hashing
+	blocksWritten := func(res diskWriteResult) {
+		writing -= len(res.blocks)
+		if res.err != nil {
+			lastError = res.err
+			s.transferChanError <- TransferError{transfer: transfer, err: lastError}
+			return
+		}
+
+		for _, pb := range res.blocks {
+			piecePicker.FinishBlock(pb.block)
+			if rp, ok := transfer.incomingPieces[pb.block.PieceIndex]; ok {
+				rp.BlockWritten(pb)
+				queueHash(rp)
+			}
+		}
+
+		s.transferResumeData <- transfer.resumeData(hashes, &piecePicker, paused)
+	}
+
+	// checkWantedFinished reports change of wanted data state after pieces or priorities were changed
+	checkWantedFinished := func() {
+		if wantedFinished && !piecePicker.IsWantedFinished() {
+			log.Printf("transfer %s wants more data\n", transfer.Hash.ToString())
+			s.transferChanUnfinished <- transfer
+		} else if !wantedFinished && piecePicker.IsWantedFinished() {
+			log.Println("All wanted data was received")
+			s.transferChanFinished <- transfer
+		}
+		wantedFinished = piecePicker.IsWantedFinished()
+	}
+
+	// recheck is requested and waits for written and hashed data, data is not received while rechecking
+	recheck := false
+	rechecking := false
+	// recheck requested before trusted hash set was received starts when hash set arrives
+	recheckWaiting := false
+	recheckResults := make(chan recheckResult, 1)
+	stopRecheck := make(chan struct{})
+
+	// recheckFinished rebuilds pieces from verified data, other pieces are downloaded again
+	recheckFinished := func(res recheckResult) {
+		rechecking = false
+		if res.err == nil && res.pieces.Count() == res.pieces.Bits() && !proto.ResultHash(res.hashes).Equals(transfer.Hash) {
+			res.err = fmt.Errorf("file hash %x does not match transfer hash %s", proto.ResultHash(res.hashes), transfer.Hash.ToString())
+			lastError = res.err
+			s.transferChanError <- TransferError{transfer: transfer, err: lastError}
+		}
+
+		if res.err == nil {
+			atp := transfer.resumeData(hashes, &piecePicker, paused)
+			atp.Pieces = res.pieces
+			atp.DownloadedBlocks = make(map[int]proto.BitField)
+			strategy, boosts := piecePicker.strategy, piecePicker.boosts
+			piecePicker = FromResumeData(&atp)
+			piecePicker.SetStrategy(strategy)
+			piecePicker.boosts = boosts
+			transfer.incomingPieces = make(map[int]*ReceivingPiece)
+			unverified = make(map[int]proto.ED2KHash)
+			hashQueue = []*ReceivingPiece{}
+			partialBlocks = make(map[proto.PieceBlock]*PendingBlock)
+			s.transferResumeData <- transfer.resumeData(hashes, &piecePicker, paused)
+			checkWantedFinished()
+		}
+
+		log.Printf("transfer %s recheck verified %d pieces of %d, error %v\n", transfer.Hash.ToString(), res.pieces.Count(), res.pieces.Bits(), res.err)
+		s.events.publish(TransferRecheckedEvent{Hash: transfer.Hash, Pieces: res.pieces.Bits(), VerifiedPieces: res.pieces.Count(), Err: res.err})
+	}
+
+	// verifyPiece marks piece as downloaded when its hash matches, otherwise piece is downloaded again
+	verifyPiece := func(pieceIndex int, hash proto.ED2KHash) {
+		if hash.Equals(hashSet.PieceHashes[pieceIndex]) {
+			log.Println("Hash match")
+			piecePicker.SetHave(pieceIndex)
+		} else {
+			log.Printf("Hash not match: %x expected %x\n", hash, hashSet.PieceHashes[pieceIndex])
+			s.events.publish(PieceHashFailedEvent{Hash: transfer.Hash, PieceIndex: pieceIndex})
+			// restore piece as no-have
+			piecePicker.RemoveDownloadingPiece(pieceIndex)
+		}
+
+		s.transferResumeData <- transfer.resumeData(hashes, &piecePicker, paused)
+		delete(transfer.incomingPieces, pieceIndex)
+		if piecePicker.IsFinished() {
+			// the last piece was downloaded, whole file is verified since pieces could be changed on disk
+			log.Printf("transfer %s verify file\n", transfer.Hash.ToString())
+			recheck = true
+		}
+
+		if !wantedFinished && piecePicker.IsWantedFinished() {
+			// disconnect all peers
+			// status finished
+			// need save resume data
+			// nothing to do - all wanted pieces marked as downloaded
+			log.Println("All wanted data was received")
+			wantedFinished = true
+			s.transferChanFinished <- transfer
+		}
+	}
+
+	// pieceHashed continues hashing of the piece or checks hash of completely downloaded piece
+	pieceHashed := func(res diskHashResult) {
+		hashing--
+		rp := transfer.incomingPieces[res.pieceIndex]
+		rp.hashing = false
+		if res.err != nil {
+			lastError = res.err
+			s.transferChanError <- TransferError{transfer: transfer, err: lastError}
+			return
+		}
+
+		if !res.complete {
+			queueHash(rp)
+			return
+		}
+
+		log.Printf("piece %d hashed\n", res.pieceIndex)
+		if hashSet == nil {
+			log.Printf("piece %d waits for trusted hash set\n", res.pieceIndex)
+			unverified[res.pieceIndex] = res.hash
+			return
+		}
+
+		verifyPiece(res.pieceIndex, res.hash)
+	}
+
+	applyCommand := func(cmd transferCommand) {
+		switch cmd.action {
+		case transferActionPause, transferActionResume:
+			// blocks of closed connections are aborted by their unregister
+			paused = cmd.action == transferActionPause
+			log.Printf("transfer %s paused %v\n", transfer.Hash.ToString(), paused)
+			s.transferResumeData <- transfer.resumeData(hashes, &piecePicker, paused)
+			if paused {
+				s.transferChanPaused <- transfer
+			}
+		case transferActionStrategy:
+			log.Printf("transfer %s pick strategy %s\n", transfer.Hash.ToString(), cmd.strategy.Name())
+			piecePicker.SetStrategy(cmd.strategy)
+		case transferActionPriority:
+			pp := cmd.priority
+			log.Printf("transfer %s priority %d for range [%d:%d]\n", transfer.Hash.ToString(), pp.priority, pp.begin, pp.end)
+			piecePicker.SetRangePriority(pp.begin, pp.end, pp.priority)
+			s.transferResumeData <- transfer.resumeData(hashes, &piecePicker, paused)
+			checkWantedFinished()
+		case transferActionBoost:
+			piecePicker.BoostRange(cmd.priority.begin, cmd.priority.end, cmd.boost)
+		}
+	}
+
+	// applyCommands applies queued commands, it is called before requests which depend on state set by the session
+	applyCommands := func() {
+		for _, cmd := range transfer.takeCommands() {
+			applyCommand(cmd)
 		}
 	}
 
 	log.Println("Transfer cycle in running")
 	for execute {
+		if recheck && len(writeQueue) == 0 && writing == 0 && hashing == 0 {
+			recheck = false
+			rechecking = true
+			go func(hs proto.HashSet) {
+				recheckResults <- recheckData(storage, hs, transfer.Size, stopRecheck)
+			}(*hashSet)
+		}
+
+		dataChan := transfer.dataChan
+		if len(writeQueue)+writing >= TRANSFER_WRITE_QUEUE_SIZE {
+			// peer connections wait with received blocks and do not read sockets until queue is written
+			dataChan = nil
+		}
+
+		diskJobs, job := queuedJob()
+		hashJobs, hashJob := queuedHashJob()
+		if recheck || rechecking {
+			// hashing is not started since all pieces are verified by recheck
+			hashJobs = nil
+		}
+
 		select {
+		case diskJobs <- job:
+			jobSent(job)
+		case res := <-writeResults:
+			blocksWritten(res)
+		case hashJobs <- hashJob:
+			hashSent(hashJob)
+		case res := <-hashResults:
+			pieceHashed(res)
+		case res := <-recheckResults:
+			recheckFinished(res)
+		case <-transfer.recheckChan:
+			if recheck || rechecking {
+				break
+			}
+
+			if storage == nil {
+				err := fmt.Errorf("transfer %s has no data to recheck", transfer.Hash.ToString())
+				s.events.publish(TransferRecheckedEvent{Hash: transfer.Hash, Err: err})
+				break
+			}
+
+			if hashSet == nil {
+				// peers are not closed since one of them sends hash set
+				log.Printf("transfer %s recheck waits for trusted hash set\n", transfer.Hash.ToString())
+				recheckWaiting = true
+				break
+			}
+
+			log.Printf("transfer %s recheck requested\n", transfer.Hash.ToString())
+			recheck = true
+			partialBlocks = make(map[proto.PieceBlock]*PendingBlock)
 		case _, ok := <-transfer.cmdChan:
 			if !ok {
 				log.Println("Transfer exit requested")
 				execute = false
 			}
-		case hashSet = <-transfer.hashSetChan:
+		case hs := <-transfer.hashSetChan:
+			if hashSet != nil {
+				break
+			}
+
+			if err := validateHashSet(hs, transfer.Hash, transfer.Size); err != nil {
+				log.Printf("transfer %s hash set rejected: %v\n", transfer.Hash.ToString(), err)
+				break
+			}
+
+			// trusted hash set is kept in resume data and verifies pieces downloaded before it
+			hashSet = hs
+			hashes = *hs
+			s.transferResumeData <- transfer.resumeData(hashes, &piecePicker, paused)
+			for pieceIndex, hash := range unverified {
+				verifyPiece(pieceIndex, hash)
+			}
+			unverified = make(map[int]proto.ED2KHash)
+			if recheckWaiting {
+				log.Printf("transfer %s recheck started with received hash set\n", transfer.Hash.ToString())
+				recheckWaiting = false
+				recheck = true
+				partialBlocks = make(map[proto.PieceBlock]*PendingBlock)
+			}
 		case apb := <-transfer.abortPendingBlockChan:
 			log.Printf("abort block %s\n", apb.pendingBlock.block.ToString())
-			piecePicker.AbortBlock(apb.pendingBlock.block, apb.peer)
-		case pb := <-transfer.dataChan:
+			if piecePicker.AbortBlock(apb.pendingBlock.block, apb.peer) && apb.pendingBlock.IsPartial() && !recheck && !rechecking {
+				if x, ok := partialBlocks[apb.pendingBlock.block]; !ok || x.region.Size() > apb.pendingBlock.region.Size() {
+					partialBlocks[apb.pendingBlock.block] = apb.pendingBlock
+				}
+			}
+		case pp := <-transfer.peerPiecesChan:
+			if err := piecePicker.AddPeerPieces(pp.peer, pp.pieces); err != nil {
+				log.Printf("peer %s pieces ignored: %v\n", pp.peer.endpoint.ToString(), err)
+			}
+		case peer := <-transfer.removePeerChan:
+			piecePicker.RemovePeer(peer)
+		case res := <-transfer.statusRequest:
+			applyCommands()
+			res <- transfer.makeTransferPieces(&piecePicker)
+		case <-transfer.commandsReady:
+			applyCommands()
+		case pb := <-dataChan:
+			if recheck || rechecking {
+				log.Printf("block %s dropped while recheck\n", pb.block.ToString())
+				break
+			}
+
+			delete(partialBlocks, pb.block)
 			rp, ok := transfer.incomingPieces[pb.block.PieceIndex]
 			if !ok {
 				log.Printf("piece %d was already removed on received block %d\n", pb.block.PieceIndex, pb.block.BlockIndex)
@@ -180,80 +557,24 @@ func (transfer *Transfer) Start(s *Session, atp *proto.AddTransferParameters) {
 				break
 			}
 
-			// write block to the file in advance
-			_, err := file.Seek(int64(pb.block.Start()), 0)
-			if err != nil {
-				lastError = err
-				s.transferChanError <- TransferError{transfer: transfer, err: lastError}
-				break
-			}
+			writeQueue = append(writeQueue, pb)
 
-			_, err = file.Write(pb.data)
-			if err != nil {
-				lastError = err
-				s.transferChanError <- TransferError{transfer: transfer, err: lastError}
+		case peerConnection := <-transfer.peerConnChan:
+			applyCommands()
+			if lastError != nil {
+				log.Println("Ready to download file - transfer error, close")
+				peerConnection.Close(true)
 				break
 			}
 
-			err = file.Sync()
-			if err != nil {
-				lastError = err
-				s.transferChanError <- TransferError{transfer: transfer, err: lastError}
+			if paused {
+				log.Println("Ready to download file - transfer paused, close")
+				peerConnection.Close(true)
 				break
 			}
 
-			piecePicker.FinishBlock(pb.block)
-			s.transferResumeData <- proto.AddTransferParameters{
-				Hashes:           hashes,
-				Filename:         localFilename,
-				Filesize:         transfer.Size,
-				Pieces:           piecePicker.GetPieces(),
-				DownloadedBlocks: piecePicker.GetDownloadedBlocks(),
-			}
-
-			// piece completely downloaded
-			if len(rp.blocks) == piecePicker.BlocksInPiece(pb.block.PieceIndex) {
-				log.Println("Ready to hash")
-				// check hash here
-				if hashSet == nil {
-					panic("hash set is nil!!")
-				}
-
-				if rp.Hash().Equals(hashSet.PieceHashes[pb.block.PieceIndex]) {
-					// match
-					// need to save resume data:
-					log.Println("Hash match")
-					piecePicker.SetHave(pb.block.PieceIndex)
-				} else {
-					log.Printf("Hash not match: %x expected %x\n", rp.Hash(), hashSet.PieceHashes[pb.block.PieceIndex])
-					// restore piece as no-have
-					piecePicker.RemoveDownloadingPiece(pb.block.PieceIndex)
-				}
-
-				s.transferResumeData <- proto.AddTransferParameters{
-					Hashes:           hashes,
-					Filename:         localFilename,
-					Filesize:         transfer.Size,
-					Pieces:           piecePicker.GetPieces(),
-					DownloadedBlocks: piecePicker.GetDownloadedBlocks(),
-				}
-
-				wasFinished := piecePicker.IsFinished()
-				piecePicker.SetHave(pb.block.PieceIndex)
-				delete(transfer.incomingPieces, pb.block.PieceIndex)
-				if !wasFinished && piecePicker.IsFinished() {
-					// disconnect all peers
-					// status finished
-					// need save resume data
-					// nothing to do - all pieces marked as downloaded
-					log.Println("All data was received, close file")
-					s.transferChanFinished <- transfer
-				}
-			}
-
-		case peerConnection := <-transfer.peerConnChan:
-			if lastError != nil {
-				log.Println("Ready to download file - transfer error, close")
+			if recheck || rechecking {
+				log.Println("Ready to download file - transfer recheck, close")
 				peerConnection.Close(true)
 				break
 			}
@@ -261,21 +582,33 @@ func (transfer *Transfer) Start(s *Session, atp *proto.AddTransferParameters) {
 			log.Println("Ready to download file")
 			//if peerConnection.peer == nil
 			blocks := piecePicker.PickPieces(proto.REQUEST_QUEUE_SIZE, peerConnection.peer)
-			req := proto.RequestParts64{Hash: peerConnection.transfer.Hash}
-			for i, x := range blocks {
+			requested := []*PendingBlock{}
+			for _, x := range blocks {
 				// add piece as incoming to the transfer
 				if transfer.incomingPieces[x.PieceIndex] == nil {
-					transfer.incomingPieces[x.PieceIndex] = &ReceivingPiece{hash: md4.New(), blocks: make([]*PendingBlock, 0)}
+					transfer.incomingPieces[x.PieceIndex] = NewReceivingPiece(x.PieceIndex, piecePicker.BlocksInPiece(x.PieceIndex))
+				}
+
+				pb, ok := partialBlocks[x]
+				if ok {
+					// block is completed by data from several peers
+					delete(partialBlocks, x)
+					log.Printf("continue partial block %s missing %d bytes\n", x.ToString(), pb.region.Size())
+				} else {
+					npb := MakePendingBlock(x, peerConnection.transfer.Size)
+					pb = &npb
 				}
-				pb := MakePendingBlock(x, peerConnection.transfer.Size)
-				peerConnection.requestedBlocks = append(peerConnection.requestedBlocks, &pb)
-				req.BeginOffset[i] = pb.region.Begin()
-				req.EndOffset[i] = pb.region.Segments[0].End
-				log.Println("Add to request", req.BeginOffset[i], req.EndOffset[i])
+				requested = append(requested, pb)
+				peerConnection.requestedBlocks = append(peerConnection.requestedBlocks, pb)
 			}
 
 			if len(blocks) > 0 {
-				go peerConnection.SendPacket(s, proto.OP_EMULEPROT, proto.OP_REQUESTPARTS_I64, &req)
+				reqs := MakeRequestParts64(peerConnection.transfer.Hash, requested)
+				go func() {
+					for i := range reqs {
+						peerConnection.SendPacket(s, proto.OP_EMULEPROT, proto.OP_REQUESTPARTS_I64, &reqs[i])
+					}
+				}()
 			} else {
 				log.Println("No more blocks for peer connection")
 				peerConnection.Close(true)
@@ -283,9 +616,146 @@ func (transfer *Transfer) Start(s *Session, atp *proto.AddTransferParameters) {
 		}
 	}
 
+	// state requested before exit is kept in resume data
+	applyCommands()
+	close(stopRecheck)
+	// received blocks are written before exit to keep them in resume data, not started hashing is continued after restart
+	for len(writeQueue) > 0 || writing > 0 || hashing > 0 || rechecking {
+		diskJobs, job := queuedJob()
+		select {
+		case diskJobs <- job:
+			jobSent(job)
+		case res := <-writeResults:
+			blocksWritten(res)
+		case res := <-hashResults:
+			pieceHashed(res)
+		case res := <-recheckResults:
+			recheckFinished(res)
+		}
+	}
+
+	if storage != nil {
+		s.disk.Release(storage)
+		if err := storage.Finalize(); err != nil {
+			log.Printf("can not finalize storage %s: %v\n", transfer.Filename, err)
+		}
+		transfer.storage = storage
+	}
+
 	s.transferChanClosed <- transfer
 }
 
+// SetPriority changes priority of pieces intersecting byte range [begin, end), skipped pieces are never requested
+func (transfer *Transfer) SetPriority(begin uint64, end uint64, priority byte) {
+	transfer.post(transferCommand{action: transferActionPriority, priority: PiecesPriority{begin: begin, end: end, priority: priority}})
+}
+
+func (transfer *Transfer) resumeData(hashes proto.HashSet, piecePicker *PiecePicker, paused bool) proto.AddTransferParameters {
+	return proto.AddTransferParameters{
+		Hashes:           hashes,
+		Filename:         proto.ByteContainer(transfer.Filename),
+		Filesize:         transfer.Size,
+		Pieces:           piecePicker.GetPieces(),
+		DownloadedBlocks: piecePicker.GetDownloadedBlocks(),
+		Priorities:       piecePicker.GetPriorities(),
+		Paused:           paused,
+		Storage:          byte(transfer.StorageMode),
+	}
+}
+
+// boostRange adds or removes boost of pieces in byte range [begin, end), priorities of pieces are kept
+func (transfer *Transfer) boostRange(begin uint64, end uint64, boost bool) {
+	transfer.post(transferCommand{action: transferActionBoost, priority: PiecesPriority{begin: begin, end: end}, boost: boost})
+}
+
+// SetPickStrategy changes order of pieces to download, pieces already downloading are continued
+func (transfer *Transfer) SetPickStrategy(strategy PickStrategy) {
+	transfer.post(transferCommand{action: transferActionStrategy, strategy: strategy})
+}
+
+// post queues command for transfer goroutine, it never blocks and commands are ignored when goroutine has exited
+func (transfer *Transfer) post(cmd transferCommand) {
+	transfer.commandsLock.Lock()
+	transfer.commands = append(transfer.commands, cmd)
+	transfer.commandsLock.Unlock()
+	select {
+	case transfer.commandsReady <- struct{}{}:
+	default:
+		// goroutine was already signaled and takes this command with the previous ones
+	}
+}
+
+func (transfer *Transfer) takeCommands() []transferCommand {
+	transfer.commandsLock.Lock()
+	defer transfer.commandsLock.Unlock()
+	res := transfer.commands
+	transfer.commands = nil
+	return res
+}
+
+// setPaused asks transfer goroutine to stop or continue requesting blocks
+func (transfer *Transfer) setPaused(paused bool) {
+	if paused {
+		transfer.post(transferCommand{action: transferActionPause})
+	} else {
+		transfer.post(transferCommand{action: transferActionResume})
+	}
+}
+
+// receiveHashSet hands hash set received from peer to transfer goroutine, returns false when goroutine has exited
+func (transfer *Transfer) receiveHashSet(hs *proto.HashSet) bool {
+	select {
+	case transfer.hashSetChan <- hs:
+		return true
+	case <-transfer.done:
+		return false
+	}
+}
+
+// receiveBlock passes completed block to transfer goroutine, returns false when goroutine has exited
+func (transfer *Transfer) receiveBlock(pb *PendingBlock) bool {
+	select {
+	case transfer.dataChan <- pb:
+		return true
+	case <-transfer.done:
+		return false
+	}
+}
+
+// readyToDownload asks transfer goroutine for blocks to request from peer, returns false when goroutine has exited
+func (transfer *Transfer) readyToDownload(peerConnection *PeerConnection) bool {
+	select {
+	case transfer.peerConnChan <- peerConnection:
+		return true
+	case <-transfer.done:
+		return false
+	}
+}
+
+// addPeerPieces passes pieces of connected peer to transfer goroutine, ignored when goroutine has exited
+func (transfer *Transfer) addPeerPieces(peer *Peer, pieces proto.BitField) {
+	select {
+	case transfer.peerPiecesChan <- PeerPieces{peer: peer, pieces: pieces}:
+	case <-transfer.done:
+	}
+}
+
+// removePeer removes pieces of disconnected peer from availability, ignored when goroutine has exited
+func (transfer *Transfer) removePeer(peer *Peer) {
+	select {
+	case transfer.removePeerChan <- peer:
+	case <-transfer.done:
+	}
+}
+
+// abortBlock returns block requested from disconnected peer to transfer, ignored when goroutine has exited
+func (transfer *Transfer) abortBlock(pb *PendingBlock, peer *Peer) {
+	select {
+	case transfer.abortPendingBlockChan <- AbortPendingBlock{pendingBlock: pb, peer: peer}:
+	case <-transfer.done:
+	}
+}
+
 func (transfer *Transfer) Stop() {
 	close(transfer.cmdChan)
 }
@@ -0,0 +1,203 @@
+package ged2k
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/a-pavlov/ged2k/proto"
+)
+
+const (
+	transferActionFind = iota
+	transferActionPause
+	transferActionResume
+	transferActionRemove
+	transferActionPriority
+	transferActionStrategy
+	transferActionRecheck
+	transferActionBoost
+)
+
+// TransferParams describes file to download, relative filename is placed to the incoming directory
+type TransferParams struct {
+	Hash        proto.ED2KHash
+	Size        uint64
+	Filename    string
+	PieceHashes []proto.ED2KHash
+	Sources     []proto.Endpoint
+	Storage     StorageMode
+	// link is set when filename comes from the ed2k link and can not be trusted
+	link bool
+}
+
+type addTransferRequest struct {
+	atp         proto.AddTransferParameters
+	sources     []proto.Endpoint
+	sourceFlag  byte
+	storageMode StorageMode
+	res         chan error
+}
+
+type transferRequest struct {
+	hash     proto.ED2KHash
+	action   int
+	begin    uint64
+	end      uint64
+	priority byte
+	strategy PickStrategy
+	// boost is set to add boost of the range and cleared to remove it
+	boost bool
+	// deleteData is set for remove action
+	deleteData bool
+	res        chan error
+}
+
+// TransferHandle controls transfer owned by the session, all methods are safe for concurrent use
+type TransferHandle struct {
+	hash    proto.ED2KHash
+	session *Session
+}
+
+// AddTransferParameters returns parameters of the new transfer, hash set is filled when it is known from the parameters
+func (tp TransferParams) AddTransferParameters(incomingDir string) (proto.AddTransferParameters, error) {
+	if tp.Hash == proto.ZERO || tp.Size == 0 || tp.Filename == "" {
+		return proto.AddTransferParameters{}, fmt.Errorf("transfer parameters are incomplete: hash %s size %d filename \"%s\"", tp.Hash.ToString(), tp.Size, tp.Filename)
+	}
+
+	filename := tp.Filename
+	if tp.link {
+		filename = filepath.Base(filename)
+	}
+
+	if tp.link || !filepath.IsAbs(filename) {
+		filename = filepath.Join(incomingDir, filename)
+		if rel, err := filepath.Rel(incomingDir, filename); err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return proto.AddTransferParameters{}, fmt.Errorf("transfer filename \"%s\" is outside of the incoming directory", tp.Filename)
+		}
+	}
+
+	atp := proto.CreateAddTransferParameters(tp.Hash, tp.Size, filename)
+	if tp.Size < proto.PIECE_SIZE_UINT64 {
+		atp.Hashes.PieceHashes = []proto.ED2KHash{tp.Hash}
+	} else if len(tp.PieceHashes) > 0 {
+		hs := proto.HashSet{Hash: tp.Hash, PieceHashes: tp.PieceHashes}
+		if !hs.IsValid(tp.Size) {
+			return proto.AddTransferParameters{}, fmt.Errorf("transfer %s has incorrect piece hashes", tp.Hash.ToString())
+		}
+		atp.Hashes = hs
+	}
+
+	return atp, nil
+}
+
+// AddTransfer starts downloading of the file or adds sources to the existing transfer with the same hash
+func (s *Session) AddTransfer(params TransferParams) (*TransferHandle, error) {
+	atp, err := params.AddTransferParameters(s.configuration.IncomingDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.addTransferParameters(atp, params.Sources, PEER_SRC_API, params.Storage)
+}
+
+// LoadTransfer restores transfer from the resume data file
+func (s *Session) LoadTransfer(resumeDataFile string) (*TransferHandle, error) {
+	atp, _, err := readResumeData(resumeDataFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = validateResumeData(&atp); err != nil {
+		return nil, err
+	}
+
+	return s.addTransferParameters(atp, nil, PEER_SRC_RESUME_DATA, StorageMode(atp.Storage))
+}
+
+func (s *Session) addTransferParameters(atp proto.AddTransferParameters, sources []proto.Endpoint, sourceFlag byte, storageMode StorageMode) (*TransferHandle, error) {
+	res := make(chan error, 1)
+	select {
+	case s.addTransferRequest <- addTransferRequest{atp: atp, sources: sources, sourceFlag: sourceFlag, storageMode: storageMode, res: res}:
+	case <-s.done:
+		return nil, ErrSessionClosed
+	}
+
+	if err := <-res; err != nil {
+		return nil, err
+	}
+
+	return &TransferHandle{hash: atp.Hashes.Hash, session: s}, nil
+}
+
+// Transfer returns handle of the existing transfer or nil
+func (s *Session) Transfer(hash proto.ED2KHash) *TransferHandle {
+	th := &TransferHandle{hash: hash, session: s}
+	if th.request(transferRequest{action: transferActionFind}) != nil {
+		return nil
+	}
+
+	return th
+}
+
+func (th *TransferHandle) Hash() proto.ED2KHash {
+	return th.hash
+}
+
+func (th *TransferHandle) request(req transferRequest) error {
+	req.hash = th.hash
+	req.res = make(chan error, 1)
+	select {
+	case th.session.transferRequest <- req:
+		return <-req.res
+	case <-th.session.done:
+		return ErrSessionClosed
+	}
+}
+
+// Pause stops requesting sources and closes peer connections of the transfer, resume data is saved
+func (th *TransferHandle) Pause() error {
+	return th.request(transferRequest{action: transferActionPause})
+}
+
+// Resume requests sources of the paused transfer again
+func (th *TransferHandle) Resume() error {
+	return th.request(transferRequest{action: transferActionResume})
+}
+
+// Remove stops the transfer and removes it from the session, file and resume data are deleted when deleteData is set
+func (th *TransferHandle) Remove(deleteData bool) error {
+	return th.request(transferRequest{action: transferActionRemove, deleteData: deleteData})
+}
+
+// SetPriority changes priority of pieces intersecting byte range [begin, end), skipped pieces are never requested
+func (th *TransferHandle) SetPriority(begin uint64, end uint64, priority byte) error {
+	if priority > proto.PIECE_PRIORITY_HIGH {
+		return fmt.Errorf("incorrect priority %d", priority)
+	}
+
+	return th.request(transferRequest{action: transferActionPriority, begin: begin, end: end, priority: priority})
+}
+
+// boost adds or removes boost of pieces in byte range [begin, end), boosted pieces are downloaded first for streaming
+func (th *TransferHandle) boost(begin uint64, end uint64, boost bool) error {
+	return th.request(transferRequest{action: transferActionBoost, begin: begin, end: end, boost: boost})
+}
+
+// Recheck verifies data of the transfer against its hash set, pieces which fail are downloaded again, when all
+// pieces match the file hash is checked too, result is reported by TransferRecheckedEvent. Transfer of file
+// larger than one piece without hash set from TransferParams.PieceHashes or resume data waits until trusted
+// hash set is received from a peer
+func (th *TransferHandle) Recheck() error {
+	return th.request(transferRequest{action: transferActionRecheck})
+}
+
+// SetPickStrategy changes order of pieces to download, pieces already downloading are continued
+func (th *TransferHandle) SetPickStrategy(name string) error {
+	strategy, err := PickStrategyFromString(name)
+	if err != nil {
+		return err
+	}
+
+	return th.request(transferRequest{action: transferActionStrategy, strategy: strategy})
+}
@@ -0,0 +1,194 @@
+package ged2k
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/a-pavlov/ged2k/proto"
+)
+
+func Test_TransferParams(t *testing.T) {
+	if _, err := (TransferParams{Hash: proto.EMULE, Filename: "a.bin"}).AddTransferParameters("/tmp"); err == nil {
+		t.Error("Transfer without size was accepted")
+	}
+
+	atp, err := TransferParams{Hash: proto.EMULE, Size: 100, Filename: "a.bin"}.AddTransferParameters("/tmp")
+	if err != nil || atp.Filename.ToString() != filepath.Join("/tmp", "a.bin") || !atp.Hashes.IsValid(100) {
+		t.Errorf("Small transfer parameters incorrect %v %v", atp, err)
+	}
+
+	atp, err = TransferParams{Hash: proto.EMULE, Size: proto.PIECE_SIZE_UINT64 + 1, Filename: "/data/a.bin"}.AddTransferParameters("/tmp")
+	if err != nil || atp.Filename.ToString() != "/data/a.bin" || len(atp.Hashes.PieceHashes) != 0 {
+		t.Errorf("Absolute filename parameters incorrect %v %v", atp, err)
+	}
+
+	if _, err = (TransferParams{Hash: proto.EMULE, Size: proto.PIECE_SIZE_UINT64 + 1, Filename: "a.bin", PieceHashes: []proto.ED2KHash{proto.EMULE}}).AddTransferParameters("/tmp"); err == nil {
+		t.Error("Incorrect piece hashes were accepted")
+	}
+
+	for _, name := range []string{"../../.bashrc", "/etc/cron.d/x", "..", "/"} {
+		atp, err = TransferParams{Hash: proto.EMULE, Size: 100, Filename: name, link: true}.AddTransferParameters("/tmp")
+		if err == nil && filepath.Dir(atp.Filename.ToString()) != "/tmp" {
+			t.Errorf("Link filename %s was placed outside of the incoming directory %s", name, atp.Filename.ToString())
+		}
+	}
+
+	if _, err = (TransferParams{Hash: proto.EMULE, Size: 100, Filename: "../a.bin"}).AddTransferParameters("/tmp"); err == nil {
+		t.Error("Relative filename outside of the incoming directory was accepted")
+	}
+}
+
+func Test_SessionTransferHandle(t *testing.T) {
+	if _, err := NewSession(Config{}); err == nil {
+		t.Error("Session without incoming directory was created")
+	}
+
+	s, err := NewSession(Config{IncomingDir: t.TempDir(), UserAgent: proto.EMULE})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Start()
+	defer s.Stop()
+
+	if _, err := s.Search("test"); err == nil {
+		t.Error("Search without server was accepted")
+	}
+
+	if s.Transfer(proto.EMULE) != nil {
+		t.Error("Not existing transfer was found")
+	}
+
+	th, err := s.AddTransfer(TransferParams{Hash: proto.EMULE, Size: 100, Filename: "a.bin"})
+	if err != nil || th.Hash() != proto.EMULE {
+		t.Fatalf("Can not add transfer %v", err)
+	}
+
+	if s.Transfer(proto.EMULE) == nil || th.Pause() != nil || th.Resume() != nil || th.SetPickStrategy(PICK_STRATEGY_SEQUENTIAL) != nil {
+		t.Error("Transfer actions failed")
+	}
+
+	if th.SetPickStrategy("unknown") == nil || th.SetPriority(0, 100, 10) == nil {
+		t.Error("Incorrect transfer parameters were accepted")
+	}
+
+	if th.Remove(false) != nil {
+		t.Error("Can not remove transfer")
+	}
+
+	if th.Pause() == nil {
+		t.Error("Removed transfer was paused")
+	}
+
+	for i := 0; i < 50 && s.Transfer(proto.EMULE) == nil; i++ {
+		// transfer goroutine closes asynchronously
+		if _, err = s.AddTransfer(TransferParams{Hash: proto.EMULE, Size: 100, Filename: "a.bin"}); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if err != nil {
+		t.Errorf("Transfer can not be added after remove %v", err)
+	}
+}
+
+func Test_SessionTransferLifecycle(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewSession(Config{IncomingDir: dir, UserAgent: proto.EMULE})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub := s.Subscribe(EVENT_CATEGORY_TRANSFER, 0)
+	defer s.Unsubscribe(sub)
+	s.Start()
+	defer s.Stop()
+
+	waitEvent := func(expected Event) {
+		for {
+			select {
+			case e := <-sub.Events():
+				if e == expected {
+					return
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Event %v was not received", expected)
+			}
+		}
+	}
+
+	th, err := s.AddTransfer(TransferParams{Hash: proto.EMULE, Size: 100, Filename: "a.bin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if th.Pause() != nil || th.Pause() != nil {
+		t.Fatal("Can not pause transfer")
+	}
+
+	waitEvent(TransferPausedEvent{Hash: proto.EMULE})
+	if ts, err := th.Status(); err != nil || !ts.Paused {
+		t.Errorf("Transfer is not paused %v %v", ts.TransferSummary, err)
+	}
+
+	if th.Resume() != nil {
+		t.Fatal("Can not resume transfer")
+	}
+
+	waitEvent(TransferResumedEvent{Hash: proto.EMULE})
+	if ts, err := th.Status(); err != nil || ts.Paused {
+		t.Errorf("Transfer is still paused %v %v", ts.TransferSummary, err)
+	}
+
+	files := []string{filepath.Join(dir, "a.bin"), filepath.Join(dir, proto.EMULE.ToString()+".rd")}
+	for _, x := range files {
+		if _, err := os.Stat(x); err != nil {
+			t.Errorf("Transfer file is not created %v", err)
+		}
+	}
+
+	if th.Remove(true) != nil {
+		t.Fatal("Can not remove transfer")
+	}
+
+	waitEvent(TransferRemovedEvent{Hash: proto.EMULE})
+	for _, x := range files {
+		if _, err := os.Stat(x); !os.IsNotExist(err) {
+			t.Errorf("Transfer file %s was not deleted %v", x, err)
+		}
+	}
+}
+
+func Test_SessionPauseResume(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewSession(Config{IncomingDir: dir, UserAgent: proto.EMULE})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Start()
+	th, err := s.AddTransfer(TransferParams{Hash: proto.EMULE, Size: 100, Filename: "a.bin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// transfer goroutine applies changes in order of requests
+	for i := 0; i < 20; i++ {
+		if th.Pause() != nil || th.Resume() != nil {
+			t.Fatal("Can not pause and resume transfer")
+		}
+	}
+
+	if ts, err := th.Status(); err != nil || ts.Paused {
+		t.Errorf("Transfer is still paused %v %v", ts.TransferSummary, err)
+	}
+
+	s.Stop()
+	atp, _, err := readResumeData(filepath.Join(dir, proto.EMULE.ToString()+RESUME_DATA_EXT))
+	if err != nil || atp.Paused {
+		t.Errorf("Resumed transfer was saved as paused %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+package ged2k
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"os"
+
+	"github.com/a-pavlov/ged2k/proto"
+)
+
+// UPLOAD_PACKET_SIZE is the size of data sent in one OP_SENDINGPART packet
+const UPLOAD_PACKET_SIZE uint64 = 10240
+
+// SharedFile describes file we are able to upload to other peers
+type SharedFile struct {
+	Hash     proto.ED2KHash
+	Size     uint64
+	Filename string
+	HashSet  proto.HashSet
+	Pieces   proto.BitField
+	Priority int
+	// memory is set for file of the transfer which keeps data in memory only, there is no file to read
+	memory bool
+}
+
+type sharedFileRequest struct {
+	hash proto.ED2KHash
+	// transfers requests file of the active transfer even without verified pieces
+	transfers bool
+	res       chan *SharedFile
+}
+
+type uploadSlotRequest struct {
+	connection *PeerConnection
+	userHash   proto.ED2KHash
+	hash       proto.ED2KHash
+	checkOnly  bool
+	res        chan int
+}
+
+// FromAddTransferParameters returns shared file with verified pieces of the transfer or nil when transfer can not be shared yet
+func FromAddTransferParameters(atp *proto.AddTransferParameters) *SharedFile {
+	if !atp.Hashes.IsValid(atp.Filesize) {
+		return nil
+	}
+
+	pieces := VerifiedPieces(atp)
+	if pieces.Count() == 0 {
+		return nil
+	}
+
+	return &SharedFile{
+		Hash:     atp.Hashes.Hash,
+		Size:     atp.Filesize,
+		Filename: atp.Filename.ToString(),
+		HashSet:  atp.Hashes,
+		Pieces:   pieces,
+		Priority: UPLOAD_PRIORITY_NORMAL,
+	}
+}
+
+// VerifiedPieces returns pieces passed hash check. Piece picker marks downloading pieces as have,
+// so pieces with downloaded blocks are excluded
+func VerifiedPieces(atp *proto.AddTransferParameters) proto.BitField {
+	res := proto.CloneBitField(atp.Pieces)
+	for i := range atp.DownloadedBlocks {
+		if i < res.Bits() {
+			res.ClearBit(i)
+		}
+	}
+
+	return res
+}
+
+func (sf *SharedFile) FileStatus() proto.FileStatusAnswer {
+	return proto.FileStatusAnswer{Hash: sf.Hash, BF: proto.CloneBitField(sf.Pieces)}
+}
+
+// HaveRange returns true when all pieces covering range [begin, end) are available
+func (sf *SharedFile) HaveRange(begin uint64, end uint64) bool {
+	if begin >= end || end > sf.Size {
+		return false
+	}
+
+	for i := int(begin / proto.PIECE_SIZE_UINT64); i <= int((end-1)/proto.PIECE_SIZE_UINT64); i++ {
+		if i >= sf.Pieces.Bits() || !sf.Pieces.GetBit(i) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (sf *SharedFile) ReadRange(begin uint64, end uint64) ([]byte, error) {
+	if !sf.HaveRange(begin, end) {
+		return nil, fmt.Errorf("range [%d:%d] is not available in %s", begin, end, sf.Hash.ToString())
+	}
+
+	file, err := os.Open(sf.Filename)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+	data := make([]byte, end-begin)
+	if _, err = file.ReadAt(data, int64(begin)); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// Compress returns zlib packed data or nil when packed data is not smaller than original
+func Compress(data []byte) []byte {
+	var b bytes.Buffer
+	z := zlib.NewWriter(&b)
+	if _, err := z.Write(data); err != nil {
+		return nil
+	}
+
+	if err := z.Close(); err != nil || b.Len() >= len(data) {
+		return nil
+	}
+
+	return b.Bytes()
+}
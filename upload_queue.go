@@ -0,0 +1,305 @@
+package ged2k
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/a-pavlov/ged2k/proto"
+)
+
+const UPLOAD_SLOTS_MIN int = 2
+const UPLOAD_SLOTS_MAX int = 10
+
+// UPLOAD_SLOT_RATE is upload rate in bytes per second expected for one upload slot
+const UPLOAD_SLOT_RATE int = 3 * 1024
+const UPLOAD_SLOT_TIME = time.Minute * time.Duration(30)
+const UPLOAD_SLOT_BYTES uint64 = proto.PIECE_SIZE_UINT64
+const UPLOAD_QUEUE_SIZE int = 1000
+
+// UPLOAD_QUEUE_ENTRY_TIMEOUT is how long disconnected peer keeps its place in the queue
+const UPLOAD_QUEUE_ENTRY_TIMEOUT = time.Hour
+
+const (
+	UPLOAD_PRIORITY_VERYLOW = iota
+	UPLOAD_PRIORITY_LOW
+	UPLOAD_PRIORITY_NORMAL
+	UPLOAD_PRIORITY_HIGH
+	UPLOAD_PRIORITY_RELEASE
+)
+
+func uploadPriorityFactor(priority int) float64 {
+	switch priority {
+	case UPLOAD_PRIORITY_VERYLOW:
+		return 0.2
+	case UPLOAD_PRIORITY_LOW:
+		return 0.6
+	case UPLOAD_PRIORITY_HIGH:
+		return 0.9
+	case UPLOAD_PRIORITY_RELEASE:
+		return 1.8
+	default:
+		return 0.7
+	}
+}
+
+// ClientCredit tracks bytes exchanged with the remote client identified by user hash
+type ClientCredit struct {
+	Uploaded   uint64
+	Downloaded uint64
+}
+
+// Ratio returns eMule-like credit modifier from 1 to 10, peers uploaded to us more get better ratio
+func (cc ClientCredit) Ratio() float64 {
+	if cc.Downloaded < 1024*1024 {
+		return 1
+	}
+
+	ratio := 10.0
+	if cc.Uploaded > 0 {
+		ratio = float64(cc.Downloaded) * 2 / float64(cc.Uploaded)
+	}
+
+	if r := math.Sqrt(float64(cc.Downloaded)/(1024*1024) + 2); r < ratio {
+		ratio = r
+	}
+
+	return math.Max(1, math.Min(ratio, 10))
+}
+
+type UploadSlot struct {
+	connection *PeerConnection
+	UserHash   proto.ED2KHash
+	Endpoint   proto.Endpoint
+	Hash       proto.ED2KHash
+	Started    time.Time
+	Bytes      uint64
+	Priority   int
+	Credit     float64
+}
+
+type UploadWaiter struct {
+	connection *PeerConnection
+	UserHash   proto.ED2KHash
+	Endpoint   proto.Endpoint
+	Hash       proto.ED2KHash
+	Enqueued   time.Time
+	LastSeen   time.Time
+	Priority   int
+	Credit     float64
+}
+
+// Score grows with waiting time and is scaled by the file priority and client credits
+func (uw *UploadWaiter) Score(t time.Time) float64 {
+	return t.Sub(uw.Enqueued).Seconds() * uploadPriorityFactor(uw.Priority) * uw.Credit
+}
+
+type UploadQueueStatus struct {
+	MaxSlots int
+	Slots    []UploadSlot
+	Waiting  []UploadWaiter
+}
+
+// UploadQueue allocates upload slots and keeps other peers waiting ordered by score
+type UploadQueue struct {
+	MaxSlots int
+	slots    []*UploadSlot
+	waiting  []*UploadWaiter
+}
+
+func MakeUploadQueue(maxSlots int) UploadQueue {
+	return UploadQueue{MaxSlots: maxSlots, slots: make([]*UploadSlot, 0), waiting: make([]*UploadWaiter, 0)}
+}
+
+// UploadSlotsCount returns count of slots allowed by upload rate limit, zero rate means no limit
+func UploadSlotsCount(maxUploadRate int, maxSlots int) int {
+	if maxSlots <= 0 {
+		maxSlots = UPLOAD_SLOTS_MAX
+	}
+
+	if maxUploadRate <= 0 {
+		return maxSlots
+	}
+
+	res := maxUploadRate / UPLOAD_SLOT_RATE
+	if res < UPLOAD_SLOTS_MIN {
+		res = UPLOAD_SLOTS_MIN
+	}
+
+	if res > maxSlots {
+		res = maxSlots
+	}
+
+	return res
+}
+
+func (uq *UploadQueue) slotIndex(connection *PeerConnection) int {
+	for i, x := range uq.slots {
+		if x.connection == connection {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// waiterIndex finds waiter by peer address and user hash. Reconnected peer comes from another port,
+// so port is compared only for peers without user hash to keep them apart
+func (uq *UploadQueue) waiterIndex(endpoint proto.Endpoint, userHash proto.ED2KHash) int {
+	for i, x := range uq.waiting {
+		if x.Endpoint.Ip == endpoint.Ip && x.UserHash == userHash && (userHash != proto.ZERO || x.Endpoint.Port == endpoint.Port) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// rank returns 1-based position of the waiter by score
+func (uq *UploadQueue) rank(waiter *UploadWaiter, t time.Time) int {
+	res := 1
+	score := waiter.Score(t)
+	for _, x := range uq.waiting {
+		if x != waiter && x.Score(t) > score {
+			res++
+		}
+	}
+
+	return res
+}
+
+func (uq *UploadQueue) hasConnectedWaiters() bool {
+	for _, x := range uq.waiting {
+		if x.connection != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Request registers upload request and returns 0 when slot was given or position in the queue.
+// Returns -1 when queue is full
+func (uq *UploadQueue) Request(connection *PeerConnection, userHash proto.ED2KHash, hash proto.ED2KHash, priority int, credit float64, t time.Time) int {
+	if i := uq.slotIndex(connection); i != -1 {
+		uq.slots[i].Hash = hash
+		return 0
+	}
+
+	if i := uq.waiterIndex(connection.Endpoint, userHash); i != -1 {
+		w := uq.waiting[i]
+		w.connection = connection
+		w.Endpoint = connection.Endpoint
+		w.Hash = hash
+		w.Priority = priority
+		w.Credit = credit
+		w.LastSeen = t
+		return uq.rank(w, t)
+	}
+
+	if len(uq.slots) < uq.MaxSlots && !uq.hasConnectedWaiters() {
+		uq.slots = append(uq.slots, &UploadSlot{connection: connection, UserHash: userHash, Endpoint: connection.Endpoint, Hash: hash, Started: t, Priority: priority, Credit: credit})
+		return 0
+	}
+
+	if len(uq.waiting) >= UPLOAD_QUEUE_SIZE {
+		return -1
+	}
+
+	w := &UploadWaiter{connection: connection, UserHash: userHash, Endpoint: connection.Endpoint, Hash: hash, Enqueued: t, LastSeen: t, Priority: priority, Credit: credit}
+	uq.waiting = append(uq.waiting, w)
+	return uq.rank(w, t)
+}
+
+func (uq *UploadQueue) HasSlot(connection *PeerConnection) bool {
+	return uq.slotIndex(connection) != -1
+}
+
+func (uq *UploadQueue) AddBytes(connection *PeerConnection, bytes int) {
+	if i := uq.slotIndex(connection); i != -1 {
+		uq.slots[i].Bytes += uint64(bytes)
+	}
+}
+
+// Disconnected frees slot of the connection, waiting peer keeps its place for a while
+func (uq *UploadQueue) Disconnected(connection *PeerConnection, t time.Time) {
+	if i := uq.slotIndex(connection); i != -1 {
+		uq.slots = append(uq.slots[:i], uq.slots[i+1:]...)
+	}
+
+	for _, x := range uq.waiting {
+		if x.connection == connection {
+			x.connection = nil
+			x.LastSeen = t
+		}
+	}
+}
+
+// Tick rotates slots exceeded time or bytes budget when somebody is waiting and gives free slots to the best waiters.
+// Returns connections lost their slots and connections got new slots
+func (uq *UploadQueue) Tick(t time.Time) ([]*PeerConnection, []*PeerConnection) {
+	rotated := make([]*PeerConnection, 0)
+	accepted := make([]*PeerConnection, 0)
+
+	waiting := uq.waiting[:0]
+	for _, x := range uq.waiting {
+		if x.connection != nil || t.Before(x.LastSeen.Add(UPLOAD_QUEUE_ENTRY_TIMEOUT)) {
+			waiting = append(waiting, x)
+		}
+	}
+	uq.waiting = waiting
+
+	if uq.hasConnectedWaiters() {
+		slots := uq.slots[:0]
+		for _, x := range uq.slots {
+			if t.After(x.Started.Add(UPLOAD_SLOT_TIME)) || x.Bytes >= UPLOAD_SLOT_BYTES || len(slots) >= uq.MaxSlots {
+				rotated = append(rotated, x.connection)
+				uq.waiting = append(uq.waiting, &UploadWaiter{connection: x.connection, UserHash: x.UserHash, Endpoint: x.Endpoint, Hash: x.Hash,
+					Enqueued: t, LastSeen: t, Priority: x.Priority, Credit: x.Credit})
+			} else {
+				slots = append(slots, x)
+			}
+		}
+		uq.slots = slots
+	}
+
+	for len(uq.slots) < uq.MaxSlots {
+		best := -1
+		for i, x := range uq.waiting {
+			if x.connection != nil && (best == -1 || x.Score(t) > uq.waiting[best].Score(t)) {
+				best = i
+			}
+		}
+
+		if best == -1 {
+			break
+		}
+
+		w := uq.waiting[best]
+		uq.waiting = append(uq.waiting[:best], uq.waiting[best+1:]...)
+		uq.slots = append(uq.slots, &UploadSlot{connection: w.connection, UserHash: w.UserHash, Endpoint: w.Endpoint, Hash: w.Hash, Started: t, Priority: w.Priority, Credit: w.Credit})
+		accepted = append(accepted, w.connection)
+	}
+
+	return rotated, accepted
+}
+
+// Status returns copy of slots and waiting peers ordered by score
+func (uq *UploadQueue) Status(t time.Time) UploadQueueStatus {
+	res := UploadQueueStatus{MaxSlots: uq.MaxSlots, Slots: make([]UploadSlot, 0, len(uq.slots)), Waiting: make([]UploadWaiter, 0, len(uq.waiting))}
+	for _, x := range uq.slots {
+		res.Slots = append(res.Slots, *x)
+		res.Slots[len(res.Slots)-1].connection = nil
+	}
+
+	for _, x := range uq.waiting {
+		res.Waiting = append(res.Waiting, *x)
+		res.Waiting[len(res.Waiting)-1].connection = nil
+	}
+
+	sort.SliceStable(res.Waiting, func(i, j int) bool {
+		return res.Waiting[i].Score(t) > res.Waiting[j].Score(t)
+	})
+
+	return res
+}
@@ -0,0 +1,127 @@
+package ged2k
+
+import (
+	"testing"
+	"time"
+
+	"github.com/a-pavlov/ged2k/proto"
+)
+
+func Test_UploadSlotsCount(t *testing.T) {
+	if UploadSlotsCount(0, 0) != UPLOAD_SLOTS_MAX || UploadSlotsCount(0, 4) != 4 {
+		t.Error("Unlimited upload slots count incorrect")
+	}
+
+	if UploadSlotsCount(1024, 0) != UPLOAD_SLOTS_MIN || UploadSlotsCount(UPLOAD_SLOT_RATE*5, 0) != 5 || UploadSlotsCount(UPLOAD_SLOT_RATE*100, 7) != 7 {
+		t.Error("Upload slots count by rate incorrect")
+	}
+}
+
+func Test_ClientCreditRatio(t *testing.T) {
+	if (ClientCredit{Downloaded: 1000}).Ratio() != 1 {
+		t.Error("Small credit must have ratio 1")
+	}
+
+	if (ClientCredit{Downloaded: 100 * 1024 * 1024}).Ratio() != 10 {
+		t.Error("Credit without upload must have max ratio")
+	}
+
+	if (ClientCredit{Downloaded: 2 * 1024 * 1024, Uploaded: 100 * 1024 * 1024}).Ratio() != 1 {
+		t.Error("Credit of leecher must have min ratio")
+	}
+}
+
+func Test_UploadQueueSlots(t *testing.T) {
+	now := time.Now()
+	uq := MakeUploadQueue(1)
+	pc1 := NewPeerConnection(proto.EndpointFromString("192.168.0.1:4662"), nil, nil)
+	pc2 := NewPeerConnection(proto.EndpointFromString("192.168.0.2:4662"), nil, nil)
+	pc3 := NewPeerConnection(proto.EndpointFromString("192.168.0.3:4662"), nil, nil)
+
+	if uq.Request(pc1, proto.EMULE, proto.EMULE, UPLOAD_PRIORITY_NORMAL, 1, now) != 0 || !uq.HasSlot(pc1) {
+		t.Error("First peer did not get upload slot")
+	}
+
+	if uq.Request(pc2, proto.LIBED2K, proto.EMULE, UPLOAD_PRIORITY_NORMAL, 1, now) != 1 || uq.HasSlot(pc2) {
+		t.Error("Second peer must be first in queue")
+	}
+
+	// third peer waits less but has much better score
+	if uq.Request(pc3, proto.Terminal, proto.EMULE, UPLOAD_PRIORITY_RELEASE, 10, now.Add(time.Second)) != 2 {
+		t.Error("Third peer must be second in queue")
+	}
+
+	later := now.Add(time.Minute)
+	if uq.Request(pc3, proto.Terminal, proto.EMULE, UPLOAD_PRIORITY_RELEASE, 10, later) != 1 {
+		t.Error("Third peer must be first in queue by score")
+	}
+
+	rotated, accepted := uq.Tick(later)
+	if len(rotated) != 0 || len(accepted) != 0 {
+		t.Error("Slot must not be rotated before budget exceeded")
+	}
+
+	uq.AddBytes(pc1, int(UPLOAD_SLOT_BYTES))
+	rotated, accepted = uq.Tick(later)
+	if len(rotated) != 1 || rotated[0] != pc1 || len(accepted) != 1 || accepted[0] != pc3 || !uq.HasSlot(pc3) || uq.HasSlot(pc1) {
+		t.Errorf("Slot rotation incorrect rotated %d accepted %d", len(rotated), len(accepted))
+	}
+
+	status := uq.Status(later.Add(time.Minute))
+	if len(status.Slots) != 1 || len(status.Waiting) != 2 || status.Waiting[0].UserHash != proto.LIBED2K {
+		t.Errorf("Upload queue status incorrect %v", status)
+	}
+
+	// slot owner disconnected - next waiter gets slot
+	uq.Disconnected(pc3, later)
+	_, accepted = uq.Tick(later.Add(time.Minute))
+	if len(accepted) != 1 || accepted[0] != pc2 {
+		t.Error("Free slot was not given to the best waiter")
+	}
+
+	// disconnected waiter is removed after timeout
+	uq.Disconnected(pc1, later)
+	uq.Tick(later.Add(UPLOAD_QUEUE_ENTRY_TIMEOUT + time.Second))
+	if len(uq.Status(later).Waiting) != 0 {
+		t.Error("Disconnected waiter was not removed")
+	}
+}
+
+func Test_UploadQueueWaitersByEndpoint(t *testing.T) {
+	now := time.Now()
+	uq := MakeUploadQueue(1)
+	pc1 := NewPeerConnection(proto.EndpointFromString("192.168.0.1:4662"), nil, nil)
+	pc2 := NewPeerConnection(proto.EndpointFromString("192.168.0.2:4662"), nil, nil)
+	pc3 := NewPeerConnection(proto.EndpointFromString("192.168.0.2:4663"), nil, nil)
+	pc4 := NewPeerConnection(proto.EndpointFromString("192.168.0.3:4662"), nil, nil)
+
+	if uq.Request(pc1, proto.EMULE, proto.EMULE, UPLOAD_PRIORITY_NORMAL, 1, now) != 0 {
+		t.Error("First peer did not get upload slot")
+	}
+
+	// peers without user hash must not share waiter entry
+	if uq.Request(pc2, proto.ZERO, proto.EMULE, UPLOAD_PRIORITY_NORMAL, 1, now) != 1 || uq.Request(pc3, proto.ZERO, proto.EMULE, UPLOAD_PRIORITY_NORMAL, 1, now) != 1 {
+		t.Error("Zero hash peers must be queued")
+	}
+
+	if uq.Request(pc4, proto.LIBED2K, proto.EMULE, UPLOAD_PRIORITY_NORMAL, 1, now.Add(time.Second)) != 3 {
+		t.Error("Peer must be third in queue")
+	}
+
+	if len(uq.Status(now).Waiting) != 3 {
+		t.Errorf("Zero hash peers overwrote each other %v", uq.Status(now))
+	}
+
+	// same user reconnected from another port keeps its place
+	uq.Disconnected(pc4, now.Add(time.Second))
+	pc5 := NewPeerConnection(proto.EndpointFromString("192.168.0.3:4700"), nil, nil)
+	if uq.Request(pc5, proto.LIBED2K, proto.EMULE, UPLOAD_PRIORITY_NORMAL, 1, now.Add(2*time.Second)) != 3 || len(uq.Status(now).Waiting) != 3 {
+		t.Error("Reconnected peer did not keep its waiter entry")
+	}
+
+	// another user from the same address gets own entry
+	pc6 := NewPeerConnection(proto.EndpointFromString("192.168.0.3:4701"), nil, nil)
+	if uq.Request(pc6, proto.Terminal, proto.EMULE, UPLOAD_PRIORITY_NORMAL, 1, now.Add(2*time.Second)) != 4 {
+		t.Error("Different user from the same address must be queued separately")
+	}
+}
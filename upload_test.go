@@ -0,0 +1,185 @@
+package ged2k
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/a-pavlov/ged2k/proto"
+)
+
+func createUploadFile(t *testing.T, size int) (SharedFile, []byte) {
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = byte(i % 7)
+	}
+
+	filename := filepath.Join(t.TempDir(), "upload.bin")
+	if err := os.WriteFile(filename, content, 0666); err != nil {
+		t.Fatalf("Can not create file %v", err)
+	}
+
+	pieces := proto.CreateBitField(1)
+	pieces.SetBit(0)
+	return SharedFile{Hash: proto.EMULE, Size: uint64(size), Filename: filename, HashSet: proto.HashSet{Hash: proto.EMULE, PieceHashes: []proto.ED2KHash{proto.EMULE}}, Pieces: pieces}, content
+}
+
+func Test_SharedFileFromParameters(t *testing.T) {
+	atp := proto.CreateAddTransferParameters(proto.EMULE, 100, "/tmp/a.bin")
+	if FromAddTransferParameters(&atp) != nil {
+		t.Error("Transfer without data was shared")
+	}
+
+	atp.Pieces.SetBit(0)
+	if FromAddTransferParameters(&atp) != nil {
+		t.Error("Transfer without hash set was shared")
+	}
+
+	atp.Hashes.PieceHashes = []proto.ED2KHash{proto.EMULE}
+	sf := FromAddTransferParameters(&atp)
+	if sf == nil || sf.Size != 100 || sf.Filename != "/tmp/a.bin" || sf.FileStatus().BF.Count() != 1 || !sf.Complete() {
+		t.Errorf("Shared file created incorrectly %v", sf)
+	}
+}
+
+func Test_SharedFilePartial(t *testing.T) {
+	size := proto.PIECE_SIZE_UINT64*2 + 100
+	pieceHashes := []proto.ED2KHash{proto.EMULE, proto.LIBED2K, proto.Terminal}
+	atp := proto.CreateAddTransferParameters(proto.ResultHash(pieceHashes), size, "/tmp/a.bin")
+	atp.Hashes.PieceHashes = pieceHashes
+	atp.Pieces.SetBit(1)
+	atp.DownloadedBlocks[1] = proto.CreateBitField(proto.BLOCKS_PER_PIECE)
+	if FromAddTransferParameters(&atp) != nil {
+		t.Error("Transfer without verified pieces was shared")
+	}
+
+	atp.Pieces.SetBit(0)
+	sf := FromAddTransferParameters(&atp)
+	if sf == nil || sf.Complete() || sf.Pieces.Count() != 1 || !sf.Pieces.GetBit(0) {
+		t.Fatalf("Partial file shared incorrectly %v", sf)
+	}
+
+	if !sf.HaveRange(0, 100) || sf.HaveRange(proto.PIECE_SIZE_UINT64, proto.PIECE_SIZE_UINT64+100) {
+		t.Error("Only verified ranges must be available")
+	}
+
+	if atp.Pieces.Count() != 2 {
+		t.Error("Transfer pieces must not be changed")
+	}
+
+	offer := sf.Offer(proto.IdChange{TcpFlags: proto.SRV_TCPFLG_COMPRESSION}, 4662)
+	if offer.Point.Ip != proto.OFFER_INCOMPLETE_ID {
+		t.Errorf("Partial file must be offered as incomplete %v", offer.Point)
+	}
+}
+
+func Test_SharedFileRange(t *testing.T) {
+	pieces := proto.CreateBitField(3)
+	pieces.SetBit(0)
+	pieces.SetBit(2)
+	sf := SharedFile{Size: proto.PIECE_SIZE_UINT64*2 + 100, Pieces: pieces}
+	if !sf.HaveRange(0, 100) || !sf.HaveRange(proto.PIECE_SIZE_UINT64*2, proto.PIECE_SIZE_UINT64*2+100) {
+		t.Error("Available range was not detected")
+	}
+
+	if sf.HaveRange(proto.PIECE_SIZE_UINT64-10, proto.PIECE_SIZE_UINT64+10) || sf.HaveRange(100, 100) || sf.HaveRange(0, proto.PIECE_SIZE_UINT64*3) {
+		t.Error("Not available range was detected as available")
+	}
+}
+
+func Test_Compress(t *testing.T) {
+	data := bytes.Repeat([]byte{1, 2, 3}, 1000)
+	packed := Compress(data)
+	if packed == nil || len(packed) >= len(data) {
+		t.Fatal("Data was not compressed")
+	}
+
+	z, err := zlib.NewReader(bytes.NewReader(packed))
+	if err != nil {
+		t.Fatalf("Can not open compressed data %v", err)
+	}
+
+	unpacked, err := io.ReadAll(z)
+	if err != nil || !bytes.Equal(unpacked, data) {
+		t.Errorf("Unpacked data does not match %v", err)
+	}
+
+	if Compress([]byte{1}) != nil {
+		t.Error("Not compressible data was compressed")
+	}
+}
+
+func Test_UploadRange(t *testing.T) {
+	sf, content := createUploadFile(t, 25000)
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	s := Session{statSendChan: make(chan StatPacket), uploadSlotRequest: make(chan uploadSlotRequest)}
+	done := make(chan struct{})
+	sent := 0
+	go func() {
+		for {
+			select {
+			case x, ok := <-s.statSendChan:
+				if !ok {
+					close(done)
+					return
+				}
+				sent += x.Counter
+			case req := <-s.uploadSlotRequest:
+				req.res <- 0
+			}
+		}
+	}()
+
+	pc := NewPeerConnection(proto.Endpoint{}, nil, nil)
+	pc.connection = local
+	pc.uploadFile = &sf
+
+	go func() {
+		if err := pc.uploadRange(&s, sf.Hash, 100, 21000); err != nil {
+			t.Errorf("Upload range failed %v", err)
+		}
+		local.Close()
+		close(s.statSendChan)
+	}()
+
+	received := make([]byte, 0)
+	combiner := proto.PacketCombiner{}
+	for {
+		ph, packetBytes, err := combiner.Read(remote)
+		if err != nil {
+			break
+		}
+
+		if ph.Protocol != proto.OP_EDONKEYPROT || ph.Packet != proto.OP_SENDINGPART {
+			t.Fatalf("Unexpected packet %x", ph.Packet)
+		}
+
+		sp := proto.SendingPart{}
+		sb := proto.StateBuffer{Data: packetBytes}
+		sb.Read(&sp)
+		if sb.Error() != nil || sp.Hash != sf.Hash || sp.Begin != uint64(100+len(received)) || sp.End-sp.Begin > UPLOAD_PACKET_SIZE {
+			t.Fatalf("Sending part incorrect %v %v", sp, sb.Error())
+		}
+
+		data := make([]byte, sp.End-sp.Begin)
+		if _, err := io.ReadFull(remote, data); err != nil {
+			t.Fatalf("Can not read part data %v", err)
+		}
+		received = append(received, data...)
+	}
+
+	<-done
+	if !bytes.Equal(received, content[100:21000]) {
+		t.Errorf("Received data does not match, received %d bytes", len(received))
+	}
+
+	if sent <= len(received) {
+		t.Errorf("Upload statistics was not counted, sent %d", sent)
+	}
+}